@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gosonic/lib"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultArtifactStore = "file"
+	defaultArtifactPath  = ".artifacts"
+)
+
+// ArtifactNeed names the artifacts of another stage that are restored into
+// the workspace before a stage runs
+type ArtifactNeed struct {
+	Stage  string            `yaml:"stage"`
+	Paths  []string          `yaml:"paths,omitempty"`  // Globs of the artifacts to restore, all if empty
+	Matrix map[string]string `yaml:"matrix,omitempty"` // Matrix cell of the stage to restore from
+}
+
+// defaultCreateArtifactStore creates the appropriate artifact store based on configuration
+func defaultCreateArtifactStore(config *Config, flags *cli.Context) (lib.ArtifactStore, error) {
+	// CLI flags take precedence over config file
+	storeType := flags.String("artifacts-store")
+	if storeType == "" {
+		storeType = config.Artifacts.Store
+	}
+	if storeType == "" {
+		storeType = defaultArtifactStore
+	}
+
+	path := flags.String("artifacts-path")
+	if path == "" {
+		path = config.Artifacts.Path
+	}
+
+	switch storeType {
+	case "file":
+		if path == "" {
+			path = defaultArtifactPath
+		}
+		return lib.NewLocalArtifactStore(path), nil
+
+	case "s3":
+		bucket := flags.String("artifacts-s3-bucket")
+		if bucket == "" {
+			bucket = config.Artifacts.S3Bucket
+		}
+		if bucket == "" {
+			return nil, fmt.Errorf("s3 bucket must be specified for s3 artifact store")
+		}
+
+		client, err := createS3Client(context.Background(), artifactS3Settings(config, flags))
+		if err != nil {
+			return nil, fmt.Errorf("creating S3 client: %w", err)
+		}
+		return lib.NewS3ArtifactStore(client, bucket, path), nil
+
+	default:
+		return nil, fmt.Errorf("unknown artifact store type: %s", storeType)
+	}
+}
+
+// storeArtifacts collects the artifacts of a successful stage run from the
+// workspace and saves them in the artifact store
+func storeArtifacts(ctx *cli.Context, name string, stage Stage, matrix map[string]string, config *Config, gitRev string, out io.Writer) error {
+	if len(stage.Artifacts) == 0 {
+		return nil
+	}
+
+	artifacts, err := lib.CollectArtifacts(config.Dir, stage.Artifacts)
+	if err != nil {
+		return fmt.Errorf("collecting artifacts of stage %q: %w", name, err)
+	}
+
+	store, err := createArtifactStore(config, ctx)
+	if err != nil {
+		return fmt.Errorf("creating artifact store: %w", err)
+	}
+
+	manifest := lib.ArtifactManifest{
+		Project:     config.Project.Name,
+		GitRevision: gitRev,
+		Stage:       name,
+		Matrix:      matrix,
+		CreatedAt:   time.Now(),
+		Artifacts:   artifacts,
+	}
+	if err := store.Save(manifest, config.Dir); err != nil {
+		return fmt.Errorf("storing artifacts of stage %q: %w", name, err)
+	}
+
+	fmt.Fprintf(out, "Stored %d artifact(s) of stage %s\n", len(artifacts), name)
+	return nil
+}
+
+// restoreArtifacts restores the artifacts a stage needs into the workspace
+func restoreArtifacts(ctx *cli.Context, name string, stage Stage, config *Config, gitRev string, out io.Writer) error {
+	if len(stage.NeedsArtifacts) == 0 {
+		return nil
+	}
+
+	store, err := createArtifactStore(config, ctx)
+	if err != nil {
+		return fmt.Errorf("creating artifact store: %w", err)
+	}
+
+	manifests, err := store.List(config.Project.Name, gitRev)
+	if err != nil {
+		return fmt.Errorf("listing artifacts: %w", err)
+	}
+
+	for _, need := range stage.NeedsArtifacts {
+		manifest, found, err := selectManifest(manifests, need.Stage, need.Matrix)
+		if err != nil {
+			return fmt.Errorf("stage %q needs artifacts of stage %q: %w, select one with matrix in needs_artifacts", name, need.Stage, err)
+		}
+		if !found {
+			return fmt.Errorf("stage %q needs artifacts of stage %q, but none were stored for revision %s", name, need.Stage, gitRev)
+		}
+
+		restored, err := lib.RestoreArtifacts(store, manifest, config.Dir, need.Paths)
+		if err != nil {
+			return fmt.Errorf("restoring artifacts of stage %q: %w", need.Stage, err)
+		}
+		label := need.Stage
+		if len(manifest.Matrix) > 0 {
+			label += " " + matrixLabel(manifest.Matrix)
+		}
+		fmt.Fprintf(out, "Restored %d artifact(s) of stage %s\n", len(restored), label)
+	}
+	return nil
+}
+
+// selectManifest returns the manifest stored by the stage in the matrix cell
+// matching all values of selector. The cells of a matrix stage store their
+// artifacts at the same paths, so only one of them can be restored and a
+// selector matching several cells is an error.
+func selectManifest(manifests []lib.ArtifactManifest, stage string, selector map[string]string) (lib.ArtifactManifest, bool, error) {
+	var matches []lib.ArtifactManifest
+	for _, manifest := range manifests {
+		if manifest.Stage == stage && matchesCell(manifest.Matrix, selector) {
+			matches = append(matches, manifest)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return lib.ArtifactManifest{}, false, nil
+	case 1:
+		return matches[0], true, nil
+	}
+	cells := make([]string, len(matches))
+	for i, manifest := range matches {
+		cells[i] = matrixLabel(manifest.Matrix)
+	}
+	sort.Strings(cells)
+	return lib.ArtifactManifest{}, false, fmt.Errorf("artifacts were stored by %d matrix cells (%s)", len(matches), strings.Join(cells, "; "))
+}
+
+// matchesCell reports whether the matrix cell has all values of selector
+func matchesCell(cell, selector map[string]string) bool {
+	for dim, value := range selector {
+		if v, ok := cell[dim]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMatrixSelector parses dimension=value pairs
+func parseMatrixSelector(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	selector := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		dim, value, ok := strings.Cut(pair, "=")
+		if !ok || dim == "" {
+			return nil, fmt.Errorf("invalid matrix selector %q, expected dimension=value", pair)
+		}
+		selector[dim] = value
+	}
+	return selector, nil
+}
+
+// artifactsCommand creates the command to inspect and download stored artifacts
+func artifactsCommand(config *Config) *cli.Command {
+	revisionFlag := &cli.StringFlag{
+		Name:  "revision",
+		Usage: "Git revision to use, defaults to the current revision",
+	}
+
+	// revision returns the revision given on the command line or the current one
+	revision := func(ctx *cli.Context) string {
+		if rev := ctx.String("revision"); rev != "" {
+			return rev
+		}
+		rev, err := getGitRevision()
+		if err != nil {
+			return "unknown"
+		}
+		return rev
+	}
+
+	return &cli.Command{
+		Name:  "artifacts",
+		Usage: "Inspect and download stored artifacts",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "list",
+				Usage:     "List the artifacts stored for a git revision",
+				ArgsUsage: "[stage...]",
+				Flags:     []cli.Flag{revisionFlag},
+				Action: func(ctx *cli.Context) error {
+					store, err := createArtifactStore(config, ctx)
+					if err != nil {
+						return fmt.Errorf("creating artifact store: %w", err)
+					}
+
+					rev := revision(ctx)
+					manifests, err := store.List(config.Project.Name, rev)
+					if err != nil {
+						return fmt.Errorf("listing artifacts: %w", err)
+					}
+
+					stages := ctx.Args().Slice()
+					for _, manifest := range manifests {
+						if len(stages) > 0 && !slices.Contains(stages, manifest.Stage) {
+							continue
+						}
+						label := manifest.Stage
+						if len(manifest.Matrix) > 0 {
+							label += " " + matrixLabel(manifest.Matrix)
+						}
+						for _, artifact := range manifest.Artifacts {
+							fmt.Printf("%s\t%s\t%d\tsha256:%s\n", label, artifact.Path, artifact.Size, artifact.SHA256)
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "get",
+				Usage:     "Download the artifacts of a stage",
+				ArgsUsage: "stage [path...]",
+				Flags: []cli.Flag{
+					revisionFlag,
+					&cli.StringSliceFlag{
+						Name:  "matrix",
+						Usage: "Matrix cell of the stage in dimension=value format (can be specified multiple times)",
+					},
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Value:   ".",
+						Usage:   "Directory to write the artifacts to",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if !ctx.Args().Present() {
+						return fmt.Errorf("no stage specified")
+					}
+					stage := ctx.Args().First()
+					paths := ctx.Args().Tail()
+					selector, err := parseMatrixSelector(ctx.StringSlice("matrix"))
+					if err != nil {
+						return err
+					}
+
+					store, err := createArtifactStore(config, ctx)
+					if err != nil {
+						return fmt.Errorf("creating artifact store: %w", err)
+					}
+
+					rev := revision(ctx)
+					manifests, err := store.List(config.Project.Name, rev)
+					if err != nil {
+						return fmt.Errorf("listing artifacts: %w", err)
+					}
+
+					manifest, found, err := selectManifest(manifests, stage, selector)
+					if err != nil {
+						return fmt.Errorf("stage %q: %w, select one with --matrix", stage, err)
+					}
+					if !found {
+						return fmt.Errorf("no artifacts of stage %q stored for revision %s", stage, rev)
+					}
+
+					restored, err := lib.RestoreArtifacts(store, manifest, ctx.String("output"), paths)
+					if err != nil {
+						return err
+					}
+					for _, artifact := range restored {
+						fmt.Println(filepath.Join(ctx.String("output"), filepath.FromSlash(artifact.Path)))
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// matrixLabel formats matrix cell values like "region=us-east-1,env=prod",
+// ordered by dimension name
+func matrixLabel(matrix map[string]string) string {
+	label := ""
+	for _, dim := range sortedKeys(matrix) {
+		if label != "" {
+			label += ","
+		}
+		label += dim + "=" + matrix[dim]
+	}
+	return label
+}
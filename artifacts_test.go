@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gosonic/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestArtifactsHandOff(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	// Artifacts are collected from and restored into the working directory
+	tmpDir := t.TempDir()
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(tmpDir))
+	defer os.Chdir(wd)
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+audit:
+  path: "logs"
+artifacts:
+  store: "file"
+  path: "store"
+stages:
+  build:
+    runner: "golang"
+    commands:
+      - "go build -o bin/app"
+    artifacts:
+      - "bin/*"
+  deploy:
+    runner: "alpine"
+    commands:
+      - "./bin/app deploy"
+    needs_artifacts:
+      - stage: "build"
+        paths: ["bin/app"]
+`)
+	assert.NoError(t, os.WriteFile("sonic.yml", configData, 0644))
+
+	var deployed string
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		switch args[len(args)-1] {
+		case "bin/app":
+			os.MkdirAll("bin", 0755)
+			os.WriteFile(filepath.Join("bin", "app"), []byte("binary"), 0755)
+		case "deploy":
+			content, _ := os.ReadFile(filepath.Join("bin", "app"))
+			deployed = string(content)
+		}
+		return lib.DockerResult{}
+	}
+
+	// Stages whose artifacts are needed have to succeed first
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", "sonic.yml", "run", "deploy"})
+	})
+	assert.ErrorContains(t, err, "required stages not completed successfully: build")
+
+	// With both stages in one run, the producer runs first even in parallel
+	stdout, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", "sonic.yml", "run", "--parallel", "2", "deploy", "build"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, stdout, "Restored 1 artifact(s) of stage build")
+	assert.Equal(t, "binary", deployed)
+	assert.NoError(t, os.RemoveAll("bin"))
+	deployed = ""
+
+	stdout, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", "sonic.yml", "run", "build"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, stdout, "Stored 1 artifact(s) of stage build")
+
+	// The next stage gets the artifact back even if the workspace was cleaned
+	assert.NoError(t, os.RemoveAll("bin"))
+	stdout, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", "sonic.yml", "run", "deploy"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, stdout, "Restored 1 artifact(s) of stage build")
+	assert.Equal(t, "binary", deployed)
+
+	gitRev, err := lib.GetGitRevision()
+	if err != nil {
+		gitRev = "unknown"
+	}
+
+	t.Run("list", func(t *testing.T) {
+		stdout, _, err := captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", "sonic.yml", "artifacts", "list", "--revision", gitRev})
+		})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(stdout, "build\tbin/app\t6\tsha256:"), stdout)
+	})
+
+	t.Run("get", func(t *testing.T) {
+		stdout, _, err := captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", "sonic.yml", "artifacts", "get", "--output", "out", "build"})
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout, filepath.Join("out", "bin", "app"))
+
+		content, err := os.ReadFile(filepath.Join("out", "bin", "app"))
+		assert.NoError(t, err)
+		assert.Equal(t, "binary", string(content))
+	})
+
+	t.Run("unknown revision", func(t *testing.T) {
+		_, _, err := captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", "sonic.yml", "artifacts", "get", "--revision", "0000000", "build"})
+		})
+		assert.ErrorContains(t, err, "no artifacts of stage \"build\" stored for revision 0000000")
+	})
+}
+
+func TestArtifactsOutsideProject(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	// gosonic runs in another directory than the sonic file's
+	tmpDir := t.TempDir()
+	project := filepath.Join(tmpDir, "project")
+	assert.NoError(t, os.MkdirAll(project, 0755))
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(tmpDir))
+	defer os.Chdir(wd)
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+audit:
+  path: "logs"
+artifacts:
+  store: "file"
+  path: "store"
+stages:
+  build:
+    runner: "golang"
+    commands:
+      - "go build -o bin/app"
+    artifacts:
+      - "bin/*"
+  deploy:
+    runner: "alpine"
+    commands:
+      - "./bin/app deploy"
+    needs_artifacts:
+      - stage: "build"
+`)
+	configPath := filepath.Join(project, "sonic.yml")
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		if args[len(args)-1] == "bin/app" {
+			os.MkdirAll(filepath.Join(project, "bin"), 0755)
+			os.WriteFile(filepath.Join(project, "bin", "app"), []byte("binary"), 0755)
+		}
+		return lib.DockerResult{}
+	}
+
+	stdout, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "run", "build"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, stdout, "Stored 1 artifact(s) of stage build")
+
+	// Artifacts are restored into the project, not the working directory
+	assert.NoError(t, os.RemoveAll(filepath.Join(project, "bin")))
+	stdout, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "run", "deploy"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, stdout, "Restored 1 artifact(s) of stage build")
+	assert.FileExists(t, filepath.Join(project, "bin", "app"))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "bin", "app"))
+}
+
+func TestRestoreArtifactsMissing(t *testing.T) {
+	config := &Config{}
+	config.Project.Name = "test-project"
+	config.Artifacts.Path = t.TempDir()
+
+	originalCreateArtifactStore := createArtifactStore
+	defer func() { createArtifactStore = originalCreateArtifactStore }()
+	store := lib.NewLocalArtifactStore(config.Artifacts.Path)
+	createArtifactStore = func(*Config, *cli.Context) (lib.ArtifactStore, error) {
+		return store, nil
+	}
+
+	stage := Stage{NeedsArtifacts: []ArtifactNeed{{Stage: "build"}}}
+	err := restoreArtifacts(nil, "deploy", stage, config, "abc123", io.Discard)
+	assert.ErrorContains(t, err, `stage "deploy" needs artifacts of stage "build", but none were stored for revision abc123`)
+}
+
+func TestRestoreArtifactsMatrix(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(tmpDir))
+	defer os.Chdir(wd)
+
+	config := &Config{}
+	config.Project.Name = "test-project"
+
+	originalCreateArtifactStore := createArtifactStore
+	defer func() { createArtifactStore = originalCreateArtifactStore }()
+	store := lib.NewLocalArtifactStore(filepath.Join(tmpDir, "store"))
+	createArtifactStore = func(*Config, *cli.Context) (lib.ArtifactStore, error) {
+		return store, nil
+	}
+
+	// Every cell of the build matrix stores its binary at the same path
+	for _, goos := range []string{"linux", "darwin"} {
+		dir := filepath.Join(tmpDir, "build-"+goos)
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "bin", "app"), []byte(goos+" binary"), 0755))
+		artifacts, err := lib.CollectArtifacts(dir, []string{"bin/*"})
+		assert.NoError(t, err)
+		assert.NoError(t, store.Save(lib.ArtifactManifest{
+			Project:     "test-project",
+			GitRevision: "abc123",
+			Stage:       "build",
+			Matrix:      map[string]string{"os": goos, "arch": "amd64"},
+			Artifacts:   artifacts,
+		}, dir))
+	}
+
+	stage := Stage{NeedsArtifacts: []ArtifactNeed{{Stage: "build"}}}
+	err = restoreArtifacts(nil, "deploy", stage, config, "abc123", io.Discard)
+	assert.ErrorContains(t, err, `stage "deploy" needs artifacts of stage "build": artifacts were stored by 2 matrix cells (arch=amd64,os=darwin; arch=amd64,os=linux), select one with matrix in needs_artifacts`)
+	assert.NoFileExists(t, filepath.Join("bin", "app"))
+
+	stage.NeedsArtifacts[0].Matrix = map[string]string{"os": "linux"}
+	var out strings.Builder
+	assert.NoError(t, restoreArtifacts(nil, "deploy", stage, config, "abc123", &out))
+	assert.Equal(t, "Restored 1 artifact(s) of stage build arch=amd64,os=linux\n", out.String())
+	content, err := os.ReadFile(filepath.Join("bin", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "linux binary", string(content))
+
+	stage.NeedsArtifacts[0].Matrix = map[string]string{"os": "windows"}
+	err = restoreArtifacts(nil, "deploy", stage, config, "abc123", io.Discard)
+	assert.ErrorContains(t, err, "none were stored for revision abc123")
+
+	// artifacts get selects the cell the same way
+	assert.NoError(t, os.WriteFile("sonic.yml", []byte("version: \"1\"\nproject:\n  name: \"test-project\"\n"), 0644))
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", "sonic.yml", "artifacts", "get", "--revision", "abc123", "--output", "out", "build"})
+	})
+	assert.ErrorContains(t, err, `stage "build": artifacts were stored by 2 matrix cells`)
+	assert.ErrorContains(t, err, "select one with --matrix")
+
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", "sonic.yml", "artifacts", "get", "--revision", "abc123", "--matrix", "os=darwin", "--output", "out", "build"})
+	})
+	assert.NoError(t, err)
+	content, err = os.ReadFile(filepath.Join("out", "bin", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "darwin binary", string(content))
+}
@@ -0,0 +1,445 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// manifestFile is the name of the file describing a stage's artifacts
+const manifestFile = "manifest.json"
+
+// Artifact is a single file produced by a stage
+type Artifact struct {
+	Path   string `json:"path"` // Slash separated, relative to the workspace
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArtifactManifest describes the artifacts collected from one stage run
+type ArtifactManifest struct {
+	Project     string            `json:"project"`
+	GitRevision string            `json:"git_revision"`
+	Stage       string            `json:"stage"`
+	Matrix      map[string]string `json:"matrix,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Artifacts   []Artifact        `json:"artifacts"`
+}
+
+// ArtifactStore defines the interface for artifact persistence
+type ArtifactStore interface {
+	// Save stores the manifest together with the content of its artifacts,
+	// read from the files below dir
+	Save(manifest ArtifactManifest, dir string) error
+	// List returns the manifests stored for a project and git revision
+	List(project, gitRevision string) ([]ArtifactManifest, error)
+	// Open returns the content of an artifact of the manifest
+	Open(manifest ArtifactManifest, artifact Artifact) (io.ReadCloser, error)
+}
+
+// LocalArtifactStore implements ArtifactStore using the local filesystem
+type LocalArtifactStore struct {
+	Directory string // Directory where artifacts will be stored
+}
+
+// S3ArtifactStore implements ArtifactStore using AWS S3
+type S3ArtifactStore struct {
+	Client     S3Client
+	BucketName string
+	Prefix     string // Optional prefix for S3 keys
+}
+
+// NewLocalArtifactStore creates a new LocalArtifactStore with the given directory
+func NewLocalArtifactStore(directory string) *LocalArtifactStore {
+	return &LocalArtifactStore{
+		Directory: directory,
+	}
+}
+
+// NewS3ArtifactStore creates a new S3ArtifactStore with the given client and bucket
+func NewS3ArtifactStore(client S3Client, bucketName string, prefix string) *S3ArtifactStore {
+	return &S3ArtifactStore{
+		Client:     client,
+		BucketName: bucketName,
+		Prefix:     prefix,
+	}
+}
+
+// CollectArtifacts returns the files below dir matching any of the globs,
+// with their size and checksum. Every glob must match at least one file.
+func CollectArtifacts(dir string, patterns []string) ([]Artifact, error) {
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		files, err := globFiles(dir, []string{pattern})
+		if err != nil {
+			return nil, fmt.Errorf("matching artifacts: %w", err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("artifact %q matched no files", pattern)
+		}
+		for _, file := range files {
+			seen[file] = true
+		}
+	}
+
+	artifacts := make([]Artifact, 0, len(seen))
+	for file := range seen {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading artifact %s: %w", file, err)
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, Artifact{Path: file, Size: info.Size(), SHA256: sum})
+	}
+
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Path < artifacts[j].Path })
+	return artifacts, nil
+}
+
+// CopyArtifact writes the content of an artifact to w and verifies its checksum
+func CopyArtifact(store ArtifactStore, manifest ArtifactManifest, artifact Artifact, w io.Writer) error {
+	r, err := store.Open(manifest, artifact)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+		return fmt.Errorf("reading artifact %s: %w", artifact.Path, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != artifact.SHA256 {
+		return fmt.Errorf("checksum mismatch for artifact %s: expected %s, got %s", artifact.Path, artifact.SHA256, sum)
+	}
+	return nil
+}
+
+// RestoreArtifacts writes the artifacts of the manifest matching any of the
+// globs to their paths below dir. No globs restore all artifacts.
+func RestoreArtifacts(store ArtifactStore, manifest ArtifactManifest, dir string, patterns []string) ([]Artifact, error) {
+	var restored []Artifact
+	for _, artifact := range manifest.Artifacts {
+		if len(patterns) > 0 {
+			ok, err := MatchAnyGlob(patterns, artifact.Path)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		target, err := artifactPath(dir, artifact.Path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, fmt.Errorf("creating artifact directory: %w", err)
+		}
+
+		// Write to a temporary file first so a corrupt artifact doesn't
+		// replace an existing file
+		f, err := os.CreateTemp(filepath.Dir(target), ".artifact-*")
+		if err != nil {
+			return nil, fmt.Errorf("restoring artifact %s: %w", artifact.Path, err)
+		}
+		err = CopyArtifact(store, manifest, artifact, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), target)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return nil, fmt.Errorf("restoring artifact %s: %w", artifact.Path, err)
+		}
+		restored = append(restored, artifact)
+	}
+	return restored, nil
+}
+
+// artifactPath returns the path of an artifact below dir, rejecting paths
+// that would escape it
+func artifactPath(dir, name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid artifact path %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// manifestDir returns the slash separated location of a manifest, relative
+// to the store's root
+func (m ArtifactManifest) manifestDir() string {
+	return path.Join(m.Project, m.GitRevision, m.Stage+matrixKey(m.Matrix))
+}
+
+// Save implements ArtifactStore for LocalArtifactStore
+func (ls *LocalArtifactStore) Save(manifest ArtifactManifest, dir string) error {
+	base := filepath.Join(ls.Directory, filepath.FromSlash(manifest.manifestDir()))
+
+	// Replace the artifacts of an earlier run of the same stage
+	if err := os.RemoveAll(filepath.Join(base, "files")); err != nil {
+		return fmt.Errorf("removing previous artifacts: %w", err)
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return fmt.Errorf("creating artifact directory: %w", err)
+	}
+
+	for _, artifact := range manifest.Artifacts {
+		target, err := artifactPath(filepath.Join(base, "files"), artifact.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("creating artifact directory: %w", err)
+		}
+		if err := copyFile(filepath.Join(dir, filepath.FromSlash(artifact.Path)), target); err != nil {
+			return fmt.Errorf("storing artifact %s: %w", artifact.Path, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling artifact manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, manifestFile), data, 0644); err != nil {
+		return fmt.Errorf("writing artifact manifest: %w", err)
+	}
+	return nil
+}
+
+// List implements ArtifactStore for LocalArtifactStore
+func (ls *LocalArtifactStore) List(project, gitRevision string) ([]ArtifactManifest, error) {
+	dir := filepath.Join(ls.Directory, project, gitRevision)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading artifacts directory: %w", err)
+	}
+
+	var manifests []ArtifactManifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name(), manifestFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("reading artifact manifest: %w", err)
+		}
+
+		var manifest ArtifactManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("parsing artifact manifest %s: %w", entry.Name(), err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// Open implements ArtifactStore for LocalArtifactStore
+func (ls *LocalArtifactStore) Open(manifest ArtifactManifest, artifact Artifact) (io.ReadCloser, error) {
+	base := filepath.Join(ls.Directory, filepath.FromSlash(manifest.manifestDir()), "files")
+	path, err := artifactPath(base, artifact.Path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening artifact %s: %w", artifact.Path, err)
+	}
+	return f, nil
+}
+
+// key returns the S3 key of a file relative to the store's prefix
+func (s *S3ArtifactStore) key(parts ...string) string {
+	key := path.Join(parts...)
+	if s.Prefix != "" {
+		key = path.Join(s.Prefix, key)
+	}
+	return key
+}
+
+// Save implements ArtifactStore for S3ArtifactStore
+func (s *S3ArtifactStore) Save(manifest ArtifactManifest, dir string) error {
+	ctx := context.Background()
+	base := manifest.manifestDir()
+
+	for _, artifact := range manifest.Artifacts {
+		if _, err := artifactPath("", artifact.Path); err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(artifact.Path)))
+		if err != nil {
+			return fmt.Errorf("storing artifact %s: %w", artifact.Path, err)
+		}
+		key := s.key(base, "files", artifact.Path)
+		_, err = s.Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &s.BucketName,
+			Key:    &key,
+			Body:   f,
+		})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("uploading artifact %s to S3: %w", artifact.Path, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling artifact manifest: %w", err)
+	}
+	key := s.key(base, manifestFile)
+	_, err = s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &s.BucketName,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading artifact manifest to S3: %w", err)
+	}
+
+	// Remove the files of an earlier save of the same stage that aren't
+	// part of this one, once the manifest no longer refers to them
+	return s.removeStale(ctx, s.key(base, "files")+"/", manifest)
+}
+
+// removeStale deletes the files below prefix that aren't in the manifest
+func (s *S3ArtifactStore) removeStale(ctx context.Context, prefix string, manifest ArtifactManifest) error {
+	keep := make(map[string]bool, len(manifest.Artifacts))
+	for _, artifact := range manifest.Artifacts {
+		keep[prefix+artifact.Path] = true
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: &s.BucketName,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing previous artifacts in S3: %w", err)
+		}
+		for _, object := range page.Contents {
+			if object.Key == nil || keep[*object.Key] {
+				continue
+			}
+			if _, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &s.BucketName,
+				Key:    object.Key,
+			}); err != nil {
+				return fmt.Errorf("removing previous artifact %s from S3: %w", *object.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// List implements ArtifactStore for S3ArtifactStore
+func (s *S3ArtifactStore) List(project, gitRevision string) ([]ArtifactManifest, error) {
+	ctx := context.Background()
+	prefix := s.key(project, gitRevision) + "/"
+
+	var manifests []ArtifactManifest
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: &s.BucketName,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing artifacts in S3: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			if object.Key == nil {
+				continue
+			}
+			// Manifests sit directly below the revision, artifact files are nested deeper
+			rest := strings.TrimPrefix(*object.Key, prefix)
+			if strings.Count(rest, "/") != 1 || path.Base(rest) != manifestFile {
+				continue
+			}
+
+			data, err := s.get(ctx, *object.Key)
+			if err != nil {
+				return nil, fmt.Errorf("downloading artifact manifest: %w", err)
+			}
+			var manifest ArtifactManifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, fmt.Errorf("parsing artifact manifest %s: %w", *object.Key, err)
+			}
+			manifests = append(manifests, manifest)
+		}
+	}
+	return manifests, nil
+}
+
+// Open implements ArtifactStore for S3ArtifactStore
+func (s *S3ArtifactStore) Open(manifest ArtifactManifest, artifact Artifact) (io.ReadCloser, error) {
+	if _, err := artifactPath("", artifact.Path); err != nil {
+		return nil, err
+	}
+	key := s.key(manifest.manifestDir(), "files", artifact.Path)
+	out, err := s.Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: &s.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("downloading artifact %s from S3: %w", artifact.Path, err)
+	}
+	return out.Body, nil
+}
+
+// get downloads an object
+func (s *S3ArtifactStore) get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"bin/app":         "binary",
+		"dist/app.tar.gz": "archive",
+		"main.go":         "package main",
+	})
+
+	artifacts, err := CollectArtifacts(dir, []string{"bin/*", "dist/**", "bin/app"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Artifact{
+		{Path: "bin/app", Size: 6, SHA256: sha256Hex("binary")},
+		{Path: "dist/app.tar.gz", Size: 7, SHA256: sha256Hex("archive")},
+	}, artifacts)
+
+	_, err = CollectArtifacts(dir, []string{"coverage.out"})
+	assert.ErrorContains(t, err, `artifact "coverage.out" matched no files`)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLocalArtifactStore(t *testing.T) {
+	workspace := t.TempDir()
+	writeFiles(t, workspace, map[string]string{"bin/app": "binary", "bin/tool": "tool"})
+
+	artifacts, err := CollectArtifacts(workspace, []string{"bin/*"})
+	assert.NoError(t, err)
+
+	store := NewLocalArtifactStore(filepath.Join(t.TempDir(), "artifacts"))
+	manifest := ArtifactManifest{
+		Project:     "test-project",
+		GitRevision: "abc123",
+		Stage:       "build",
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+		Artifacts:   artifacts,
+	}
+	assert.NoError(t, store.Save(manifest, workspace))
+
+	// Manifests are listed per revision
+	manifests, err := store.List("test-project", "abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, []ArtifactManifest{manifest}, manifests)
+
+	manifests, err = store.List("test-project", "def456")
+	assert.NoError(t, err)
+	assert.Empty(t, manifests)
+
+	t.Run("restore all", func(t *testing.T) {
+		target := t.TempDir()
+		restored, err := RestoreArtifacts(store, manifest, target, nil)
+		assert.NoError(t, err)
+		assert.Len(t, restored, 2)
+
+		content, err := os.ReadFile(filepath.Join(target, "bin", "app"))
+		assert.NoError(t, err)
+		assert.Equal(t, "binary", string(content))
+	})
+
+	t.Run("restore matching", func(t *testing.T) {
+		target := t.TempDir()
+		restored, err := RestoreArtifacts(store, manifest, target, []string{"bin/tool"})
+		assert.NoError(t, err)
+		assert.Equal(t, []Artifact{artifacts[1]}, restored)
+		assert.NoFileExists(t, filepath.Join(target, "bin", "app"))
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		corrupt := manifest
+		corrupt.Artifacts = []Artifact{{Path: "bin/app", Size: 6, SHA256: strings.Repeat("0", 64)}}
+
+		target := t.TempDir()
+		writeFiles(t, target, map[string]string{"bin/app": "previous"})
+		_, err := RestoreArtifacts(store, corrupt, target, nil)
+		assert.ErrorContains(t, err, "checksum mismatch")
+
+		// The existing file is left untouched
+		content, err := os.ReadFile(filepath.Join(target, "bin", "app"))
+		assert.NoError(t, err)
+		assert.Equal(t, "previous", string(content))
+	})
+
+	t.Run("path outside workspace", func(t *testing.T) {
+		escaping := manifest
+		escaping.Artifacts = []Artifact{{Path: "../etc/passwd"}}
+		_, err := RestoreArtifacts(store, escaping, t.TempDir(), nil)
+		assert.ErrorContains(t, err, "invalid artifact path")
+	})
+}
+
+func TestS3ArtifactStore(t *testing.T) {
+	workspace := t.TempDir()
+	writeFiles(t, workspace, map[string]string{"bin/app": "binary"})
+	artifacts, err := CollectArtifacts(workspace, []string{"bin/app"})
+	assert.NoError(t, err)
+
+	manifest := ArtifactManifest{
+		Project:     "test-project",
+		GitRevision: "abc123",
+		Stage:       "build",
+		Matrix:      map[string]string{"os": "linux"},
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+		Artifacts:   artifacts,
+	}
+	manifestData, err := json.Marshal(manifest)
+	assert.NoError(t, err)
+
+	mockClient := new(MockS3Client)
+	store := NewS3ArtifactStore(mockClient, "test-bucket", "artifacts")
+
+	t.Run("save", func(t *testing.T) {
+		var keys []string
+		mockClient.On("PutObject", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			keys = append(keys, *args.Get(1).(*s3.PutObjectInput).Key)
+		}).Return(&s3.PutObjectOutput{}, nil).Twice()
+
+		// Files of an earlier save that aren't saved again are removed
+		mockClient.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(in *s3.ListObjectsV2Input) bool {
+			return *in.Prefix == "artifacts/test-project/abc123/build[os=linux]/files/"
+		})).Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("artifacts/test-project/abc123/build[os=linux]/files/bin/app")},
+				{Key: aws.String("artifacts/test-project/abc123/build[os=linux]/files/bin/old")},
+			},
+			IsTruncated: aws.Bool(false),
+		}, nil).Once()
+		mockClient.On("DeleteObject", mock.Anything, &s3.DeleteObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("artifacts/test-project/abc123/build[os=linux]/files/bin/old"),
+		}).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+		assert.NoError(t, store.Save(manifest, workspace))
+		assert.Equal(t, []string{
+			"artifacts/test-project/abc123/build[os=linux]/files/bin/app",
+			"artifacts/test-project/abc123/build[os=linux]/manifest.json",
+		}, keys)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		// Results span two pages, artifact files are not manifests
+		mockClient.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(in *s3.ListObjectsV2Input) bool {
+			return in.ContinuationToken == nil && *in.Prefix == "artifacts/test-project/abc123/"
+		})).Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("artifacts/test-project/abc123/build[os=linux]/files/bin/manifest.json")},
+			},
+			IsTruncated:           aws.Bool(true),
+			NextContinuationToken: aws.String("page2"),
+		}, nil).Once()
+		mockClient.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(in *s3.ListObjectsV2Input) bool {
+			return in.ContinuationToken != nil && *in.ContinuationToken == "page2"
+		})).Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("artifacts/test-project/abc123/build[os=linux]/manifest.json")},
+			},
+			IsTruncated: aws.Bool(false),
+		}, nil).Once()
+		mockClient.On("GetObject", mock.Anything, &s3.GetObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("artifacts/test-project/abc123/build[os=linux]/manifest.json"),
+		}).Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(manifestData))}, nil).Once()
+
+		manifests, err := store.List("test-project", "abc123")
+		assert.NoError(t, err)
+		assert.Equal(t, []ArtifactManifest{manifest}, manifests)
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		mockClient.On("GetObject", mock.Anything, &s3.GetObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("artifacts/test-project/abc123/build[os=linux]/files/bin/app"),
+		}).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("binary"))}, nil).Once()
+
+		target := t.TempDir()
+		_, err := RestoreArtifacts(store, manifest, target, nil)
+		assert.NoError(t, err)
+
+		content, err := os.ReadFile(filepath.Join(target, "bin", "app"))
+		assert.NoError(t, err)
+		assert.Equal(t, "binary", string(content))
+	})
+
+	mockClient.AssertExpectations(t)
+}
@@ -5,28 +5,51 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 // Allow mocking exec.Command in tests
 var execCommand = exec.Command
 
+// Statuses of audit logs. An attempt is stored as running before it starts
+// and overwritten with its final status when it ends, so an interrupted
+// attempt stays running and is never taken for a successful one.
+const (
+	StatusRunning   = "running"
+	StatusSuccess   = "success"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+	StatusTimeout   = "timeout"
+	StatusSkipped   = "skipped"
+	StatusCached    = "cached"
+)
+
 // S3Client defines the interface for S3 operations we need
 type S3Client interface {
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
 }
 
 // AuditStore defines the interface for audit log persistence
 type AuditStore interface {
 	// Store persists the audit log
 	Store(log AuditLog) error
-	// LoadLogs loads all audit logs for a project and git revision
+	// StoreRun persists the record of a run
+	StoreRun(run Run) error
+	// LoadLogs loads all audit logs for a project and git revision. An empty
+	// git revision loads the logs of all revisions.
 	LoadLogs(project, gitRevision string) ([]AuditLog, error)
 }
 
@@ -35,43 +58,122 @@ type FileStore struct {
 	Directory string // Directory where logs will be stored
 }
 
-// S3Store implements AuditStore using AWS S3
+// S3Store implements AuditStore using AWS S3. Logs are stored below the
+// project and git revision, so the logs of a revision are listed without
+// the rest of the project's history.
 type S3Store struct {
 	Client     S3Client
 	BucketName string
 	Prefix     string // Optional prefix for S3 keys
+
+	mu         sync.Mutex
+	downloaded map[string]downloadedLog // Logs already downloaded by key
+}
+
+// downloadedLog is a parsed log with the ETag of the object it came from
+type downloadedLog struct {
+	etag string
+	log  AuditLog
 }
 
 type AuditLog struct {
-	Project     string    `json:"project"`
-	GitRevision string    `json:"git_revision"`
-	Stage       string    `json:"stage"`
-	Command     string    `json:"command"`
-	StartTime   time.Time `json:"start_time"`
-	Duration    float64   `json:"duration"`
-	Status      string    `json:"status"`
-	Error       string    `json:"error,omitempty"`
+	SchemaVersion int    `json:"schema_version"`
+	RunID         string `json:"run_id,omitempty"` // ID of the run the stage was part of
+
+	Project     string            `json:"project"`
+	GitRevision string            `json:"git_revision"`
+	Branch      string            `json:"branch,omitempty"`
+	Stage       string            `json:"stage"`
+	Matrix      map[string]string `json:"matrix,omitempty"`
+	Attempt     int               `json:"attempt,omitempty"`
+	Command     string            `json:"command"`
+	Host        bool              `json:"host,omitempty"`         // Ran directly on the host by the shell runner
+	Runtime     string            `json:"runtime,omitempty"`      // Container runtime that ran the stage
+	Image       string            `json:"image,omitempty"`        // Runner image reference
+	ImageDigest string            `json:"image_digest,omitempty"` // Digest of the runner image that ran
+	ImageID     string            `json:"image_id,omitempty"`     // ID of the runner image if it has no digest, e.g. built by gosonic
+	User        string            `json:"user,omitempty"`         // User the container ran as, if not the image's
+	StartTime   time.Time         `json:"start_time"`
+	EndTime     *time.Time        `json:"end_time,omitempty"` // Unset while the stage is running
+	Duration    float64           `json:"duration"`           // Seconds from start to end
+	Status      string            `json:"status"`
+	ExitCode    *int              `json:"exit_code,omitempty"` // Exit code of the container or host process
+	Error       string            `json:"error,omitempty"`
+	Reason      string            `json:"reason,omitempty"`    // Why the stage was skipped, or oom_killed, probable_oom or command_timeout
+	CacheKey    string            `json:"cache_key,omitempty"` // Hash of the stage's inputs and configuration
+	Coverage    *float64          `json:"coverage,omitempty"`  // Total coverage in percent
+	Usage       *ResourceUsage    `json:"usage,omitempty"`     // Resources the container used
+	Output      string            `json:"output,omitempty"`    // Tail of the stage output
 }
 
 // generateFilename creates a consistent filename for the audit log
 func (a AuditLog) generateFilename() string {
+	stage := a.Stage
+	stage += matrixKey(a.Matrix)
+	if a.Attempt > 1 {
+		stage += fmt.Sprintf("-attempt%d", a.Attempt)
+	}
+	// Runs started in the same second get their own files
+	timestamp := a.StartTime.Format("20060102-150405")
+	if a.RunID != "" {
+		timestamp += "-" + a.RunID
+	}
+
 	return fmt.Sprintf("%s-%s-%s.json",
 		a.Project,
-		a.Stage,
-		a.StartTime.Format("20060102-150405"),
+		stage,
+		timestamp,
 	)
 }
 
+// matrixEscaper escapes the characters separating the dimensions and values
+// of a matrix key, and the path separators
+var matrixEscaper = strings.NewReplacer("%", "%25", "[", "%5B", "]", "%5D", "=", "%3D", ",", "%2C", "/", "%2F", `\`, "%5C")
+
+// matrixKey returns a matrix cell as [dimension=value,...] in dimension name
+// order, or an empty string if there is no matrix. Separators in dimension
+// names and values are escaped, so different cells never share a key.
+func matrixKey(matrix map[string]string) string {
+	if len(matrix) == 0 {
+		return ""
+	}
+	dims := sortedKeys(matrix)
+	pairs := make([]string, len(dims))
+	for i, dim := range dims {
+		pairs[i] = matrixEscaper.Replace(dim) + "=" + matrixEscaper.Replace(matrix[dim])
+	}
+	return "[" + strings.Join(pairs, ",") + "]"
+}
+
 // marshalLog converts the audit log to JSON bytes
 func (a AuditLog) marshalLog() ([]byte, error) {
+	a.SchemaVersion = AuditSchemaVersion
 	return json.MarshalIndent(a, "", "  ")
 }
 
+// marshalRun converts the run record to JSON bytes
+func (r Run) marshalRun() ([]byte, error) {
+	r.SchemaVersion = AuditSchemaVersion
+	return json.MarshalIndent(r, "", "  ")
+}
+
 func (a *AuditLog) SetError(err error) {
-	a.Status = "error"
+	a.Status = StatusFailed
 	a.Error = err.Error()
 }
 
+// finish records the end of an attempt with its final status
+func (a *AuditLog) finish(status string, exitCode int, err error) {
+	end := time.Now()
+	a.EndTime = &end
+	a.Duration = end.Sub(a.StartTime).Seconds()
+	a.Status = status
+	a.ExitCode = &exitCode
+	if err != nil {
+		a.Error = err.Error()
+	}
+}
+
 func GetGitRevision() (string, error) {
 	cmd := execCommand("git", "rev-parse", "HEAD")
 	out, err := cmd.Output()
@@ -88,18 +190,50 @@ func (fs *FileStore) Store(log AuditLog) error {
 		return fmt.Errorf("marshaling audit log: %w", err)
 	}
 
-	// Create logs directory if it doesn't exist
-	if err := os.MkdirAll(fs.Directory, 0755); err != nil {
-		return fmt.Errorf("creating logs directory: %w", err)
+	if err := writeFileAtomic(filepath.Join(fs.Directory, log.generateFilename()), data); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
 	}
+	return nil
+}
 
-	logPath := filepath.Join(fs.Directory, log.generateFilename())
+// StoreRun implements AuditStore for FileStore
+func (fs *FileStore) StoreRun(run Run) error {
+	data, err := run.marshalRun()
+	if err != nil {
+		return fmt.Errorf("marshaling run: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(fs.Directory, filepath.FromSlash(run.key())), data); err != nil {
+		return fmt.Errorf("writing run: %w", err)
+	}
+	return nil
+}
 
-	if err := os.WriteFile(logPath, data, 0644); err != nil {
-		return fmt.Errorf("writing audit log: %w", err)
+// writeFileAtomic writes a file that replaces an earlier version, e.g. the
+// final log replacing the running one. It writes to a temporary file first,
+// so a crash can't leave a truncated file behind.
+func writeFileAtomic(file string, data []byte) error {
+	// Create logs directory if it doesn't exist
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating logs directory: %w", err)
 	}
 
-	return nil
+	tmp, err := os.CreateTemp(dir, ".audit-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
 }
 
 // Store implements AuditStore for S3Store
@@ -109,9 +243,29 @@ func (s *S3Store) Store(log AuditLog) error {
 		return fmt.Errorf("marshaling audit log: %w", err)
 	}
 
-	key := log.generateFilename()
+	key := s.logPrefix(log.Project, log.GitRevision) + log.generateFilename()
+	_, err = s.Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: &s.BucketName,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading audit log to S3: %w", err)
+	}
+
+	return nil
+}
+
+// StoreRun implements AuditStore for S3Store
+func (s *S3Store) StoreRun(run Run) error {
+	data, err := run.marshalRun()
+	if err != nil {
+		return fmt.Errorf("marshaling run: %w", err)
+	}
+
+	key := run.key()
 	if s.Prefix != "" {
-		key = filepath.Join(s.Prefix, key)
+		key = path.Join(s.Prefix, key)
 	}
 
 	_, err = s.Client.PutObject(context.Background(), &s3.PutObjectInput{
@@ -120,7 +274,7 @@ func (s *S3Store) Store(log AuditLog) error {
 		Body:   bytes.NewReader(data),
 	})
 	if err != nil {
-		return fmt.Errorf("uploading audit log to S3: %w", err)
+		return fmt.Errorf("uploading run to S3: %w", err)
 	}
 
 	return nil
@@ -156,7 +310,7 @@ func (fs *FileStore) LoadLogs(project, gitRevision string) ([]AuditLog, error) {
 		}
 
 		// Only include logs for the specified git revision
-		if log.GitRevision == gitRevision {
+		if gitRevision == "" || log.GitRevision == gitRevision {
 			logs = append(logs, log)
 		}
 	}
@@ -182,8 +336,93 @@ func NewS3Store(client S3Client, bucketName string, prefix string) *S3Store {
 
 // LoadLogs implements AuditStore for S3Store
 func (s *S3Store) LoadLogs(project, gitRevision string) ([]AuditLog, error) {
-	// TODO: Implement S3 log loading
-	// This would require listing objects in the bucket with the project prefix
-	// and downloading/parsing each matching log file
-	return nil, fmt.Errorf("S3 log loading not implemented")
+	ctx := context.Background()
+	prefix := s.logPrefix(project, gitRevision)
+	// Keys are revision/filename below the project, filename below a revision
+	depth := 1
+	if gitRevision != "" {
+		depth = 0
+	}
+
+	var logs []AuditLog
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: &s.BucketName,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing audit logs in S3: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if strings.Count(strings.TrimPrefix(key, prefix), "/") != depth || !strings.HasSuffix(key, ".json") {
+				continue
+			}
+
+			log, err := s.load(ctx, key, aws.ToString(object.ETag))
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, log)
+		}
+	}
+
+	return logs, nil
+}
+
+// logPrefix returns the key prefix of the project's logs, or of the logs
+// of one git revision if it's set
+func (s *S3Store) logPrefix(project, gitRevision string) string {
+	prefix := project + "/"
+	if gitRevision != "" {
+		prefix += gitRevision + "/"
+	}
+	if s.Prefix != "" {
+		prefix = path.Join(s.Prefix, prefix) + "/"
+	}
+	return prefix
+}
+
+// load downloads and parses a log. Parsed logs are kept by key and ETag, so
+// loading the project's history again, e.g. for every cache lookup of a
+// run, only downloads logs that were added or replaced since.
+func (s *S3Store) load(ctx context.Context, key, etag string) (AuditLog, error) {
+	s.mu.Lock()
+	cached, ok := s.downloaded[key]
+	s.mu.Unlock()
+	if ok && etag != "" && cached.etag == etag {
+		return cached.log, nil
+	}
+
+	data, err := s.get(ctx, key)
+	if err != nil {
+		return AuditLog{}, fmt.Errorf("downloading audit log %s: %w", key, err)
+	}
+	var log AuditLog
+	if err := json.Unmarshal(data, &log); err != nil {
+		return AuditLog{}, fmt.Errorf("parsing audit log %s: %w", key, err)
+	}
+
+	s.mu.Lock()
+	if s.downloaded == nil {
+		s.downloaded = make(map[string]downloadedLog)
+	}
+	s.downloaded[key] = downloadedLog{etag: etag, log: log}
+	s.mu.Unlock()
+	return log, nil
+}
+
+// get downloads an object
+func (s *S3Store) get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
 }
@@ -2,10 +2,13 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // Mock command execution
@@ -41,7 +45,7 @@ func TestFileStore(t *testing.T) {
 	// Test SetError
 	t.Run("set error", func(t *testing.T) {
 		log.SetError(assert.AnError)
-		assert.Equal(t, "error", log.Status)
+		assert.Equal(t, StatusFailed, log.Status)
 		assert.Equal(t, assert.AnError.Error(), log.Error)
 	})
 
@@ -65,9 +69,39 @@ func TestFileStore(t *testing.T) {
 		assert.Equal(t, log.Project, readLog.Project)
 		assert.Equal(t, log.Stage, readLog.Stage)
 		assert.Equal(t, log.Status, readLog.Status)
+		assert.Equal(t, AuditSchemaVersion, readLog.SchemaVersion)
 	})
 }
 
+func TestFileStoreReplacesRunningLog(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+
+	log := AuditLog{
+		Project:   "test-project",
+		Stage:     "test",
+		StartTime: time.Now(),
+		Status:    StatusRunning,
+	}
+	assert.NoError(t, store.Store(log))
+
+	log.finish(StatusFailed, 2, assert.AnError)
+	assert.NoError(t, store.Store(log))
+
+	// The final log overwrites the running one, no temporary files remain
+	files, err := os.ReadDir(store.Directory)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	logs, err := store.LoadLogs("test-project", "")
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, StatusFailed, logs[0].Status)
+		assert.Equal(t, 2, *logs[0].ExitCode)
+		assert.False(t, logs[0].EndTime.Before(logs[0].StartTime))
+		assert.Equal(t, assert.AnError.Error(), logs[0].Error)
+	}
+}
+
 func TestS3Store(t *testing.T) {
 	mockClient := new(MockS3Client)
 	store := NewS3Store(mockClient, "test-bucket", "logs")
@@ -82,7 +116,7 @@ func TestS3Store(t *testing.T) {
 		Duration:    1.5,
 	}
 
-	expectedKey := filepath.Join("logs", log.generateFilename())
+	expectedKey := "logs/test-project/abc123/" + log.generateFilename()
 	expectedData, _ := log.marshalLog()
 
 	// Set up expectations
@@ -114,3 +148,146 @@ func TestGetGitRevision(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, mockSHA, rev)
 }
+
+func TestGenerateFilenameWithMatrix(t *testing.T) {
+	startTime := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	log := AuditLog{
+		Project:   "test-project",
+		Stage:     "deploy",
+		StartTime: startTime,
+	}
+	assert.Equal(t, "test-project-deploy-20250301-123000.json", log.generateFilename())
+
+	log.Matrix = map[string]string{"region": "us-east-1", "env": "prod"}
+	assert.Equal(t, "test-project-deploy[env=prod,region=us-east-1]-20250301-123000.json", log.generateFilename())
+
+	// Runs in the same second don't overwrite each other
+	log.RunID = "0123456789abcdef"
+	assert.Equal(t, "test-project-deploy[env=prod,region=us-east-1]-20250301-123000-0123456789abcdef.json", log.generateFilename())
+}
+
+func TestMatrixKey(t *testing.T) {
+	assert.Equal(t, "", matrixKey(nil))
+	assert.Equal(t, "[a=x-y,b=z]", matrixKey(map[string]string{"a": "x-y", "b": "z"}))
+	assert.Equal(t, "[a=x,b=y-z]", matrixKey(map[string]string{"a": "x", "b": "y-z"}))
+
+	// Separators and path separators in names and values are escaped
+	assert.Equal(t, "[a=x%2Cb%3Dy]", matrixKey(map[string]string{"a": "x,b=y"}))
+	assert.NotEqual(t, matrixKey(map[string]string{"a": "x,b=y"}), matrixKey(map[string]string{"a": "x", "b": "y"}))
+	assert.Equal(t, "[%5Bk%5D=100%25,os=linux%2Famd64]", matrixKey(map[string]string{"os": "linux/amd64", "[k]": "100%"}))
+}
+
+// newFakeS3Client creates an S3 client talking to a FakeS3
+func newFakeS3Client(t *testing.T, fake *FakeS3) *s3.Client {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+}
+
+func TestS3StoreLoadLogs(t *testing.T) {
+	fake := NewFakeS3()
+	fake.PageSize = 2
+	store := NewS3Store(newFakeS3Client(t, fake), "test-bucket", "ci-logs")
+
+	start := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+	for i, log := range []AuditLog{
+		{Project: "test-project", Stage: "build", GitRevision: "abc123", Status: StatusSuccess},
+		{Project: "test-project", Stage: "test", GitRevision: "abc123", Status: StatusFailed},
+		{Project: "test-project", Stage: "test", GitRevision: "abc123", Attempt: 2, Status: StatusSuccess},
+		{Project: "test-project", Stage: "build", GitRevision: "def456", Status: StatusSuccess},
+		{Project: "test-project-web", Stage: "build", GitRevision: "abc123", Status: StatusSuccess},
+		{Project: "other", Stage: "build", GitRevision: "abc123", Status: StatusSuccess},
+	} {
+		log.RunID = NewRunID()
+		log.StartTime = start.Add(time.Duration(i) * time.Second)
+		require.NoError(t, store.Store(log))
+	}
+	require.NoError(t, store.StoreRun(Run{ID: NewRunID(), Project: "test-project", StartTime: start}))
+
+	tests := map[string]struct {
+		gitRevision string
+		wantStages  []string
+	}{
+		"revision":      {gitRevision: "abc123", wantStages: []string{"build", "test", "test"}},
+		"all revisions": {wantStages: []string{"build", "test", "test", "build"}},
+		"no logs":       {gitRevision: "unknown"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			logs, err := store.LoadLogs("test-project", tc.gitRevision)
+			require.NoError(t, err)
+
+			var stages []string
+			for _, log := range logs {
+				assert.Equal(t, "test-project", log.Project)
+				stages = append(stages, log.Stage)
+			}
+			assert.ElementsMatch(t, tc.wantStages, stages)
+		})
+	}
+
+	// The test-project/ prefix matches 4 keys, listed 2 per page
+	lists := fake.Lists()
+	_, err := store.LoadLogs("test-project", "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.Lists()-lists)
+
+	// A revision's logs are listed without the rest of the history
+	lists = fake.Lists()
+	_, err = store.LoadLogs("test-project", "def456")
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.Lists()-lists)
+
+	// Logs are only downloaded again once they were replaced
+	fresh := NewS3Store(store.Client, "test-bucket", "ci-logs")
+	gets := fake.Gets()
+	_, err = fresh.LoadLogs("test-project", "")
+	require.NoError(t, err)
+	_, err = fresh.LoadLogs("test-project", "")
+	require.NoError(t, err)
+	assert.Equal(t, 4, fake.Gets()-gets)
+
+	log := AuditLog{Project: "test-project", Stage: "deploy", GitRevision: "def456", RunID: NewRunID(), StartTime: start, Status: StatusRunning}
+	require.NoError(t, fresh.Store(log))
+	log.Status = StatusSuccess
+	require.NoError(t, fresh.Store(log))
+	gets = fake.Gets()
+	logs, err := fresh.LoadLogs("test-project", "def456")
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.Gets()-gets)
+	assert.Len(t, logs, 2)
+	for _, l := range logs {
+		if l.Stage == "deploy" {
+			assert.Equal(t, StatusSuccess, l.Status)
+		}
+	}
+}
+
+func TestS3StoreLoadLogsErrors(t *testing.T) {
+	fake := NewFakeS3()
+	client := newFakeS3Client(t, fake)
+
+	_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("test-bucket"),
+		Key:    aws.String("test-project/abc123/test-project-build-20250301-123000.json"),
+		Body:   strings.NewReader("not json"),
+	})
+	require.NoError(t, err)
+
+	_, err = NewS3Store(client, "test-bucket", "").LoadLogs("test-project", "")
+	assert.ErrorContains(t, err, "parsing audit log test-project/abc123/test-project-build-20250301-123000.json")
+
+	mockClient := new(MockS3Client)
+	mockClient.On("ListObjectsV2", mock.Anything, mock.Anything).Return(nil, assert.AnError)
+	_, err = NewS3Store(mockClient, "test-bucket", "").LoadLogs("test-project", "")
+	assert.ErrorContains(t, err, "listing audit logs in S3")
+}
@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDockerfile is built when a build doesn't name a Dockerfile
+const defaultDockerfile = "Dockerfile"
+
+// ImageBuild describes a runner image built from a Dockerfile
+type ImageBuild struct {
+	Context    string            // Build context directory
+	Dockerfile string            // Dockerfile relative to the context, defaults to Dockerfile
+	Args       map[string]string // Build arguments
+}
+
+// dockerfile returns the Dockerfile's path relative to the context
+func (b ImageBuild) dockerfile() string {
+	if b.Dockerfile == "" {
+		return defaultDockerfile
+	}
+	return filepath.ToSlash(filepath.Clean(b.Dockerfile))
+}
+
+// validate checks that the context is a directory containing the Dockerfile
+func (b ImageBuild) validate() error {
+	if b.Context == "" {
+		return fmt.Errorf("build context must be specified")
+	}
+	info, err := os.Stat(b.Context)
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("build context %s is not a directory", b.Context)
+	}
+	dockerfile := b.dockerfile()
+	if filepath.IsAbs(dockerfile) || dockerfile == ".." || strings.HasPrefix(dockerfile, "../") {
+		return fmt.Errorf("dockerfile %s must be inside the build context", b.Dockerfile)
+	}
+	if _, err := os.Stat(filepath.Join(b.Context, dockerfile)); err != nil {
+		return fmt.Errorf("dockerfile %s not found in build context %s", dockerfile, b.Context)
+	}
+	return nil
+}
+
+// hash hashes the content of the build context, the Dockerfile and the
+// build arguments. Images built from the same hash are identical.
+func (b ImageBuild) hash() (string, error) {
+	h := sha256.New()
+	writeField := func(s string) {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+
+	writeField("dockerfile=" + b.dockerfile())
+	for _, k := range sortedKeys(b.Args) {
+		writeField("arg=" + k + "=" + b.Args[k])
+	}
+
+	err := walkContext(b.Context, func(rel string, path string, entry fs.DirEntry) error {
+		switch {
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			writeField("link=" + rel + "=" + target)
+		case entry.Type().IsRegular():
+			sum, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			// The executable bit changes the image too
+			writeField(fmt.Sprintf("file=%s=%s=%o", rel, sum, info.Mode().Perm()))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("hashing build context %s: %w", b.Context, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// walkContext calls fn for every entry below the context directory in
+// lexical order, rel is the entry's slash separated path in the context
+func walkContext(dir string, fn func(rel, path string, entry fs.DirEntry) error) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), path, entry)
+	})
+}
+
+// tarContext archives the build context for the Engine API
+func tarContext(dir string) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := walkContext(dir, func(rel, path string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("archiving build context %s: %w", dir, err)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("archiving build context %s: %w", dir, err)
+	}
+	return &buf, nil
+}
+
+// buildTag returns the tag of a project's runner image built from the
+// context with the given hash
+func buildTag(projectName, hash string) string {
+	return strings.ToLower(dockerName("gosonic-"+projectName+"-runner")) + ":" + hash[:16]
+}
+
+// prepareBuild points the stage's runner at the tag of the image built from
+// its build context. The tag is derived from the content hash, so the cache
+// key changes with the context.
+func prepareBuild(stage *StageExecution, projectName string) error {
+	if err := stage.Build.validate(); err != nil {
+		return err
+	}
+	hash, err := stage.Build.hash()
+	if err != nil {
+		return err
+	}
+	stage.Runner = buildTag(projectName, hash)
+	return nil
+}
+
+// ensureImage builds the stage's runner image unless an image with its tag
+// exists already, and returns the image's ID
+func ensureImage(ctx context.Context, stage StageExecution, out io.Writer) (string, error) {
+	runtime := stage.runtime()
+	if info, err := runtime.Inspect(ctx, stage.Runner); err == nil {
+		fmt.Fprintf(out, "Reusing runner image %s, build context unchanged\n", stage.Runner)
+		return info.ID, nil
+	}
+
+	fmt.Fprintf(out, "Building runner image %s from %s\n", stage.Runner, stage.Build.Context)
+	if err := runtime.Build(ctx, *stage.Build, stage.Runner, out); err != nil {
+		return "", err
+	}
+	info, err := runtime.Inspect(ctx, stage.Runner)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeContext creates a build context with the given files
+func writeContext(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestImageBuildHash(t *testing.T) {
+	files := map[string]string{
+		"Dockerfile":     "FROM alpine\nCOPY tools /tools\n",
+		"tools/lint.sh":  "echo lint",
+		"tools/build.sh": "echo build",
+	}
+	base := ImageBuild{Context: writeContext(t, files), Args: map[string]string{"GO": "1.24"}}
+	baseHash, err := base.hash()
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		build    func(t *testing.T) ImageBuild
+		wantSame bool
+	}{
+		"same content elsewhere": {
+			build: func(t *testing.T) ImageBuild {
+				return ImageBuild{Context: writeContext(t, files), Args: map[string]string{"GO": "1.24"}}
+			},
+			wantSame: true,
+		},
+		"default dockerfile named": {
+			build: func(t *testing.T) ImageBuild {
+				return ImageBuild{Context: base.Context, Dockerfile: "./Dockerfile", Args: map[string]string{"GO": "1.24"}}
+			},
+			wantSame: true,
+		},
+		"changed file": {
+			build: func(t *testing.T) ImageBuild {
+				dir := writeContext(t, files)
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "tools", "lint.sh"), []byte("echo lint2"), 0644))
+				return ImageBuild{Context: dir, Args: map[string]string{"GO": "1.24"}}
+			},
+		},
+		"new file": {
+			build: func(t *testing.T) ImageBuild {
+				dir := writeContext(t, files)
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), nil, 0644))
+				return ImageBuild{Context: dir, Args: map[string]string{"GO": "1.24"}}
+			},
+		},
+		"executable file": {
+			build: func(t *testing.T) ImageBuild {
+				dir := writeContext(t, files)
+				require.NoError(t, os.Chmod(filepath.Join(dir, "tools", "lint.sh"), 0755))
+				return ImageBuild{Context: dir, Args: map[string]string{"GO": "1.24"}}
+			},
+		},
+		"changed arg": {
+			build: func(t *testing.T) ImageBuild {
+				return ImageBuild{Context: base.Context, Args: map[string]string{"GO": "1.25"}}
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			hash, err := tc.build(t).hash()
+			require.NoError(t, err)
+			if tc.wantSame {
+				assert.Equal(t, baseHash, hash)
+			} else {
+				assert.NotEqual(t, baseHash, hash)
+			}
+		})
+	}
+}
+
+func TestImageBuildValidate(t *testing.T) {
+	dir := writeContext(t, map[string]string{"Dockerfile": "FROM alpine", "ci/Dockerfile.ci": "FROM alpine"})
+
+	tests := map[string]struct {
+		build   ImageBuild
+		wantErr string
+	}{
+		"default dockerfile": {build: ImageBuild{Context: dir}},
+		"named dockerfile":   {build: ImageBuild{Context: dir, Dockerfile: "ci/Dockerfile.ci"}},
+		"missing context": {
+			build:   ImageBuild{Context: filepath.Join(dir, "missing")},
+			wantErr: "is not a directory",
+		},
+		"missing dockerfile": {
+			build:   ImageBuild{Context: filepath.Join(dir, "ci")},
+			wantErr: "dockerfile Dockerfile not found",
+		},
+		"dockerfile outside context": {
+			build:   ImageBuild{Context: filepath.Join(dir, "ci"), Dockerfile: "../Dockerfile"},
+			wantErr: "must be inside the build context",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.build.validate()
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestTarContext(t *testing.T) {
+	dir := writeContext(t, map[string]string{"Dockerfile": "FROM alpine", "tools/lint.sh": "echo lint"})
+
+	buf, err := tarContext(dir)
+	require.NoError(t, err)
+
+	files := make(map[string]string)
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(content)
+	}
+	assert.Equal(t, map[string]string{"Dockerfile": "FROM alpine", "tools": "", "tools/lint.sh": "echo lint"}, files)
+}
+
+func TestBuildTag(t *testing.T) {
+	assert.Equal(t, "gosonic-my_app-runner:0123456789abcdef", buildTag("My App", "0123456789abcdef0123"))
+}
+
+func TestExecuteStageBuild(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	dir := writeContext(t, map[string]string{"Dockerfile": "FROM alpine"})
+	stage := StageExecution{
+		Name:     "lint",
+		Build:    &ImageBuild{Context: dir},
+		Commands: []string{"lint"},
+		Output:   io.Discard,
+	}
+
+	built := false
+	var calls []string
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		calls = append(calls, args[1])
+		switch args[1] {
+		case "image":
+			if !built {
+				return DockerResult{Error: errors.New("exit status 1"), Stderr: "No such image"}
+			}
+			return DockerResult{Stdout: `[{"Id": "sha256:built"}]`}
+		case "build":
+			built = true
+		}
+		return DockerResult{}
+	}
+
+	store := &mockAuditStore{}
+	require.NoError(t, ExecuteStage(stage, store, "test"))
+	assert.Equal(t, []string{"image", "build", "image", "run"}, calls)
+
+	log := store.logs[len(store.logs)-1]
+	assert.Equal(t, "sha256:built", log.ImageID)
+	assert.Regexp(t, `^gosonic-test-runner:[0-9a-f]{16}$`, log.Image)
+
+	// The image is reused while the context is unchanged
+	calls = nil
+	require.NoError(t, ExecuteStage(stage, store, "test"))
+	assert.Equal(t, []string{"image", "run"}, calls)
+	assert.Equal(t, "sha256:built", store.logs[len(store.logs)-1].ImageID)
+
+	// Build failures fail the stage before it runs
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		if args[1] == "run" {
+			t.Fatal("stage ran without its image")
+		}
+		return DockerResult{Error: errors.New("exit status 1")}
+	}
+	err := ExecuteStage(stage, store, "other")
+	assert.ErrorContains(t, err, "stage lint: building gosonic-other-runner:")
+}
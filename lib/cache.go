@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CacheKey hashes everything that determines a stage's result: the content
+// of the files matching the input globs, the runner image, the commands,
+// the environment, the matrix cell, the volumes, the user, the resource
+// limits and where the secrets come from, but not their values. Globs are
+// matched against paths relative to root.
+func CacheKey(stage StageExecution, root string) (string, error) {
+	files, err := globFiles(root, stage.Inputs)
+	if err != nil {
+		return "", fmt.Errorf("matching inputs: %w", err)
+	}
+
+	h := sha256.New()
+	writeField := func(s string) {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+
+	writeField("runner=" + stage.Runner)
+	for _, cmd := range stage.Commands {
+		writeField("command=" + cmd)
+	}
+	for _, k := range sortedKeys(stage.Environment) {
+		writeField("env=" + k + "=" + stage.Environment[k])
+	}
+	for _, k := range sortedKeys(stage.Matrix) {
+		writeField("matrix=" + k + "=" + stage.Matrix[k])
+	}
+	for _, v := range stage.Volumes {
+		writeField(fmt.Sprintf("volume=%s=%s=%s=%t=%s=%s", v.Type, v.Source, v.Target, v.Readonly, v.Size, v.Lockfile))
+	}
+	writeField("user=" + stage.User)
+	writeField(fmt.Sprintf("host_user=%t", stage.HostUser))
+	r := stage.Resources
+	writeField(fmt.Sprintf("resources=%s=%s=%d=%s", r.CPUs, r.Memory, r.Pids, r.ShmSize))
+	for _, secret := range stage.Secrets {
+		writeField("secret=" + secret.Name + "=" + secret.Target + "=" + secret.Source)
+	}
+
+	for _, file := range files {
+		sum, err := hashFile(filepath.Join(root, filepath.FromSlash(file)))
+		if err != nil {
+			return "", err
+		}
+		writeField("input=" + file + "=" + sum)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FindCached returns the most recent successful audit log of the stage that
+// was recorded with the given cache key
+func FindCached(logs []AuditLog, stage StageExecution, key string) (AuditLog, bool) {
+	var found AuditLog
+	ok := false
+	for _, log := range logs {
+		if log.Stage != stage.Name || log.Status != StatusSuccess || log.CacheKey != key {
+			continue
+		}
+		if !ok || log.StartTime.After(found.StartTime) {
+			found, ok = log, true
+		}
+	}
+	return found, ok
+}
+
+// OutputsExist reports whether every output glob matches at least one file
+// below root
+func OutputsExist(root string, outputs []string) (bool, error) {
+	for _, pattern := range outputs {
+		files, err := globFiles(root, []string{pattern})
+		if err != nil {
+			return false, fmt.Errorf("matching outputs: %w", err)
+		}
+		if len(files) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// globFiles returns the sorted slash separated paths of the regular files
+// below root matching any of the patterns. The .git directory is ignored.
+func globFiles(root string, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		ok, err := MatchAnyGlob(patterns, rel)
+		if err != nil {
+			return err
+		}
+		if ok {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("hashing %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFiles creates the given files below dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.go":        "package main",
+		"lib/docker.go":  "package lib",
+		"README.md":      "# readme",
+		".git/HEAD":      "ref: refs/heads/main",
+		"lib/docker.txt": "notes",
+	})
+
+	stage := StageExecution{
+		Name:        "build",
+		Runner:      "golang:1.23",
+		Commands:    []string{"go build ./..."},
+		Environment: map[string]string{"CGO_ENABLED": "0"},
+		Inputs:      []string{"**/*.go", ".git/**"},
+	}
+
+	files, err := globFiles(dir, stage.Inputs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lib/docker.go", "main.go"}, files)
+
+	key, err := CacheKey(stage, dir)
+	assert.NoError(t, err)
+	assert.Len(t, key, 64)
+
+	// The key is stable
+	again, err := CacheKey(stage, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	// Files that aren't inputs don't change the key
+	writeFiles(t, dir, map[string]string{"README.md": "# changed"})
+	again, err = CacheKey(stage, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	changes := map[string]func(s *StageExecution){
+		"runner":      func(s *StageExecution) { s.Runner = "golang:1.24" },
+		"commands":    func(s *StageExecution) { s.Commands = []string{"go build -race ./..."} },
+		"environment": func(s *StageExecution) { s.Environment = map[string]string{"CGO_ENABLED": "1"} },
+		"matrix":      func(s *StageExecution) { s.Matrix = map[string]string{"os": "linux"} },
+		"volumes": func(s *StageExecution) {
+			s.Volumes = []Volume{{Type: VolumeCache, Source: "go-mod", Target: "/go/pkg/mod"}}
+		},
+		"user":      func(s *StageExecution) { s.User = "1000:1000" },
+		"host user": func(s *StageExecution) { s.HostUser = true },
+		"resources": func(s *StageExecution) { s.Resources = Resources{Memory: "512m"} },
+		"secrets":   func(s *StageExecution) { s.Secrets = []Secret{{Name: "TOKEN", Value: "hunter2", Source: "env:TOKEN"}} },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			changed := stage
+			change(&changed)
+			other, err := CacheKey(changed, dir)
+			assert.NoError(t, err)
+			assert.NotEqual(t, key, other)
+		})
+	}
+
+	t.Run("secret value", func(t *testing.T) {
+		// Only where secrets come from is hashed, rotating them keeps the key
+		withSecret := stage
+		withSecret.Secrets = []Secret{{Name: "TOKEN", Value: "hunter2", Source: "env:TOKEN"}}
+		first, err := CacheKey(withSecret, dir)
+		require.NoError(t, err)
+		withSecret.Secrets = []Secret{{Name: "TOKEN", Value: "rotated", Source: "env:TOKEN"}}
+		second, err := CacheKey(withSecret, dir)
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("input content", func(t *testing.T) {
+		writeFiles(t, dir, map[string]string{"lib/docker.go": "package lib // changed"})
+		other, err := CacheKey(stage, dir)
+		assert.NoError(t, err)
+		assert.NotEqual(t, key, other)
+	})
+}
+
+func TestFindCached(t *testing.T) {
+	stage := StageExecution{Name: "build"}
+	now := time.Now()
+
+	logs := []AuditLog{
+		{Stage: "build", Status: "success", CacheKey: "abc", GitRevision: "rev1", StartTime: now.Add(-time.Hour)},
+		{Stage: "build", Status: "success", CacheKey: "abc", GitRevision: "rev2", StartTime: now},
+		{Stage: "build", Status: "error", CacheKey: "def", GitRevision: "rev3", StartTime: now},
+		{Stage: "test", Status: "success", CacheKey: "ghi", GitRevision: "rev3", StartTime: now},
+	}
+
+	cached, ok := FindCached(logs, stage, "abc")
+	assert.True(t, ok)
+	assert.Equal(t, "rev2", cached.GitRevision)
+
+	_, ok = FindCached(logs, stage, "def")
+	assert.False(t, ok, "failed runs are not cached")
+
+	_, ok = FindCached(logs, stage, "ghi")
+	assert.False(t, ok, "other stages are not cached")
+}
+
+func TestOutputsExist(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bin/app": "binary"})
+
+	ok, err := OutputsExist(dir, []string{"bin/*"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = OutputsExist(dir, []string{"bin/*", "dist/**"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = OutputsExist(dir, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestExecuteStageCached(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	// Inputs and outputs are resolved relative to the project root, not
+	// the working directory
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"main.go": "package main"})
+
+	runs := 0
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		if args[1] != "run" {
+			return DockerResult{} // The runner image is inspected afterwards
+		}
+		runs++
+		writeFiles(t, dir, map[string]string{"bin/app": "binary"})
+		return DockerResult{}
+	}
+
+	store := &mockAuditStore{}
+	stage := StageExecution{
+		Name:     "build",
+		Runner:   "golang:1.23",
+		Commands: []string{"go build -o bin/app"},
+		Inputs:   []string{"**/*.go"},
+		Outputs:  []string{"bin/app"},
+		Output:   io.Discard,
+		Root:     dir,
+	}
+
+	// First run executes and records the cache key
+	assert.NoError(t, ExecuteStage(stage, store, "test-project"))
+	assert.Equal(t, 1, runs)
+	assert.NotEmpty(t, store.logs[0].CacheKey)
+
+	// Unchanged inputs are skipped
+	assert.NoError(t, ExecuteStage(stage, store, "test-project"))
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, "cached", store.logs[len(store.logs)-1].Status)
+
+	// Missing outputs are rebuilt
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "bin")))
+	assert.NoError(t, ExecuteStage(stage, store, "test-project"))
+	assert.Equal(t, 2, runs)
+
+	// Changed inputs are rebuilt
+	writeFiles(t, dir, map[string]string{"main.go": "package main // changed"})
+	assert.NoError(t, ExecuteStage(stage, store, "test-project"))
+	assert.Equal(t, 3, runs)
+
+	// Force ignores the cache
+	stage.Force = true
+	assert.NoError(t, ExecuteStage(stage, store, "test-project"))
+	assert.Equal(t, 4, runs)
+}
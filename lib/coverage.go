@@ -0,0 +1,349 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Coverage report formats
+const (
+	CoverageFormatGo        = "go"
+	CoverageFormatCobertura = "cobertura"
+	CoverageFormatLCOV      = "lcov"
+)
+
+// coverageProfiles are the report locations checked when no profile is configured
+var coverageProfiles = []string{
+	"coverage.out",
+	"cover.out",
+	"coverage.txt",
+	"coverage.xml",
+	"cobertura.xml",
+	"coverage/cobertura-coverage.xml",
+	"lcov.info",
+	"coverage/lcov.info",
+}
+
+// errCoverageGate marks failures of the coverage gate, retrying the stage
+// won't change its coverage
+var errCoverageGate = errors.New("coverage gate failed")
+
+// CoverageCheck defines the coverage a stage must reach
+type CoverageCheck struct {
+	Profile    string  // Path of the coverage report, found automatically if empty
+	Format     string  // go, cobertura or lcov, detected from the content if empty
+	Threshold  float64 // Minimum total coverage in percent
+	BaseBranch string  // Branch to compare coverage against, empty disables the comparison
+	MaxDrop    float64 // Percentage points the coverage may drop compared to the base branch
+}
+
+// FindCoverageProfile returns the first well known coverage report below dir
+// modified since the given time. Older reports are left over from earlier
+// runs and are skipped.
+func FindCoverageProfile(dir string, since time.Time) (string, error) {
+	var stale []string
+	for _, name := range coverageProfiles {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if modifiedBefore(info, since) {
+			stale = append(stale, path)
+			continue
+		}
+		return path, nil
+	}
+	if len(stale) > 0 {
+		return "", fmt.Errorf("no coverage report written by the stage, %s is left over from an earlier run", strings.Join(stale, ", "))
+	}
+	return "", fmt.Errorf("no coverage report found, looked for %s", strings.Join(coverageProfiles, ", "))
+}
+
+// modifiedBefore reports whether the file was last modified before t. File
+// systems with coarse timestamps round down, so the second of t counts as
+// after it.
+func modifiedBefore(info os.FileInfo, t time.Time) bool {
+	return info.ModTime().Before(t.Truncate(time.Second))
+}
+
+// ParseCoverage returns the total coverage in percent of a Go coverage
+// profile, a Cobertura XML report or an LCOV tracefile. An empty format is
+// detected from the content.
+func ParseCoverage(path, format string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("reading coverage report: %w", err)
+	}
+
+	if format == "" {
+		format = detectCoverageFormat(data)
+	}
+
+	var percent float64
+	switch format {
+	case CoverageFormatGo:
+		percent, err = parseGoCoverage(data)
+	case CoverageFormatCobertura:
+		percent, err = parseCoberturaCoverage(data)
+	case CoverageFormatLCOV:
+		percent, err = parseLCOVCoverage(data)
+	case "":
+		return 0, fmt.Errorf("unknown coverage report format in %s", path)
+	default:
+		return 0, fmt.Errorf("unsupported coverage format: %s", format)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s coverage report %s: %w", format, path, err)
+	}
+	return percent, nil
+}
+
+// detectCoverageFormat guesses the format of a coverage report from its content
+func detectCoverageFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("mode:")):
+		return CoverageFormatGo
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		return CoverageFormatCobertura
+	case bytes.HasPrefix(trimmed, []byte("TN:")), bytes.HasPrefix(trimmed, []byte("SF:")):
+		return CoverageFormatLCOV
+	}
+	return ""
+}
+
+// parseGoCoverage computes statement coverage from a Go coverage profile.
+// Blocks listed more than once, e.g. in merged profiles, count once and are
+// covered if any of their entries is.
+func parseGoCoverage(data []byte) (float64, error) {
+	type block struct {
+		statements int
+		covered    bool
+	}
+	blocks := make(map[string]*block)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "mode:") {
+			continue
+		}
+
+		// file.go:startLine.startCol,endLine.endCol statements count
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return 0, fmt.Errorf("line %d: invalid block %q", line, text)
+		}
+		statements, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, fmt.Errorf("line %d: invalid statement count: %w", line, err)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("line %d: invalid execution count: %w", line, err)
+		}
+
+		b, ok := blocks[fields[0]]
+		if !ok {
+			b = &block{statements: statements}
+			blocks[fields[0]] = b
+		}
+		b.covered = b.covered || count > 0
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	var total, covered int
+	for _, b := range blocks {
+		total += b.statements
+		if b.covered {
+			covered += b.statements
+		}
+	}
+	return percentage(covered, total)
+}
+
+// parseCoberturaCoverage reads line coverage from the root element of a
+// Cobertura report
+func parseCoberturaCoverage(data []byte) (float64, error) {
+	var report struct {
+		XMLName      xml.Name `xml:"coverage"`
+		LineRate     *float64 `xml:"line-rate,attr"`
+		LinesCovered *int     `xml:"lines-covered,attr"`
+		LinesValid   *int     `xml:"lines-valid,attr"`
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	// Only the attributes of the root element are needed
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return 0, fmt.Errorf("no coverage element")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local != "coverage" {
+				return 0, fmt.Errorf("unexpected root element %q", start.Name.Local)
+			}
+			if err := decoder.DecodeElement(&report, &start); err != nil {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	switch {
+	case report.LinesCovered != nil && report.LinesValid != nil:
+		return percentage(*report.LinesCovered, *report.LinesValid)
+	case report.LineRate != nil:
+		return *report.LineRate * 100, nil
+	}
+	return 0, fmt.Errorf("coverage element has no line-rate")
+}
+
+// parseLCOVCoverage computes line coverage from the LF and LH records of an
+// LCOV tracefile, falling back to counting DA records
+func parseLCOVCoverage(data []byte) (float64, error) {
+	var found, hit, daFound, daHit int
+	summaries := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "LF", "LH":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: invalid %s record: %w", line, key, err)
+			}
+			summaries = true
+			if key == "LF" {
+				found += n
+			} else {
+				hit += n
+			}
+		case "DA":
+			// DA:line,count[,checksum]
+			parts := strings.Split(value, ",")
+			if len(parts) < 2 {
+				return 0, fmt.Errorf("line %d: invalid DA record", line)
+			}
+			count, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return 0, fmt.Errorf("line %d: invalid DA record: %w", line, err)
+			}
+			daFound++
+			if count > 0 {
+				daHit++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if summaries {
+		return percentage(hit, found)
+	}
+	return percentage(daHit, daFound)
+}
+
+// percentage returns part of total in percent. A report without any lines
+// is an error, it would pass any threshold.
+func percentage(part, total int) (float64, error) {
+	if total == 0 {
+		return 0, errors.New("report covers no lines")
+	}
+	return float64(part) * 100 / float64(total), nil
+}
+
+// checkCoverage measures the coverage of a successful stage run and checks
+// it against the threshold and the last successful run on the base branch.
+// Reports are looked up in the project root and only those written since the
+// attempt started count. The measured coverage is returned even if the check
+// fails.
+func checkCoverage(stage StageExecution, auditStore AuditStore, projectName string, started time.Time, out io.Writer) (*float64, error) {
+	check := stage.Coverage
+
+	var profile string
+	if check.Profile == "" {
+		var err error
+		if profile, err = FindCoverageProfile(stage.root(), started); err != nil {
+			return nil, fmt.Errorf("%w: %v", errCoverageGate, err)
+		}
+	} else {
+		profile = projectPath(stage.root(), check.Profile)
+		if info, err := os.Stat(profile); err == nil && modifiedBefore(info, started) {
+			return nil, fmt.Errorf("%w: coverage report %s was not written by the stage, it is left over from an earlier run", errCoverageGate, check.Profile)
+		}
+	}
+
+	percent, err := ParseCoverage(profile, check.Format)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCoverageGate, err)
+	}
+	fmt.Fprintf(out, "Coverage: %.1f%% (threshold %.1f%%)\n", percent, check.Threshold)
+
+	if percent < check.Threshold {
+		return &percent, fmt.Errorf("%w: coverage %.1f%% is below the threshold of %.1f%%", errCoverageGate, percent, check.Threshold)
+	}
+
+	if check.BaseBranch == "" || auditStore == nil {
+		return &percent, nil
+	}
+
+	logs, err := auditStore.LoadLogs(projectName, "")
+	if err != nil {
+		fmt.Fprintf(out, "Error loading audit logs, skipping coverage comparison: %v\n", err)
+		return &percent, nil
+	}
+
+	base, ok := baseCoverage(logs, stage, check.BaseBranch)
+	if !ok {
+		fmt.Fprintf(out, "No coverage recorded for branch %s, skipping coverage comparison\n", check.BaseBranch)
+		return &percent, nil
+	}
+
+	fmt.Fprintf(out, "Coverage on %s: %.1f%% (revision %s)\n", check.BaseBranch, *base.Coverage, base.GitRevision)
+	if drop := *base.Coverage - percent; drop > check.MaxDrop {
+		return &percent, fmt.Errorf("%w: coverage dropped by %.1f percentage points compared to branch %s, at most %.1f are allowed",
+			errCoverageGate, drop, check.BaseBranch, check.MaxDrop)
+	}
+	return &percent, nil
+}
+
+// baseCoverage returns the most recent successful audit log of the stage
+// with recorded coverage on the given branch
+func baseCoverage(logs []AuditLog, stage StageExecution, branch string) (AuditLog, bool) {
+	var found AuditLog
+	ok := false
+	for _, log := range logs {
+		if log.Stage != stage.Name || log.Status != StatusSuccess || log.Branch != branch || log.Coverage == nil {
+			continue
+		}
+		if matrixKey(log.Matrix) != matrixKey(stage.Matrix) {
+			continue
+		}
+		if !ok || log.StartTime.After(found.StartTime) {
+			found, ok = log, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCoverage(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		format  string
+		want    float64
+		wantErr bool
+	}{
+		"go profile": {
+			content: `mode: set
+example.com/app/main.go:5.13,7.2 2 1
+example.com/app/main.go:9.13,11.2 1 0
+example.com/app/lib.go:3.20,6.2 1 1
+`,
+			want: 75,
+		},
+		"merged go profile": {
+			// The same block from two test binaries counts once
+			content: `mode: atomic
+example.com/app/main.go:5.13,7.2 2 0
+example.com/app/main.go:9.13,11.2 2 0
+example.com/app/main.go:5.13,7.2 2 3
+`,
+			want: 50,
+		},
+		"invalid go profile": {
+			content: "mode: set\nmain.go:5.13,7.2 two 1\n",
+			wantErr: true,
+		},
+		"cobertura with line counts": {
+			content: `<?xml version="1.0" ?>
+<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">
+<coverage line-rate="0.5" lines-covered="30" lines-valid="40" version="1.9">
+  <packages/>
+</coverage>`,
+			want: 75,
+		},
+		"cobertura with line rate": {
+			content: `<coverage line-rate="0.825" branch-rate="0"></coverage>`,
+			want:    82.5,
+		},
+		"cobertura without rate": {
+			content: `<coverage></coverage>`,
+			wantErr: true,
+		},
+		"lcov summaries": {
+			content: `TN:
+SF:src/index.js
+DA:1,1
+DA:2,0
+LF:2
+LH:1
+end_of_record
+SF:src/util.js
+LF:8
+LH:8
+end_of_record
+`,
+			want: 90,
+		},
+		"lcov line records": {
+			content: `SF:src/index.js
+DA:1,1
+DA:2,0
+DA:3,5
+DA:4,0
+end_of_record
+`,
+			want: 50,
+		},
+		"explicit format": {
+			content: "SF:src/index.js\nDA:1,1\nend_of_record\n",
+			format:  CoverageFormatLCOV,
+			want:    100,
+		},
+		"unknown format": {
+			content: "coverage: 80%\n",
+			wantErr: true,
+		},
+		"empty go profile": {
+			content: "mode: set\n",
+			wantErr: true,
+		},
+		"empty lcov tracefile": {
+			content: "TN:\nend_of_record\n",
+			format:  CoverageFormatLCOV,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "coverage")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0644))
+
+			got, err := ParseCoverage(path, tc.format)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, tc.want, got, 0.001)
+		})
+	}
+}
+
+func TestFindCoverageProfile(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now()
+	_, err := FindCoverageProfile(dir, start)
+	assert.ErrorContains(t, err, "no coverage report found")
+
+	writeFiles(t, dir, map[string]string{"coverage/lcov.info": "SF:a.js\n"})
+	path, err := FindCoverageProfile(dir, start)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "coverage", "lcov.info"), path)
+
+	// Go profiles are preferred
+	writeFiles(t, dir, map[string]string{"coverage.out": "mode: set\n"})
+	path, err = FindCoverageProfile(dir, start)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "coverage.out"), path)
+
+	// Reports from earlier runs are skipped
+	earlier := start.Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "coverage.out"), earlier, earlier))
+	path, err = FindCoverageProfile(dir, start)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "coverage", "lcov.info"), path)
+
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "coverage", "lcov.info"), earlier, earlier))
+	_, err = FindCoverageProfile(dir, start)
+	assert.ErrorContains(t, err, "no coverage report written by the stage")
+}
+
+func TestExecuteStageCoverage(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	// Coverage reports are looked up in the project root, not the working
+	// directory
+	dir := t.TempDir()
+
+	// The stage writes a report covering 3 of 4 statements, unless the
+	// report is left over from an earlier run
+	runs := 0
+	stale := false
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		if args[1] != "run" {
+			return DockerResult{} // The runner image is inspected afterwards
+		}
+		runs++
+		if !stale {
+			writeFiles(t, dir, map[string]string{"coverage.out": "mode: set\nmain.go:1.1,2.1 3 1\nmain.go:3.1,4.1 1 0\n"})
+		}
+		return DockerResult{}
+	}
+
+	ptr := func(f float64) *float64 { return &f }
+
+	tests := map[string]struct {
+		check   CoverageCheck
+		history []AuditLog
+		stale   bool
+		wantErr string
+	}{
+		"above threshold": {
+			check: CoverageCheck{Threshold: 70},
+		},
+		"below threshold": {
+			check:   CoverageCheck{Threshold: 80},
+			wantErr: "coverage 75.0% is below the threshold of 80.0%",
+		},
+		"configured report": {
+			check: CoverageCheck{Profile: "coverage.out", Threshold: 70},
+		},
+		"missing report": {
+			check:   CoverageCheck{Profile: "cover.xml"},
+			wantErr: "reading coverage report",
+		},
+		"stale report": {
+			stale:   true,
+			wantErr: "no coverage report written by the stage",
+		},
+		"stale configured report": {
+			check:   CoverageCheck{Profile: "coverage.out"},
+			stale:   true,
+			wantErr: "coverage report coverage.out was not written by the stage",
+		},
+		"no base coverage": {
+			check: CoverageCheck{BaseBranch: "main"},
+		},
+		"within allowed drop": {
+			check: CoverageCheck{BaseBranch: "main", MaxDrop: 1},
+			history: []AuditLog{
+				{Project: "test-project", Stage: "test", Status: "success", Branch: "main", Coverage: ptr(75.5)},
+			},
+		},
+		"dropped compared to base": {
+			check: CoverageCheck{BaseBranch: "main", MaxDrop: 1},
+			history: []AuditLog{
+				{Project: "test-project", Stage: "test", Status: "success", Branch: "main", Coverage: ptr(90), StartTime: time.Now().Add(-time.Hour)},
+				{Project: "test-project", Stage: "test", Status: "success", Branch: "main", Coverage: ptr(80), StartTime: time.Now().Add(-time.Minute)},
+				{Project: "test-project", Stage: "test", Status: "success", Branch: "feature", Coverage: ptr(70)},
+			},
+			wantErr: "coverage dropped by 5.0 percentage points compared to branch main",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			runs = 0
+			stale = tc.stale
+			if stale {
+				writeFiles(t, dir, map[string]string{"coverage.out": "mode: set\nmain.go:1.1,2.1 1 1\n"})
+				earlier := time.Now().Add(-time.Hour)
+				assert.NoError(t, os.Chtimes(filepath.Join(dir, "coverage.out"), earlier, earlier))
+			}
+			check := tc.check
+			store := &mockAuditStore{logs: tc.history}
+			err := ExecuteStage(StageExecution{
+				Name:     "test",
+				Runner:   "golang:1.23",
+				Commands: []string{"go test -coverprofile=coverage.out ./..."},
+				Coverage: &check,
+				Retry:    RetryPolicy{Attempts: 3},
+				Output:   io.Discard,
+				Root:     dir,
+			}, store, "test-project")
+
+			// Coverage failures are not retried
+			assert.Equal(t, 1, runs)
+
+			final := store.logs[len(store.logs)-1]
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				assert.Equal(t, "failed", final.Status)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "success", final.Status)
+			}
+			if tc.check.Profile == "" && !tc.stale {
+				assert.NotNil(t, final.Coverage)
+				assert.InDelta(t, 75, *final.Coverage, 0.001)
+			}
+		})
+	}
+}
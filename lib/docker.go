@@ -1,33 +1,52 @@
 package lib
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"time"
 )
 
-// Volume represents a docker volume mount configuration
-type Volume struct {
-	Type     string `yaml:"type"`               // bind, cache, tmp
-	Source   string `yaml:"source"`             // host path or named volume
-	Target   string `yaml:"target"`             // container path
-	Readonly bool   `yaml:"readonly,omitempty"` // mount as readonly
-}
+// maxCapturedOutput limits how much output is kept in a DockerResult
+const maxCapturedOutput = 64 * 1024
 
+// DockerResult holds the outcome of a docker command. Output is streamed to
+// the writers passed to ExecDocker, the result only keeps the last
+// maxCapturedOutput bytes of each stream.
 type DockerResult struct {
-	Stdout   string
-	Stderr   string
-	Error    error
-	ExitCode int
+	Stdout    string
+	Stderr    string
+	Output    string // Tail of stdout and stderr combined, in the order written
+	Error     error
+	ExitCode  int
+	OOMKilled bool           // The container was killed for exceeding its memory limit
+	Usage     *ResourceUsage // Resources the container used, if the runtime reports them
+
+	// ProbableOOM is set for containers with a memory limit killed with
+	// SIGKILL when the runtime couldn't report whether it was an OOM kill
+	ProbableOOM bool
+}
+
+// execDockerImpl is the actual implementation. Output is streamed to stdout
+// and stderr as it arrives, nil writers discard it. The process is killed
+// when the context is done.
+func execDockerImpl(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+	return runCommand(exec.CommandContext(ctx, args[0], args[1:]...), stdout, stderr)
 }
 
-// execDockerImpl is the actual implementation
-func execDockerImpl(args []string) DockerResult {
-	cmd := exec.Command(args[0], args[1:]...)
-	var stdout, stderr strings.Builder
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// runCommand runs cmd, streaming its output to stdout and stderr while
+// keeping the tail of it for the result
+func runCommand(cmd *exec.Cmd, stdout, stderr io.Writer) DockerResult {
+	result := newStreamResult(stdout, stderr)
+	cmd.Stdout = result.stdout
+	cmd.Stderr = result.stderr
 
 	err := cmd.Run()
 	exitCode := 0
@@ -36,15 +55,69 @@ func execDockerImpl(args []string) DockerResult {
 			exitCode = exitErr.ExitCode()
 		}
 	}
+	return result.finish(err, exitCode)
+}
+
+// streamResult streams a command's output to writers and keeps its tail for
+// the DockerResult
+type streamResult struct {
+	stdout, stderr             io.Writer
+	outTail, errTail, combined *tailBuffer
+}
+
+func newStreamResult(stdout, stderr io.Writer) *streamResult {
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	r := &streamResult{
+		outTail:  newTailBuffer(maxCapturedOutput),
+		errTail:  newTailBuffer(maxCapturedOutput),
+		combined: newTailBuffer(maxCapturedOutput),
+	}
+	r.stdout = io.MultiWriter(stdout, r.outTail, r.combined)
+	r.stderr = io.MultiWriter(stderr, r.errTail, r.combined)
+	return r
+}
 
+func (r *streamResult) finish(err error, exitCode int) DockerResult {
 	return DockerResult{
-		Stdout:   stdout.String(),
-		Stderr:   stderr.String(),
+		Stdout:   r.outTail.String(),
+		Stderr:   r.errTail.String(),
+		Output:   r.combined.String(),
 		Error:    err,
 		ExitCode: exitCode,
 	}
 }
 
+// then combines the result of a run with the one of the run before it. The
+// output of both is kept up to the capture limit, the rest of the result is
+// the later run's.
+func (r DockerResult) then(next DockerResult) DockerResult {
+	next.Stdout = tail(r.Stdout + next.Stdout)
+	next.Stderr = tail(r.Stderr + next.Stderr)
+	next.Output = tail(r.Output + next.Output)
+	if r.Usage != nil && next.Usage != nil {
+		next.Usage = &ResourceUsage{
+			CPUSeconds: r.Usage.CPUSeconds + next.Usage.CPUSeconds,
+			PeakMemory: max(r.Usage.PeakMemory, next.Usage.PeakMemory),
+		}
+	} else if next.Usage == nil {
+		next.Usage = r.Usage
+	}
+	return next
+}
+
+// tail returns the end of s that fits into a DockerResult
+func tail(s string) string {
+	if len(s) > maxCapturedOutput {
+		return s[len(s)-maxCapturedOutput:]
+	}
+	return s
+}
+
 // ExecDocker is a variable that can be overridden in tests
 var ExecDocker = execDockerImpl
 
@@ -154,112 +227,559 @@ func ResolveRunnerImage(runner string, defaultRegistry string) string {
 
 // StageExecution represents the configuration needed to execute a stage
 type StageExecution struct {
-	Name        string
-	Runner      string
-	Commands    []string
-	Environment map[string]string
-	Volumes     []Volume
+	Name           string
+	Runner         string
+	Commands       []string
+	Environment    map[string]string
+	Volumes        []Volume
+	Matrix         map[string]string // Matrix cell values, keyed by dimension
+	Output         io.Writer         // Where stage output is printed, defaults to os.Stdout
+	ErrOutput      io.Writer         // Where the stage's stderr is printed, defaults to os.Stderr
+	Timeout        time.Duration     // Maximum execution time per attempt, zero means no limit
+	CommandTimeout time.Duration     // Maximum execution time of each command, zero means no limit
+	Retry          RetryPolicy       // How often to retry a failed stage
+	Inputs         []string          // Globs of the files the stage depends on, enables caching
+	Outputs        []string          // Globs of the files the stage produces, must exist for a cache hit
+	Force          bool              // Run the stage even if its inputs are unchanged
+	Coverage       *CoverageCheck    // Coverage the stage must reach, nil disables the check
+	Services       []Service         // Containers started on a shared network before the stage runs
+	Dir            string            // Directory the shell runner runs commands in, defaults to the current directory
+	Root           string            // Project directory inputs and outputs are relative to, defaults to the current directory
+	Runtime        Runtime           // Container runtime running the stage, defaults to Docker
+	Digest         string            // Digest Runner is pinned to by the lockfile
+	Build          *ImageBuild       // Builds the runner image, Runner is set to its tag
+	ImageID        string            // ID of the built runner image
+	User           string            // uid[:gid] or name the container runs as, the image's user if empty
+	HostUser       bool              // Run the container as the calling user with a writable HOME
+	Resources      Resources         // Limits of the stage's container
+	Secrets        []Secret          // Passed in files and masked in the output and audit logs
+	RunID          string            // Run the stage is part of, a new ID is generated if empty
+}
+
+// root returns the project directory of the stage
+func (s StageExecution) root() string {
+	if s.Root == "" {
+		return "."
+	}
+	return s.Root
+}
+
+// runtime returns the stage's container runtime
+func (s StageExecution) runtime() Runtime {
+	if s.Runtime == nil {
+		return Docker
+	}
+	return s.Runtime
+}
+
+// RetryPolicy defines how a failed stage is retried
+type RetryPolicy struct {
+	Attempts    int           // Total number of attempts, values below 1 mean a single attempt
+	Backoff     time.Duration // Delay before the first retry, doubled for every further retry
+	OnExitCodes []int         // Only retry on these exit codes, empty means any failure
+}
+
+// maxRetryDelay caps the doubled backoff between retries
+const maxRetryDelay = 10 * time.Minute
+
+// delay returns how long to wait before the given retry, starting at 1. The
+// backoff is doubled until it reaches maxRetryDelay, so it can't overflow.
+func (r RetryPolicy) delay(retry int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < retry && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryDelay)
+}
+
+// retryable reports whether a failed attempt with the given exit code should be retried
+func (r RetryPolicy) retryable(exitCode int) bool {
+	if len(r.OnExitCodes) == 0 {
+		return true
+	}
+	for _, code := range r.OnExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidNameChars matches characters docker doesn't allow in container names
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// containerName creates a unique container name for a stage execution
+func containerName(projectName, stageName string) string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return dockerName(fmt.Sprintf("gosonic-%s-%s-%s", projectName, stageName, hex.EncodeToString(suffix)))
+}
+
+// dockerName replaces characters docker doesn't allow in container and volume names
+func dockerName(name string) string {
+	return invalidNameChars.ReplaceAllString(name, "_")
+}
+
+// ReasonCommandTimeout is the audit log reason of stages with a command that
+// exceeded the stage's command timeout
+const ReasonCommandTimeout = "command_timeout"
+
+// ParseTimeout parses a stage timeout such as "30s" or "1h30m". An empty
+// string means no timeout.
+func ParseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", timeout, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must not be negative", timeout)
+	}
+	return d, nil
 }
 
 // ExecuteStage runs a stage in a docker container and handles audit logging
 func ExecuteStage(stage StageExecution, auditStore AuditStore, projectName string) error {
-	startTime := time.Now()
+	return ExecuteStageContext(context.Background(), stage, auditStore, projectName)
+}
 
-	// Get git revision
-	gitRev, err := GetGitRevision()
+// ExecuteStageContext is like ExecuteStage but stops the stage's container
+// when the context is done or the stage timeout expires
+func ExecuteStageContext(ctx context.Context, stage StageExecution, auditStore AuditStore, projectName string) error {
+	if stage.RunID == "" {
+		stage.RunID = NewRunID()
+	}
+	// Errors may quote commands or their output, which may contain secrets
+	return newMasker(stage.Secrets).maskError(executeStage(ctx, stage, auditStore, projectName))
+}
+
+// executeStage implements ExecuteStageContext
+func executeStage(ctx context.Context, stage StageExecution, auditStore AuditStore, projectName string) error {
+	out := stage.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	errOut := stage.ErrOutput
+	if errOut == nil {
+		errOut = os.Stderr
+	}
+	for _, w := range []io.Writer{out, errOut} {
+		if pw, ok := w.(*PrefixWriter); ok {
+			defer pw.Flush()
+		}
+	}
+
+	// Secret values never reach the output or the audit logs
+	if masker := newMasker(stage.Secrets); masker != nil {
+		maskedOut := &maskWriter{w: out, masker: masker}
+		maskedErrOut := &maskWriter{w: errOut, masker: masker}
+		defer maskedOut.Flush()
+		defer maskedErrOut.Flush()
+		out, errOut = maskedOut, maskedErrOut
+		if auditStore != nil {
+			auditStore = maskingStore{AuditStore: auditStore, masker: masker}
+		}
+	}
+
+	// Stages on the host have no container to mount volumes in or to
+	// connect to services
+	if stage.Runner == ShellRunner && (len(stage.Volumes) > 0 || len(stage.Services) > 0) {
+		return fmt.Errorf("stage %s: volumes and services are not supported by the %s runner", stage.Name, ShellRunner)
+	}
+	if stage.Runner == ShellRunner && stage.User != "" {
+		return fmt.Errorf("stage %s: the %s runner runs as the calling user, user can't be set", stage.Name, ShellRunner)
+	}
+	if stage.Runner == ShellRunner && !stage.Resources.IsZero() {
+		return fmt.Errorf("stage %s: resource limits are not supported by the %s runner", stage.Name, ShellRunner)
+	}
+	for _, secret := range stage.Secrets {
+		if err := secret.Validate(); err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+		if stage.Runner == ShellRunner && secret.Target != "" {
+			return fmt.Errorf("stage %s: secret %s: file secrets are not supported by the %s runner", stage.Name, secret.Name, ShellRunner)
+		}
+	}
+	if err := stage.Resources.Validate(); err != nil {
+		return fmt.Errorf("stage %s: resources: %w", stage.Name, err)
+	}
+
+	// Files the stage writes to bind mounts then belong to the calling user
+	if stage.HostUser && stage.Runner != ShellRunner {
+		if err := runAsHostUser(&stage); err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+	}
+
+	// Resolve the volumes once, invalid volumes fail the stage before it runs
+	mounts, err := volumeMounts(stage.Volumes, projectName, stage.root())
 	if err != nil {
-		gitRev = "unknown" // Don't fail if we can't get git revision
+		return fmt.Errorf("stage %s: %w", stage.Name, err)
 	}
 
-	// Build docker command
-	dockerArgs := []string{
-		"docker", "run",
-		"--rm",                    // Remove container after execution
-		"--init",                  // Use tini as init process
-		"--workdir", "/workspace", // Set working directory
+	// Container secrets are passed in files instead of arguments, which
+	// show up in the printed command, the audit log and the process list
+	var envFile string
+	if stage.Runner != ShellRunner {
+		secrets, err := writeSecrets(stage.Secrets)
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+		defer secrets.remove()
+		mounts = append(mounts, secrets.mounts...)
+		envFile = secrets.envFile
 	}
 
-	// Add environment variables
-	for k, v := range stage.Environment {
-		dockerArgs = append(dockerArgs, "-e", fmt.Sprintf("%s=%s", k, v))
+	// Built runners are tagged with the hash of their context before the
+	// cache check, so changing the context invalidates the cache
+	if stage.Build != nil {
+		if err := prepareBuild(&stage, projectName); err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
 	}
 
-	// Add volume mounts
-	for _, vol := range stage.Volumes {
-		mountOpts := []string{}
-		if vol.Readonly {
-			mountOpts = append(mountOpts, "ro")
+	// Skip the stage if it already succeeded with the same inputs
+	var cacheKey string
+	if len(stage.Inputs) > 0 {
+		cacheKey, err = CacheKey(stage, stage.root())
+		if err != nil {
+			return fmt.Errorf("computing cache key: %w", err)
+		}
+		if !stage.Force {
+			if cached, ok := findCachedRun(stage, auditStore, projectName, cacheKey, out); ok {
+				reason := fmt.Sprintf("inputs unchanged since revision %s", cached.GitRevision)
+				return recordSkip(stage, auditStore, projectName, StatusCached, reason, cacheKey)
+			}
 		}
+	}
 
-		volumeArg := fmt.Sprintf("%s:%s", vol.Source, vol.Target)
-		if len(mountOpts) > 0 {
-			volumeArg += ":" + strings.Join(mountOpts, ",")
+	if stage.Build != nil {
+		stage.ImageID, err = ensureImage(ctx, stage, out)
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
 		}
-		dockerArgs = append(dockerArgs, "-v", volumeArg)
 	}
 
-	// Add image name
-	dockerArgs = append(dockerArgs, stage.Runner)
+	// Start the services once for all attempts, they are removed again
+	// however the stage ends
+	var network string
+	if len(stage.Services) > 0 {
+		services, err := startServices(ctx, stage, projectName, out)
+		defer services.teardown(out)
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+		network = services.network
+	}
 
-	// Add commands
-	if len(stage.Commands) == 1 {
-		// For a single command, execute directly without shell
-		args := splitCommandArgs(stage.Commands[0])
-		dockerArgs = append(dockerArgs, args...)
-	} else if len(stage.Commands) > 1 {
-		// For multiple commands, use shell
-		command := strings.Join(stage.Commands, " && ")
-		dockerArgs = append(dockerArgs, "sh", "-c", command)
+	attempts := stage.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
 	}
 
-	// Create the full command string for audit
-	fullCommand := strings.Join(dockerArgs, " ")
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			delay := stage.Retry.delay(attempt - 1)
+			fmt.Fprintf(out, "\nRetrying stage %s in %s (attempt %d of %d)\n", stage.Name, delay, attempt, attempts)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+		}
+
+		var exitCode int
+		exitCode, err = executeAttempt(ctx, stage, auditStore, projectName, attempt, cacheKey, mounts, network, envFile, out, errOut)
+		if err == nil || ctx.Err() != nil || errors.Is(err, errCoverageGate) || !stage.Retry.retryable(exitCode) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// findCachedRun looks for a successful run of the stage with the given cache
+// key, in any git revision, whose outputs still exist
+func findCachedRun(stage StageExecution, auditStore AuditStore, projectName, cacheKey string, out io.Writer) (AuditLog, bool) {
+	if auditStore == nil {
+		return AuditLog{}, false
+	}
+
+	logs, err := auditStore.LoadLogs(projectName, "")
+	if err != nil {
+		fmt.Fprintf(out, "Error loading audit logs, running stage %s: %v\n", stage.Name, err)
+		return AuditLog{}, false
+	}
+	cached, ok := FindCached(logs, stage, cacheKey)
+	if !ok {
+		return AuditLog{}, false
+	}
+
+	exist, err := OutputsExist(stage.root(), stage.Outputs)
+	if err != nil {
+		fmt.Fprintf(out, "Error checking outputs, running stage %s: %v\n", stage.Name, err)
+		return AuditLog{}, false
+	}
+	return cached, exist
+}
+
+// SkipStage records that a stage was skipped for the given reason instead of
+// being executed
+func SkipStage(stage StageExecution, auditStore AuditStore, projectName, reason string) error {
+	if stage.RunID == "" {
+		stage.RunID = NewRunID()
+	}
+	return recordSkip(stage, auditStore, projectName, StatusSkipped, reason, "")
+}
+
+// recordSkip records a stage that was not executed with the given status
+func recordSkip(stage StageExecution, auditStore AuditStore, projectName, status, reason, cacheKey string) error {
+	out := stage.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, "Skipping stage %s: %s\n", stage.Name, reason)
+
+	if auditStore == nil {
+		return nil
+	}
+
+	gitRev, err := GetGitRevision()
+	if err != nil {
+		gitRev = "unknown" // Don't fail if we can't get git revision
+	}
+
+	auditLog := AuditLog{
+		RunID:       stage.RunID,
+		Project:     projectName,
+		GitRevision: gitRev,
+		Stage:       stage.Name,
+		StartTime:   time.Now(),
+		Matrix:      stage.Matrix,
+		Status:      status,
+		Reason:      reason,
+		CacheKey:    cacheKey,
+	}
+	if err := auditStore.Store(auditLog); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	return nil
+}
+
+// executeAttempt runs a single attempt of a stage and records it in the
+// audit store. It returns the container's exit code.
+func executeAttempt(ctx context.Context, stage StageExecution, auditStore AuditStore, projectName string, attempt int, cacheKey string, mounts []Mount, network, envFile string, out, errOut io.Writer) (int, error) {
+	startTime := time.Now()
+
+	if stage.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, stage.Timeout)
+		defer cancel()
+	}
+	// Get git revision
+	gitRev, err := GetGitRevision()
+	if err != nil {
+		gitRev = "unknown" // Don't fail if we can't get git revision
+	}
+	branch, _ := GetGitBranch() // Only used to compare coverage between branches
+
+	host := stage.Runner == ShellRunner
+	steps := stage.steps()
+	var args []string
+	var specs []ContainerSpec
+	var runtimeName string
+	for _, step := range steps {
+		if host {
+			args = append(args, strings.Join(hostCommand(step), " "))
+			continue
+		}
+		spec := containerSpec(ctx, step, projectName, mounts, network, envFile)
+		specs = append(specs, spec)
+		args = append(args, strings.Join(stage.runtime().CommandLine(spec), " "))
+		runtimeName = stage.runtime().Name()
+	}
+
+	// Create the full command string for audit, one line per step
+	fullCommand := strings.Join(args, "\n")
 
 	// Print the command
-	fmt.Printf("Stage: %s\n", stage.Name)
-	fmt.Printf("Runner: %s\n", stage.Runner)
-	fmt.Printf("\nDocker command:\n%s\n", fullCommand)
+	fmt.Fprintf(out, "Stage: %s\n", stage.Name)
+	if host {
+		fmt.Fprintf(out, "Runner: %s (on the host)\n", stage.Runner)
+		fmt.Fprintf(out, "\nHost command:\n%s\n", fullCommand)
+	} else {
+		fmt.Fprintf(out, "Runner: %s\n", stage.Runner)
+		fmt.Fprintf(out, "\nContainer command:\n%s\n", fullCommand)
+	}
 
 	// Create audit log
 	auditLog := AuditLog{
+		RunID:       stage.RunID,
 		Project:     projectName,
 		GitRevision: gitRev,
+		Branch:      branch,
 		Stage:       stage.Name,
 		Command:     fullCommand,
 		StartTime:   startTime,
-		Status:      "success", // Will be updated if there's an error
+		Matrix:      stage.Matrix,
+		Attempt:     attempt,
+		CacheKey:    cacheKey,
+		Host:        host,
+		Runtime:     runtimeName,
+		Status:      StatusRunning, // Replaced by the final status once the stage ends
+	}
+	if !host {
+		auditLog.Image = stage.Runner
+		auditLog.ImageDigest = stage.Digest
+		auditLog.ImageID = stage.ImageID
+		auditLog.User = stage.User
 	}
 
-	// Write initial audit log
+	// Write the running audit log
 	if auditStore != nil {
 		if err := auditStore.Store(auditLog); err != nil {
-			fmt.Printf("Error writing audit log: %v\n", err)
+			fmt.Fprintf(out, "Error writing audit log: %v\n", err)
 		}
 	}
 
-	// Execute docker command
-	result := ExecDocker(dockerArgs)
-
-	// Print output
-	if result.Stdout != "" {
-		fmt.Println(result.Stdout)
+	// Execute the steps in order, each under its own deadline if the stage
+	// has a command timeout
+	var result DockerResult
+	timedOut := -1 // Step that exceeded the command timeout
+	for i, step := range steps {
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if stage.CommandTimeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, stage.CommandTimeout)
+		}
+		var stepResult DockerResult
+		if host {
+			stepResult = execHost(stepCtx, hostCommand(step), stage.Dir, secretEnv(stage.Environment, stage.Secrets), out, errOut)
+		} else {
+			stepResult = stage.runtime().Run(stepCtx, specs[i], out, errOut)
+		}
+		if ctx.Err() == nil && errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+			timedOut = i
+		}
+		cancel()
+		result = result.then(stepResult)
+		if result.Error != nil || timedOut >= 0 {
+			break
+		}
+	}
+	if !host && auditLog.ImageDigest == "" && auditLog.ImageID == "" {
+		// The runtime pulled the image if needed, record what actually ran
+		auditLog.ImageDigest, auditLog.ImageID = runnerImage(ctx, stage)
+	}
+	auditLog.Output = result.Output
+	auditLog.Usage = result.Usage
+
+	status, err := StatusSuccess, result.Error
+	switch {
+	case timedOut >= 0:
+		// Record the timeout of a single command with its own reason
+		status = StatusTimeout
+		err = fmt.Errorf("command %q timed out after %s", strings.Join(steps[timedOut].Commands, " && "), stage.CommandTimeout)
+		auditLog.Reason = ReasonCommandTimeout
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// Record a timeout if the deadline expired
+		status = StatusTimeout
+		err = fmt.Errorf("stage timed out after %s", time.Since(startTime).Round(time.Millisecond))
+	case ctx.Err() != nil:
+		status = StatusCancelled
+		err = fmt.Errorf("stage cancelled after %s: %w", time.Since(startTime).Round(time.Millisecond), ctx.Err())
+	case result.OOMKilled:
+		// Out of memory kills are recorded with their own reason, the exit
+		// status alone doesn't tell them from other kills
+		err = fmt.Errorf("killed for exceeding the memory limit of %s: %w", stage.Resources.Memory, result.Error)
+		auditLog.Reason = ReasonOOMKilled
+		fmt.Fprintf(errOut, "Stage %s ran out of memory, raise resources.memory above %s\n", stage.Name, stage.Resources.Memory)
+	case result.ProbableOOM:
+		auditLog.Reason = ReasonProbableOOM
+		fmt.Fprintf(errOut, "Stage %s was killed, possibly for exceeding the memory limit of %s\n", stage.Name, stage.Resources.Memory)
 	}
-	if result.Stderr != "" {
-		fmt.Printf("%s", result.Stderr)
+	if err != nil && status == StatusSuccess {
+		status = StatusFailed
 	}
 
-	// Update audit log if there was an error
-	if result.Error != nil {
-		auditLog.SetError(result.Error)
-		if auditStore != nil {
-			if err := auditStore.Store(auditLog); err != nil {
-				fmt.Printf("Error writing audit log: %v\n", err)
-			}
+	// Enforce the coverage gate and record the coverage
+	if status == StatusSuccess && stage.Coverage != nil {
+		auditLog.Coverage, err = checkCoverage(stage, auditStore, projectName, startTime, out)
+		if err != nil {
+			status = StatusFailed
 		}
-		return result.Error
 	}
 
-	return nil
+	auditLog.finish(status, result.ExitCode, err)
+	if auditStore != nil {
+		if err := auditStore.Store(auditLog); err != nil {
+			fmt.Fprintf(out, "Error writing audit log: %v\n", err)
+		}
+	}
+	return result.ExitCode, err
+}
+
+// steps splits the stage into the runs executing its commands. All commands
+// run at once unless the stage has a command timeout, then each command runs
+// on its own so it can be given its own deadline.
+func (s StageExecution) steps() []StageExecution {
+	if s.CommandTimeout <= 0 || len(s.Commands) == 0 {
+		return []StageExecution{s}
+	}
+	steps := make([]StageExecution, len(s.Commands))
+	for i, cmd := range s.Commands {
+		steps[i] = s
+		steps[i].Commands = []string{cmd}
+	}
+	return steps
+}
+
+// runnerImage returns the registry digest of the stage's runner image, or
+// its ID for images that were never pushed or pulled. Both are empty if the
+// image can't be inspected, e.g. because pulling it failed or the stage was
+// cancelled.
+func runnerImage(ctx context.Context, stage StageExecution) (digest, id string) {
+	info, err := stage.runtime().Inspect(ctx, stage.Runner)
+	if err != nil {
+		return "", ""
+	}
+	if digest = info.Digest(stage.Runner); digest != "" {
+		return digest, ""
+	}
+	return "", info.ID
+}
+
+// containerSpec describes the container running a stage. The container is
+// named if the context can be cancelled, so it can be stopped early, or if
+// it has a memory limit, so it can be asked whether it was OOM killed.
+func containerSpec(ctx context.Context, stage StageExecution, projectName string, mounts []Mount, network, envFile string) ContainerSpec {
+	spec := ContainerSpec{
+		Image:     stage.Runner,
+		Env:       stage.Environment,
+		EnvFile:   envFile,
+		User:      stage.User,
+		HostUser:  stage.HostUser,
+		Resources: stage.Resources,
+		WorkDir:   "/workspace",
+		Mounts:    mounts,
+		Network:   network, // Join the services' network so they can be reached by name
+		Init:      true,    // Use tini as init process
+	}
+	if ctx.Done() != nil || stage.CommandTimeout > 0 || stage.Resources.Memory != "" {
+		spec.Name = containerName(projectName, stage.Name)
+	}
+
+	if len(stage.Commands) == 1 {
+		// For a single command, execute directly without shell
+		spec.Command = splitCommandArgs(stage.Commands[0])
+	} else if len(stage.Commands) > 1 {
+		// For multiple commands, use shell
+		spec.Command = []string{"sh", "-c", strings.Join(stage.Commands, " && ")}
+	}
+	return spec
 }
 
 // splitCommandArgs splits a command string into arguments, respecting quotes
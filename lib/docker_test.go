@@ -1,25 +1,31 @@
 package lib
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // Mock docker execution for tests
-var mockDockerExec func(args []string) DockerResult
+var mockDockerExec func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult
 
 func init() {
 	// Store the original docker execution function
 	originalExec := ExecDocker
 	// Set up the mock wrapper
-	ExecDocker = func(args []string) DockerResult {
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
 		if mockDockerExec != nil {
-			return mockDockerExec(args)
+			return mockDockerExec(ctx, args, stdout, stderr)
 		}
-		return originalExec(args)
+		return originalExec(ctx, args, stdout, stderr)
 	}
 }
 
@@ -42,7 +48,7 @@ func TestExecDocker(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			result := ExecDocker(tc.args)
+			result := ExecDocker(context.Background(), tc.args, nil, nil)
 
 			if tc.wantErr {
 				assert.Error(t, result.Error)
@@ -271,6 +277,7 @@ func TestParseImageRef_UnitTests(t *testing.T) {
 
 type mockAuditStore struct {
 	logs []AuditLog
+	runs []Run
 }
 
 func (m *mockAuditStore) Store(log AuditLog) error {
@@ -278,10 +285,15 @@ func (m *mockAuditStore) Store(log AuditLog) error {
 	return nil
 }
 
+func (m *mockAuditStore) StoreRun(run Run) error {
+	m.runs = append(m.runs, run)
+	return nil
+}
+
 func (m *mockAuditStore) LoadLogs(project, gitRevision string) ([]AuditLog, error) {
 	var result []AuditLog
 	for _, log := range m.logs {
-		if log.Project == project && log.GitRevision == gitRevision {
+		if log.Project == project && (gitRevision == "" || log.GitRevision == gitRevision) {
 			result = append(result, log)
 		}
 	}
@@ -330,7 +342,10 @@ func TestExecuteStage(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			// Mock docker execution
-			ExecDocker = func(args []string) DockerResult {
+			ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				if args[1] != "run" {
+					return DockerResult{} // The runner image is inspected afterwards
+				}
 				// Verify command structure
 				assert.Equal(t, tc.wantCommand, args)
 				return DockerResult{ExitCode: 0}
@@ -358,3 +373,367 @@ func (m *MockAuditStore) LoadLogs(project, gitRevision string) ([]AuditLog, erro
 	args := m.Called(project, gitRevision)
 	return args.Get(0).([]AuditLog), args.Error(1)
 }
+
+func TestParseTimeout(t *testing.T) {
+	tests := map[string]struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		"empty":    {input: "", want: 0},
+		"seconds":  {input: "30s", want: 30 * time.Second},
+		"combined": {input: "1h30m", want: 90 * time.Minute},
+		"invalid":  {input: "soon", wantErr: true},
+		"negative": {input: "-5s", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseTimeout(tc.input)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestExecuteStageTimeout(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	var container string
+	var removed []string
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		if args[1] == "rm" {
+			removed = append(removed, args[len(args)-1])
+			return DockerResult{}
+		}
+
+		for i, arg := range args {
+			if arg == "--name" {
+				container = args[i+1]
+			}
+		}
+
+		// Simulate a hung container
+		<-ctx.Done()
+		return DockerResult{Error: ctx.Err(), ExitCode: -1}
+	}
+
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:     "test",
+		Runner:   "alpine:latest",
+		Commands: []string{"sleep 3600"},
+		Timeout:  10 * time.Millisecond,
+	}, store, "test-project")
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.True(t, strings.HasPrefix(container, "gosonic-test-project-test-"))
+	assert.Equal(t, []string{container}, removed)
+
+	final := store.logs[len(store.logs)-1]
+	assert.Equal(t, "timeout", final.Status)
+	assert.GreaterOrEqual(t, final.Duration, 0.01)
+}
+
+func TestExecuteStageCommandTimeout(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	var ran []string
+	var removed int
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		switch args[1] {
+		case "rm":
+			removed++
+			return DockerResult{}
+		case "run":
+		default:
+			return DockerResult{} // The runner image is inspected afterwards
+		}
+
+		command := strings.Join(args[len(args)-2:], " ")
+		ran = append(ran, command)
+		if command != "sleep 3600" {
+			return DockerResult{Output: command + "\n"}
+		}
+
+		// Simulate a hung command
+		<-ctx.Done()
+		return DockerResult{Error: ctx.Err(), ExitCode: -1}
+	}
+
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:           "test",
+		Runner:         "alpine:latest",
+		Commands:       []string{"echo one", "sleep 3600", "echo three"},
+		Timeout:        time.Minute,
+		CommandTimeout: 10 * time.Millisecond,
+	}, store, "test-project")
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `command "sleep 3600" timed out after 10ms`)
+	assert.Equal(t, []string{"echo one", "sleep 3600"}, ran, "commands after the timeout don't run")
+	assert.Equal(t, 1, removed, "the timed out container is removed")
+
+	final := store.logs[len(store.logs)-1]
+	assert.Equal(t, StatusTimeout, final.Status)
+	assert.Equal(t, ReasonCommandTimeout, final.Reason)
+	assert.Equal(t, "echo one\n", final.Output)
+	assert.Len(t, strings.Split(final.Command, "\n"), 3, "each command is recorded")
+}
+
+func TestExecuteStageAuditLifecycle(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	tests := map[string]struct {
+		result       DockerResult
+		cancel       bool
+		wantStatus   string
+		wantExitCode int
+		wantErr      string
+	}{
+		"success": {
+			wantStatus: StatusSuccess,
+		},
+		"failed": {
+			result:       DockerResult{Error: errors.New("exit status 2"), ExitCode: 2},
+			wantStatus:   StatusFailed,
+			wantExitCode: 2,
+			wantErr:      "exit status 2",
+		},
+		"cancelled": {
+			result:       DockerResult{Error: context.Canceled, ExitCode: -1},
+			cancel:       true,
+			wantStatus:   StatusCancelled,
+			wantExitCode: -1,
+			wantErr:      "stage cancelled",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			store := &mockAuditStore{}
+			ExecDocker = func(_ context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				if args[1] == "rm" {
+					return DockerResult{}
+				}
+				// The running log is written before the container starts
+				require.Len(t, store.logs, 1)
+				if tc.cancel {
+					cancel()
+				}
+				return tc.result
+			}
+
+			err := ExecuteStageContext(ctx, StageExecution{
+				Name:     "test",
+				Runner:   "alpine:latest",
+				Commands: []string{"go test ./..."},
+				Output:   io.Discard,
+			}, store, "test-project")
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			require.Len(t, store.logs, 2)
+			running, final := store.logs[0], store.logs[1]
+			assert.Equal(t, StatusRunning, running.Status)
+			assert.Nil(t, running.EndTime)
+			assert.Nil(t, running.ExitCode)
+
+			// Both are written to the same file, the final log replaces the running one
+			assert.Equal(t, running.generateFilename(), final.generateFilename())
+			assert.NotEmpty(t, final.RunID)
+			assert.Equal(t, tc.wantStatus, final.Status)
+			require.NotNil(t, final.ExitCode)
+			assert.Equal(t, tc.wantExitCode, *final.ExitCode)
+			require.NotNil(t, final.EndTime)
+			assert.False(t, final.EndTime.Before(final.StartTime))
+			assert.Equal(t, final.EndTime.Sub(final.StartTime).Seconds(), final.Duration)
+		})
+	}
+}
+
+func TestExecuteStageImageDigest(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	var calls []string
+	ExecDocker = func(_ context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		calls = append(calls, args[1])
+		if args[1] == "image" {
+			return DockerResult{Stdout: `[{"Id": "sha256:local", "RepoDigests": ["alpine@sha256:pulled"]}]`}
+		}
+		return DockerResult{}
+	}
+
+	// Unlocked runners are inspected once they ran
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{Name: "test", Runner: "alpine:latest", Commands: []string{"true"}, Output: io.Discard}, store, "test-project")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"run", "image"}, calls)
+	final := store.logs[len(store.logs)-1]
+	assert.Equal(t, "sha256:pulled", final.ImageDigest)
+	assert.Empty(t, final.ImageID)
+
+	// Locked runners already know their digest
+	calls = nil
+	store = &mockAuditStore{}
+	err = ExecuteStage(StageExecution{Name: "test", Runner: "alpine:latest", Digest: "sha256:locked", Commands: []string{"true"}, Output: io.Discard}, store, "test-project")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"run"}, calls)
+	assert.Equal(t, "sha256:locked", store.logs[len(store.logs)-1].ImageDigest)
+}
+
+func TestExecDockerStreamsOutput(t *testing.T) {
+	var stdout, stderr strings.Builder
+	result := execDockerImpl(context.Background(), []string{"sh", "-c", "echo out; echo err >&2; exit 3"}, &stdout, &stderr)
+
+	assert.Error(t, result.Error)
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+	assert.Equal(t, "out\n", result.Stdout)
+	assert.Equal(t, "err\n", result.Stderr)
+	assert.Contains(t, result.Output, "out\n")
+	assert.Contains(t, result.Output, "err\n")
+}
+
+func TestExecuteStageOutput(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		io.WriteString(stdout, "running tests\n")
+		io.WriteString(stderr, "test failed\n")
+		return DockerResult{
+			Output:   "running tests\ntest failed\n",
+			Error:    assert.AnError,
+			ExitCode: 1,
+		}
+	}
+
+	var stdout, stderr strings.Builder
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:      "test",
+		Runner:    "alpine:latest",
+		Commands:  []string{"go test ./..."},
+		Output:    NewPrefixWriter(&stdout, "[test] "),
+		ErrOutput: NewPrefixWriter(&stderr, "[test] "),
+	}, store, "test-project")
+
+	assert.Error(t, err)
+	assert.Contains(t, stdout.String(), "[test] Stage: test\n")
+	assert.Contains(t, stdout.String(), "[test] running tests\n")
+	assert.Equal(t, "[test] test failed\n", stderr.String())
+
+	final := store.logs[len(store.logs)-1]
+	assert.Equal(t, "running tests\ntest failed\n", final.Output)
+}
+
+func TestExecuteStageRetry(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	tests := map[string]struct {
+		retry        RetryPolicy
+		exitCodes    []int // Exit code per attempt, 0 means success
+		wantAttempts int
+		wantErr      bool
+	}{
+		"single attempt by default": {
+			exitCodes:    []int{1, 0},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		"succeeds on retry": {
+			retry:        RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+			exitCodes:    []int{1, 1, 0},
+			wantAttempts: 3,
+		},
+		"fails after last attempt": {
+			retry:        RetryPolicy{Attempts: 2},
+			exitCodes:    []int{1, 1, 0},
+			wantAttempts: 2,
+			wantErr:      true,
+		},
+		"only retries listed exit codes": {
+			retry:        RetryPolicy{Attempts: 3, OnExitCodes: []int{125}},
+			exitCodes:    []int{125, 2, 0},
+			wantAttempts: 2,
+			wantErr:      true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				if args[1] != "run" {
+					return DockerResult{} // The runner image is inspected afterwards
+				}
+				code := tc.exitCodes[calls]
+				calls++
+				if code != 0 {
+					return DockerResult{Error: fmt.Errorf("exit status %d", code), ExitCode: code}
+				}
+				return DockerResult{}
+			}
+
+			store := &mockAuditStore{}
+			err := ExecuteStage(StageExecution{
+				Name:     "integration-test",
+				Runner:   "alpine:latest",
+				Commands: []string{"go test ./..."},
+				Retry:    tc.retry,
+				Output:   io.Discard,
+			}, store, "test-project")
+
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantAttempts, calls)
+
+			// Every attempt is recorded with its number
+			attempts := map[int]string{}
+			for _, log := range store.logs {
+				attempts[log.Attempt] = log.Status
+			}
+			assert.Len(t, attempts, tc.wantAttempts)
+			if !tc.wantErr {
+				assert.Equal(t, "success", attempts[tc.wantAttempts])
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	retry := RetryPolicy{Backoff: time.Second}
+	assert.Equal(t, time.Second, retry.delay(1))
+	assert.Equal(t, 2*time.Second, retry.delay(2))
+	assert.Equal(t, 4*time.Second, retry.delay(3))
+
+	// Delays are capped instead of overflowing
+	assert.Equal(t, maxRetryDelay, retry.delay(11))
+	assert.Equal(t, maxRetryDelay, retry.delay(64))
+	assert.Equal(t, maxRetryDelay, retry.delay(1000))
+	assert.Equal(t, maxRetryDelay, RetryPolicy{Backoff: time.Hour}.delay(1))
+	assert.Equal(t, maxRetryDelay, RetryPolicy{Backoff: 1 << 62}.delay(3))
+	assert.Zero(t, RetryPolicy{}.delay(100))
+}
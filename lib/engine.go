@@ -0,0 +1,658 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// RuntimeDockerAPI talks to the Docker Engine API instead of the docker client
+const RuntimeDockerAPI = "docker-api"
+
+// Engine API defaults
+const (
+	defaultDockerHost = "unix:///var/run/docker.sock"
+	engineAPIVersion  = "v1.41"
+)
+
+// EngineRuntime runs containers through the Docker Engine API. Unlike the
+// command line clients it knows the container's ID and real exit status and
+// can stop containers without a separate process.
+type EngineRuntime struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewEngineRuntime connects to the engine at host, e.g.
+// unix:///var/run/docker.sock or tcp://localhost:2375. An empty host uses
+// DOCKER_HOST or the default socket.
+func NewEngineRuntime(host string) (*EngineRuntime, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		// The host name is ignored, requests go to the socket
+		return &EngineRuntime{client: &http.Client{Transport: transport}, baseURL: "http://docker"}, nil
+	case "tcp", "http":
+		return &EngineRuntime{client: &http.Client{}, baseURL: "http://" + u.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q, must be unix:// or tcp://", host)
+	}
+}
+
+// engineError is an error response of the Engine API
+type engineError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *engineError) Error() string {
+	return fmt.Sprintf("engine API: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// isNotFound reports whether err is a 404 response of the Engine API
+func isNotFound(err error) bool {
+	var apiErr *engineError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// do sends a request to the Engine API. A non-nil in is sent as JSON, a
+// non-nil out is decoded from the JSON response. The caller must close the
+// returned body if out is nil.
+func (r *EngineRuntime) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) (io.ReadCloser, error) {
+	// Readers are sent as they are, e.g. build contexts, anything else as JSON
+	var body io.Reader
+	contentType := "application/json"
+	if reader, ok := in.(io.Reader); ok {
+		body = reader
+		contentType = "application/x-tar"
+	} else if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := r.baseURL + "/" + engineAPIVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("engine API: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var msg struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &engineError{StatusCode: resp.StatusCode, Message: msg.Message}
+	}
+
+	if out == nil {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("engine API: decoding %s response: %w", path, err)
+	}
+	return nil, nil
+}
+
+// call sends a request whose response body isn't needed
+func (r *EngineRuntime) call(ctx context.Context, method, path string, query url.Values, in interface{}) error {
+	body, err := r.do(ctx, method, path, query, in, nil)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, body)
+	return body.Close()
+}
+
+// Name returns docker-api
+func (r *EngineRuntime) Name() string {
+	return RuntimeDockerAPI
+}
+
+// CommandLine returns the docker command equivalent to the container
+func (r *EngineRuntime) CommandLine(spec ContainerSpec) []string {
+	return Docker.CommandLine(spec)
+}
+
+// containerConfig is the body of a container create request
+type containerConfig struct {
+	Image            string
+	Cmd              []string            `json:",omitempty"`
+	Env              []string            `json:",omitempty"`
+	User             string              `json:",omitempty"`
+	WorkingDir       string              `json:",omitempty"`
+	ExposedPorts     map[string]struct{} `json:",omitempty"`
+	HostConfig       hostConfig
+	NetworkingConfig *networkingConfig `json:",omitempty"`
+}
+
+type hostConfig struct {
+	Binds        []string                 `json:",omitempty"`
+	Tmpfs        map[string]string        `json:",omitempty"`
+	Init         bool                     `json:",omitempty"`
+	NetworkMode  string                   `json:",omitempty"`
+	PortBindings map[string][]portBinding `json:",omitempty"`
+	NanoCpus     int64                    `json:",omitempty"`
+	Memory       int64                    `json:",omitempty"`
+	PidsLimit    int64                    `json:",omitempty"`
+	ShmSize      int64                    `json:",omitempty"`
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string `json:",omitempty"`
+}
+
+type networkingConfig struct {
+	EndpointsConfig map[string]endpointConfig
+}
+
+type endpointConfig struct {
+	Aliases []string `json:",omitempty"`
+}
+
+// newContainerConfig translates a spec into a create request
+func newContainerConfig(spec ContainerSpec) (containerConfig, error) {
+	config := containerConfig{
+		Image:      spec.Image,
+		Cmd:        spec.Command,
+		User:       spec.User,
+		WorkingDir: spec.WorkDir,
+		HostConfig: hostConfig{Init: spec.Init, NetworkMode: spec.Network},
+	}
+	for _, k := range sortedKeys(spec.Env) {
+		config.Env = append(config.Env, k+"="+spec.Env[k])
+	}
+	// The API has no env files, the request body isn't visible like argv
+	if spec.EnvFile != "" {
+		env, err := readEnvFile(spec.EnvFile)
+		if err != nil {
+			return containerConfig{}, err
+		}
+		config.Env = append(config.Env, env...)
+	}
+
+	for _, m := range spec.Mounts {
+		if m.Type == VolumeTmp {
+			if config.HostConfig.Tmpfs == nil {
+				config.HostConfig.Tmpfs = make(map[string]string)
+			}
+			var opts []string
+			if m.Readonly {
+				opts = append(opts, "ro")
+			}
+			if m.Size != "" {
+				opts = append(opts, "size="+m.Size)
+			}
+			config.HostConfig.Tmpfs[m.Target] = strings.Join(opts, ",")
+			continue
+		}
+		// Named volumes are bound by name like host paths
+		config.HostConfig.Binds = append(config.HostConfig.Binds, m.cliArgs()[1])
+	}
+
+	for _, p := range spec.Ports {
+		port, binding, err := parsePort(p)
+		if err != nil {
+			return containerConfig{}, err
+		}
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = make(map[string]struct{})
+			config.HostConfig.PortBindings = make(map[string][]portBinding)
+		}
+		config.ExposedPorts[port] = struct{}{}
+		config.HostConfig.PortBindings[port] = append(config.HostConfig.PortBindings[port], binding)
+	}
+
+	var err error
+	if config.HostConfig.NanoCpus, err = spec.Resources.nanoCPUs(); err != nil {
+		return containerConfig{}, err
+	}
+	if config.HostConfig.Memory, err = parseSize(spec.Resources.Memory); err != nil {
+		return containerConfig{}, fmt.Errorf("invalid memory: %w", err)
+	}
+	if config.HostConfig.ShmSize, err = parseSize(spec.Resources.ShmSize); err != nil {
+		return containerConfig{}, fmt.Errorf("invalid shm_size: %w", err)
+	}
+	config.HostConfig.PidsLimit = spec.Resources.Pids
+
+	if spec.Network != "" && spec.NetworkAlias != "" {
+		config.NetworkingConfig = &networkingConfig{EndpointsConfig: map[string]endpointConfig{
+			spec.Network: {Aliases: []string{spec.NetworkAlias}},
+		}}
+	}
+	return config, nil
+}
+
+// parsePort parses a published port like 8080, 8080:80,
+// 127.0.0.1:8080:80 or 53:53/udp
+func parsePort(p string) (string, portBinding, error) {
+	spec, proto, ok := strings.Cut(p, "/")
+	if !ok {
+		proto = "tcp"
+	}
+
+	parts := strings.Split(spec, ":")
+	var binding portBinding
+	switch len(parts) {
+	case 1:
+	case 2:
+		binding.HostPort = parts[0]
+	case 3:
+		binding.HostIP, binding.HostPort = parts[0], parts[1]
+	default:
+		return "", portBinding{}, fmt.Errorf("invalid port %q", p)
+	}
+	container := parts[len(parts)-1]
+	if container == "" {
+		return "", portBinding{}, fmt.Errorf("invalid port %q", p)
+	}
+	return container + "/" + proto, binding, nil
+}
+
+// create creates a container, pulling its image first if it's missing
+func (r *EngineRuntime) create(ctx context.Context, spec ContainerSpec) (string, error) {
+	config, err := newContainerConfig(spec)
+	if err != nil {
+		return "", err
+	}
+
+	var query url.Values
+	if spec.Name != "" {
+		query = url.Values{"name": {spec.Name}}
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	_, err = r.do(ctx, http.MethodPost, "/containers/create", query, config, &created)
+	if isNotFound(err) {
+		if err := r.Pull(ctx, spec.Image, nil); err != nil {
+			return "", err
+		}
+		_, err = r.do(ctx, http.MethodPost, "/containers/create", query, config, &created)
+	}
+	if err != nil {
+		return "", fmt.Errorf("creating container: %w", err)
+	}
+	return created.ID, nil
+}
+
+// Run creates the container, attaches to its output, starts it, waits for
+// it to exit and removes it. The container is removed as well if the
+// context is done first.
+func (r *EngineRuntime) Run(ctx context.Context, spec ContainerSpec, stdout, stderr io.Writer) DockerResult {
+	id, err := r.create(ctx, spec)
+	if err != nil {
+		return DockerResult{Error: err, ExitCode: -1}
+	}
+	defer func() { _ = r.Stop(context.Background(), id) }()
+
+	// Attach before starting, so no output is lost
+	stream, err := r.do(ctx, http.MethodPost, "/containers/"+id+"/attach", url.Values{
+		"stream": {"1"}, "stdout": {"1"}, "stderr": {"1"},
+	}, nil, nil)
+	if err != nil {
+		return DockerResult{Error: fmt.Errorf("attaching to container: %w", err), ExitCode: -1}
+	}
+	defer stream.Close()
+
+	result := newStreamResult(stdout, stderr)
+	copied := make(chan error, 1)
+	go func() {
+		copied <- demuxStream(stream, result.stdout, result.stderr)
+	}()
+
+	if err := r.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil); err != nil {
+		return result.finish(fmt.Errorf("starting container: %w", err), -1)
+	}
+
+	statsCtx, stopStats := context.WithCancel(ctx)
+	defer stopStats()
+	usage := make(chan *ResourceUsage, 1)
+	go func() {
+		usage <- r.stats(statsCtx, id)
+	}()
+
+	var waited struct {
+		StatusCode int
+		Error      *struct{ Message string }
+	}
+	if _, err := r.do(ctx, http.MethodPost, "/containers/"+id+"/wait", nil, nil, &waited); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return result.finish(err, -1)
+	}
+
+	// The stream ends once the container exited
+	select {
+	case <-copied:
+	case <-ctx.Done():
+		return result.finish(ctx.Err(), -1)
+	}
+
+	var res DockerResult
+	switch {
+	case waited.Error != nil && waited.Error.Message != "":
+		res = result.finish(errors.New(waited.Error.Message), waited.StatusCode)
+	case waited.StatusCode != 0:
+		res = result.finish(fmt.Errorf("exit status %d", waited.StatusCode), waited.StatusCode)
+		res.OOMKilled = r.oomKilled(ctx, id)
+	default:
+		res = result.finish(nil, 0)
+	}
+
+	// The daemon ends the stats stream once the container stopped
+	select {
+	case res.Usage = <-usage:
+	case <-time.After(statsTimeout):
+		stopStats()
+		res.Usage = <-usage
+	}
+	return res
+}
+
+// statsTimeout is how long Run waits for the stats stream to end after the
+// container exited
+const statsTimeout = time.Second
+
+// containerStats is the part of a stats response gosonic records
+type containerStats struct {
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage uint64 `json:"total_usage"` // Nanoseconds
+		} `json:"cpu_usage"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage    uint64 `json:"usage"`
+		MaxUsage uint64 `json:"max_usage"` // Only reported for cgroup v1
+	} `json:"memory_stats"`
+}
+
+// stats samples the container's stats until the stream ends or the context
+// is done and returns the CPU time and peak memory it used, or nil if there were no
+// samples. The daemon sends a sample about every second, so the peak of
+// short spikes can be missed.
+func (r *EngineRuntime) stats(ctx context.Context, id string) *ResourceUsage {
+	body, err := r.do(ctx, http.MethodGet, "/containers/"+id+"/stats", url.Values{"stream": {"1"}}, nil, nil)
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+
+	var usage *ResourceUsage
+	decoder := json.NewDecoder(body)
+	for {
+		var s containerStats
+		if err := decoder.Decode(&s); err != nil {
+			return usage
+		}
+		if usage == nil {
+			usage = &ResourceUsage{}
+		}
+		if cpu := float64(s.CPUStats.CPUUsage.TotalUsage) / 1e9; cpu > usage.CPUSeconds {
+			usage.CPUSeconds = cpu
+		}
+		peak := s.MemoryStats.MaxUsage
+		if s.MemoryStats.Usage > peak {
+			peak = s.MemoryStats.Usage
+		}
+		if int64(peak) > usage.PeakMemory {
+			usage.PeakMemory = int64(peak)
+		}
+	}
+}
+
+// oomKilled reports whether the kernel killed the container for exceeding
+// its memory limit
+func (r *EngineRuntime) oomKilled(ctx context.Context, id string) bool {
+	var inspect struct {
+		State struct{ OOMKilled bool }
+	}
+	if _, err := r.do(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, &inspect); err != nil {
+		return false
+	}
+	return inspect.State.OOMKilled
+}
+
+// Start creates and starts a container in the background
+func (r *EngineRuntime) Start(ctx context.Context, spec ContainerSpec) error {
+	id, err := r.create(ctx, spec)
+	if err != nil {
+		return err
+	}
+	if err := r.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil); err != nil {
+		return fmt.Errorf("starting container: %w", err)
+	}
+	return nil
+}
+
+// Exec runs a command in a running container and returns its exit status
+func (r *EngineRuntime) Exec(ctx context.Context, container string, command []string) DockerResult {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	_, err := r.do(ctx, http.MethodPost, "/containers/"+container+"/exec", nil, map[string]interface{}{
+		"Cmd":          command,
+		"AttachStdout": true,
+		"AttachStderr": true,
+	}, &created)
+	if err != nil {
+		return DockerResult{Error: err, ExitCode: -1}
+	}
+
+	stream, err := r.do(ctx, http.MethodPost, "/exec/"+created.ID+"/start", nil, map[string]bool{"Detach": false}, nil)
+	if err != nil {
+		return DockerResult{Error: err, ExitCode: -1}
+	}
+	defer stream.Close()
+
+	result := newStreamResult(nil, nil)
+	if err := demuxStream(stream, result.stdout, result.stderr); err != nil {
+		return result.finish(err, -1)
+	}
+
+	var inspect struct {
+		ExitCode int
+	}
+	if _, err := r.do(ctx, http.MethodGet, "/exec/"+created.ID+"/json", nil, nil, &inspect); err != nil {
+		return result.finish(err, -1)
+	}
+	if inspect.ExitCode != 0 {
+		return result.finish(fmt.Errorf("exit status %d", inspect.ExitCode), inspect.ExitCode)
+	}
+	return result.finish(nil, 0)
+}
+
+// Stop force-removes a container with its anonymous volumes, containers
+// that are already gone are ignored
+func (r *EngineRuntime) Stop(ctx context.Context, container string) error {
+	err := r.call(ctx, http.MethodDelete, "/containers/"+container, url.Values{"force": {"1"}, "v": {"1"}}, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("removing container %s: %w", container, err)
+	}
+	return nil
+}
+
+// Pull pulls an image, printing the progress messages to out
+func (r *EngineRuntime) Pull(ctx context.Context, image string, out io.Writer) error {
+	body, err := r.do(ctx, http.MethodPost, "/images/create", pullQuery(image), nil, nil)
+	if err != nil {
+		return fmt.Errorf("pulling %s: %w", image, err)
+	}
+	defer body.Close()
+	if err := readProgress(body, out); err != nil {
+		return fmt.Errorf("pulling %s: %w", image, err)
+	}
+	return nil
+}
+
+// pullQuery splits image into the repository and the tag or digest to pull.
+// Without a tag the API pulls every tag of the repository, so it defaults
+// to latest like the CLI.
+func pullQuery(image string) url.Values {
+	ref := ParseImageRef(image)
+	tag := ref.Tag
+	if ref.Digest != "" {
+		tag = ref.Digest
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	ref.Tag, ref.Digest = "", ""
+	return url.Values{"fromImage": {ref.String()}, "tag": {tag}}
+}
+
+// Build builds an image from the archived context directory
+func (r *EngineRuntime) Build(ctx context.Context, build ImageBuild, tag string, out io.Writer) error {
+	archive, err := tarContext(build.Context)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"t": {tag}, "dockerfile": {build.dockerfile()}, "rm": {"1"}}
+	if len(build.Args) > 0 {
+		args, err := json.Marshal(build.Args)
+		if err != nil {
+			return err
+		}
+		query.Set("buildargs", string(args))
+	}
+
+	body, err := r.do(ctx, http.MethodPost, "/build", query, archive, nil)
+	if err != nil {
+		return fmt.Errorf("building %s: %w", tag, err)
+	}
+	defer body.Close()
+	if err := readProgress(body, out); err != nil {
+		return fmt.Errorf("building %s: %w", tag, err)
+	}
+	return nil
+}
+
+// readProgress prints the messages of a pull or build progress stream to
+// out. Failures are reported in the stream, not by the status code.
+func readProgress(body io.Reader, out io.Writer) error {
+	if out == nil {
+		out = io.Discard
+	}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var progress struct {
+			Status string `json:"status"` // Pull progress
+			Stream string `json:"stream"` // Build output
+			Error  string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &progress); err != nil {
+			continue
+		}
+		if progress.Error != "" {
+			return errors.New(progress.Error)
+		}
+		if progress.Status != "" {
+			fmt.Fprintln(out, progress.Status)
+		}
+		if progress.Stream != "" {
+			io.WriteString(out, progress.Stream)
+		}
+	}
+	return scanner.Err()
+}
+
+// Inspect returns the ID and digests of a local image
+func (r *EngineRuntime) Inspect(ctx context.Context, image string) (ImageInfo, error) {
+	var info struct {
+		ID          string `json:"Id"`
+		RepoDigests []string
+	}
+	if _, err := r.do(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, &info); err != nil {
+		return ImageInfo{}, fmt.Errorf("inspecting %s: %w", image, err)
+	}
+	return ImageInfo{ID: info.ID, RepoDigests: info.RepoDigests}, nil
+}
+
+// CreateNetwork creates a bridge network
+func (r *EngineRuntime) CreateNetwork(ctx context.Context, name string) error {
+	if err := r.call(ctx, http.MethodPost, "/networks/create", nil, map[string]string{"Name": name}); err != nil {
+		return fmt.Errorf("creating network %s: %w", name, err)
+	}
+	return nil
+}
+
+// RemoveNetwork removes a network
+func (r *EngineRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	if err := r.call(ctx, http.MethodDelete, "/networks/"+name, nil, nil); err != nil {
+		return fmt.Errorf("removing network %s: %w", name, err)
+	}
+	return nil
+}
+
+// demuxStream splits the multiplexed output stream of a container without
+// a TTY. Every frame has an 8 byte header holding the stream (1 stdout, 2
+// stderr) and the payload size.
+func demuxStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package lib
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEngine implements the parts of the Docker Engine API used by EngineRuntime
+type fakeEngine struct {
+	mu         sync.Mutex
+	calls      []string
+	images     map[string]bool
+	containers map[string]*fakeContainer
+	networks   map[string]bool
+	nextID     int
+
+	builds    map[string]fakeBuild // Built images by tag
+	output    [][2]string          // Frames written to attached streams, stream and payload
+	exitCode  int
+	oomKilled bool     // Exited containers report they were killed for exceeding their memory limit
+	stats     []string // Stats samples sent before the stats stream ends
+	hang      bool     // Containers run until they are removed
+}
+
+// fakeBuild records the files and parameters an image was built from
+type fakeBuild struct {
+	files      []string
+	dockerfile string
+	args       string
+}
+
+type fakeContainer struct {
+	config  containerConfig
+	started chan struct{}
+	removed chan struct{}
+}
+
+func newFakeEngine(t *testing.T) (*fakeEngine, *EngineRuntime) {
+	engine := &fakeEngine{
+		images:     map[string]bool{"alpine:latest": true},
+		containers: make(map[string]*fakeContainer),
+		networks:   make(map[string]bool),
+		builds:     make(map[string]fakeBuild),
+	}
+
+	// Serve on a unix socket like the real daemon
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	server := httptest.NewUnstartedServer(engine)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	runtime, err := NewEngineRuntime("unix://" + socket)
+	assert.NoError(t, err)
+	return engine, runtime
+}
+
+func (e *fakeEngine) container(name string) *fakeContainer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.containers[name]
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/"+engineAPIVersion)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	// Stats are sampled concurrently, they aren't recorded so the order of
+	// the calls is stable
+	if r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "containers" && parts[2] == "stats" {
+		for _, s := range e.stats {
+			fmt.Fprintln(w, s)
+		}
+		return
+	}
+
+	e.mu.Lock()
+	e.calls = append(e.calls, r.Method+" "+path)
+	e.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && path == "/containers/create":
+		var config containerConfig
+		json.NewDecoder(r.Body).Decode(&config)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if !e.images[config.Image] {
+			writeEngineError(w, http.StatusNotFound, "No such image: "+config.Image)
+			return
+		}
+		e.nextID++
+		id := fmt.Sprintf("c%d", e.nextID)
+		c := &fakeContainer{config: config, started: make(chan struct{}), removed: make(chan struct{})}
+		e.containers[id] = c
+		if name := r.URL.Query().Get("name"); name != "" {
+			e.containers[name] = c
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Id": id})
+
+	case r.Method == http.MethodPost && path == "/images/create":
+		query := r.URL.Query()
+		image := query.Get("fromImage") + ":" + query.Get("tag")
+		if strings.HasPrefix(query.Get("tag"), "sha256:") {
+			image = query.Get("fromImage") + "@" + query.Get("tag")
+		}
+		e.mu.Lock()
+		e.images[image] = true
+		e.mu.Unlock()
+		fmt.Fprintln(w, `{"status":"Pulling from library/golang"}`)
+		fmt.Fprintln(w, `{"status":"Download complete"}`)
+
+	case r.Method == http.MethodPost && path == "/build":
+		query := r.URL.Query()
+		build := fakeBuild{dockerfile: query.Get("dockerfile"), args: query.Get("buildargs")}
+		tr := tar.NewReader(r.Body)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			build.files = append(build.files, header.Name)
+		}
+		if r.Header.Get("Content-Type") != "application/x-tar" || len(build.files) == 0 {
+			fmt.Fprintln(w, `{"error":"empty build context"}`)
+			return
+		}
+		e.mu.Lock()
+		e.builds[query.Get("t")] = build
+		e.mu.Unlock()
+		fmt.Fprintln(w, `{"stream":"Step 1/1 : FROM alpine\n"}`)
+		fmt.Fprintln(w, `{"aux":{"ID":"sha256:built"}}`)
+
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "containers":
+		c := e.container(parts[1])
+		if c == nil {
+			writeEngineError(w, http.StatusNotFound, "No such container: "+parts[1])
+			return
+		}
+		switch parts[2] {
+		case "attach":
+			w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-c.started
+			for _, frame := range e.output {
+				writeFrame(w, frame[0], frame[1])
+			}
+		case "start":
+			close(c.started)
+			w.WriteHeader(http.StatusNoContent)
+		case "wait":
+			if e.hang {
+				select {
+				case <-c.removed:
+				case <-r.Context().Done():
+				}
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]int{"StatusCode": e.exitCode})
+		case "exec":
+			json.NewEncoder(w).Encode(map[string]string{"Id": "e1"})
+		}
+
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "containers" && parts[2] == "json":
+		json.NewEncoder(w).Encode(map[string]interface{}{"State": map[string]bool{"OOMKilled": e.oomKilled}})
+
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "containers":
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		c, ok := e.containers[parts[1]]
+		if !ok {
+			writeEngineError(w, http.StatusNotFound, "No such container: "+parts[1])
+			return
+		}
+		for name, other := range e.containers {
+			if other == c {
+				delete(e.containers, name)
+			}
+		}
+		close(c.removed)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && path == "/exec/e1/start":
+		writeFrame(w, "stderr", "not ready\n")
+	case r.Method == http.MethodGet && path == "/exec/e1/json":
+		json.NewEncoder(w).Encode(map[string]int{"ExitCode": 2})
+
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "images":
+		if parts[1] != "alpine:latest" {
+			writeEngineError(w, http.StatusNotFound, "No such image: "+parts[1])
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Id": "sha256:abc", "RepoDigests": []string{"alpine@sha256:def"}})
+
+	case r.Method == http.MethodPost && path == "/networks/create":
+		var body struct{ Name string }
+		json.NewDecoder(r.Body).Decode(&body)
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.networks[body.Name] {
+			writeEngineError(w, http.StatusConflict, "network with name "+body.Name+" already exists")
+			return
+		}
+		e.networks[body.Name] = true
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "networks":
+		e.mu.Lock()
+		delete(e.networks, parts[1])
+		e.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeEngineError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func writeEngineError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func writeFrame(w io.Writer, stream, payload string) {
+	header := make([]byte, 8)
+	header[0] = 1
+	if stream == "stderr" {
+		header[0] = 2
+	}
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	w.Write(header)
+	io.WriteString(w, payload)
+}
+
+func TestEngineRuntimeRun(t *testing.T) {
+	engine, runtime := newFakeEngine(t)
+	engine.output = [][2]string{{"stdout", "building\n"}, {"stderr", "warning\n"}, {"stdout", "done\n"}}
+
+	spec := ContainerSpec{
+		Name:    "gosonic-test",
+		Image:   "alpine:latest",
+		Command: []string{"sh", "-c", "make"},
+		Env:     map[string]string{"CGO_ENABLED": "0"},
+		WorkDir: "/workspace",
+		Mounts: []Mount{
+			{Type: VolumeBind, Source: "/src", Target: "/workspace", Readonly: true},
+			{Type: VolumeCache, Source: "gosonic-test-go", Target: "/go"},
+			{Type: VolumeTmp, Target: "/tmp", Size: "64m"},
+		},
+		Init: true,
+	}
+
+	var stdout, stderr strings.Builder
+	result := runtime.Run(context.Background(), spec, &stdout, &stderr)
+	assert.NoError(t, result.Error)
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Equal(t, "building\ndone\n", stdout.String())
+	assert.Equal(t, "warning\n", stderr.String())
+	assert.Equal(t, "building\nwarning\ndone\n", result.Output)
+
+	assert.Equal(t, []string{
+		"POST /containers/create",
+		"POST /containers/c1/attach",
+		"POST /containers/c1/start",
+		"POST /containers/c1/wait",
+		"DELETE /containers/c1",
+	}, engine.calls)
+	assert.Empty(t, engine.containers)
+
+	t.Run("exit status", func(t *testing.T) {
+		engine.exitCode = 3
+		defer func() { engine.exitCode = 0 }()
+
+		result := runtime.Run(context.Background(), spec, nil, nil)
+		assert.EqualError(t, result.Error, "exit status 3")
+		assert.Equal(t, 3, result.ExitCode)
+		assert.False(t, result.OOMKilled)
+	})
+
+	t.Run("out of memory", func(t *testing.T) {
+		engine.exitCode = 137
+		engine.oomKilled = true
+		defer func() { engine.exitCode, engine.oomKilled = 0, false }()
+
+		result := runtime.Run(context.Background(), spec, nil, nil)
+		assert.EqualError(t, result.Error, "exit status 137")
+		assert.True(t, result.OOMKilled)
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		assert.Nil(t, result.Usage)
+
+		engine.stats = []string{
+			`{"cpu_stats":{"cpu_usage":{"total_usage":500000000}},"memory_stats":{"usage":104857600}}`,
+			`{"cpu_stats":{"cpu_usage":{"total_usage":1500000000}},"memory_stats":{"usage":52428800,"max_usage":209715200}}`,
+			`{"cpu_stats":{"cpu_usage":{"total_usage":0}},"memory_stats":{}}`, // Stopped
+		}
+		defer func() { engine.stats = nil }()
+
+		result := runtime.Run(context.Background(), spec, nil, nil)
+		assert.NoError(t, result.Error)
+		assert.Equal(t, &ResourceUsage{CPUSeconds: 1.5, PeakMemory: 200 << 20}, result.Usage)
+	})
+
+	t.Run("pulls missing images", func(t *testing.T) {
+		engine.calls = nil
+		pulled := spec
+		pulled.Image = "golang:1.23"
+
+		result := runtime.Run(context.Background(), pulled, nil, nil)
+		assert.NoError(t, result.Error)
+		assert.Equal(t, []string{"POST /containers/create", "POST /images/create", "POST /containers/create"}, engine.calls[:3])
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		engine.hang = true
+		defer func() { engine.hang = false }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		result := runtime.Run(ctx, spec, nil, nil)
+		assert.ErrorIs(t, result.Error, context.DeadlineExceeded)
+		assert.Equal(t, -1, result.ExitCode)
+
+		// The container is removed even though the stage was stopped
+		assert.Nil(t, engine.container("gosonic-test"))
+	})
+}
+
+func TestNewContainerConfig(t *testing.T) {
+	config, err := newContainerConfig(ContainerSpec{
+		Image:        "postgres:16",
+		Env:          map[string]string{"B": "2", "A": "1"},
+		User:         "1000:1000",
+		Resources:    Resources{CPUs: "1.5", Memory: "512m", Pids: 100, ShmSize: "1g"},
+		Mounts:       []Mount{{Type: VolumeBind, Source: "/data", Target: "/var/lib/postgresql/data", Readonly: true}, {Type: VolumeTmp, Target: "/tmp", Readonly: true, Size: "1g"}},
+		Network:      "gosonic-net",
+		NetworkAlias: "db",
+		Ports:        []string{"5432", "8080:80", "127.0.0.1:5353:53/udp"},
+		Init:         true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, containerConfig{
+		Image: "postgres:16",
+		Env:   []string{"A=1", "B=2"},
+		User:  "1000:1000",
+		ExposedPorts: map[string]struct{}{
+			"5432/tcp": {}, "80/tcp": {}, "53/udp": {},
+		},
+		HostConfig: hostConfig{
+			Binds:       []string{"/data:/var/lib/postgresql/data:ro"},
+			Tmpfs:       map[string]string{"/tmp": "ro,size=1g"},
+			Init:        true,
+			NetworkMode: "gosonic-net",
+			NanoCpus:    1500000000,
+			Memory:      512 << 20,
+			PidsLimit:   100,
+			ShmSize:     1 << 30,
+			PortBindings: map[string][]portBinding{
+				"5432/tcp": {{}},
+				"80/tcp":   {{HostPort: "8080"}},
+				"53/udp":   {{HostIP: "127.0.0.1", HostPort: "5353"}},
+			},
+		},
+		NetworkingConfig: &networkingConfig{EndpointsConfig: map[string]endpointConfig{
+			"gosonic-net": {Aliases: []string{"db"}},
+		}},
+	}, config)
+
+	_, err = newContainerConfig(ContainerSpec{Ports: []string{"1:2:3:4"}})
+	assert.ErrorContains(t, err, `invalid port "1:2:3:4"`)
+
+	_, err = newContainerConfig(ContainerSpec{Resources: Resources{Memory: "lots"}})
+	assert.ErrorContains(t, err, "invalid memory")
+
+	envFile := filepath.Join(t.TempDir(), "env")
+	assert.NoError(t, os.WriteFile(envFile, []byte("TOKEN=abc\nOTHER=def\n"), 0600))
+	config, err = newContainerConfig(ContainerSpec{Env: map[string]string{"CI": "true"}, EnvFile: envFile})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CI=true", "TOKEN=abc", "OTHER=def"}, config.Env)
+}
+
+func TestEngineRuntimeOperations(t *testing.T) {
+	engine, runtime := newFakeEngine(t)
+	ctx := context.Background()
+
+	t.Run("network", func(t *testing.T) {
+		assert.NoError(t, runtime.CreateNetwork(ctx, "gosonic-net"))
+		err := runtime.CreateNetwork(ctx, "gosonic-net")
+		assert.EqualError(t, err, "creating network gosonic-net: engine API: network with name gosonic-net already exists (status 409)")
+		assert.NoError(t, runtime.RemoveNetwork(ctx, "gosonic-net"))
+		assert.Empty(t, engine.networks)
+	})
+
+	t.Run("start and exec", func(t *testing.T) {
+		assert.NoError(t, runtime.Start(ctx, ContainerSpec{Name: "db", Image: "alpine:latest"}))
+		assert.NotNil(t, engine.container("db"))
+
+		result := runtime.Exec(ctx, "db", []string{"pg_isready"})
+		assert.EqualError(t, result.Error, "exit status 2")
+		assert.Equal(t, 2, result.ExitCode)
+		assert.Equal(t, "not ready\n", result.Stderr)
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		assert.NoError(t, runtime.Stop(ctx, "db"))
+		assert.Nil(t, engine.container("db"))
+		// Removing a container that's already gone is fine
+		assert.NoError(t, runtime.Stop(ctx, "db"))
+	})
+
+	t.Run("pull", func(t *testing.T) {
+		var out strings.Builder
+		assert.NoError(t, runtime.Pull(ctx, "golang:1.23", &out))
+		assert.Equal(t, "Pulling from library/golang\nDownload complete\n", out.String())
+		assert.True(t, engine.images["golang:1.23"])
+	})
+
+	t.Run("pull query", func(t *testing.T) {
+		tests := map[string]url.Values{
+			"golang":               {"fromImage": {"golang"}, "tag": {"latest"}},
+			"golang:1.23":          {"fromImage": {"golang"}, "tag": {"1.23"}},
+			"localhost:5000/app":   {"fromImage": {"localhost:5000/app"}, "tag": {"latest"}},
+			"alpine@sha256:abc":    {"fromImage": {"alpine"}, "tag": {"sha256:abc"}},
+			"alpine:3@sha256:abc":  {"fromImage": {"alpine"}, "tag": {"sha256:abc"}},
+			"ghcr.io/org/app:v1.2": {"fromImage": {"ghcr.io/org/app"}, "tag": {"v1.2"}},
+		}
+		for image, want := range tests {
+			assert.Equal(t, want, pullQuery(image), image)
+		}
+
+		assert.NoError(t, runtime.Pull(ctx, "alpine@sha256:abc", io.Discard))
+		assert.True(t, engine.images["alpine@sha256:abc"])
+	})
+
+	t.Run("build", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile.ci"), []byte("FROM alpine"), 0644))
+
+		var out strings.Builder
+		build := ImageBuild{Context: dir, Dockerfile: "Dockerfile.ci", Args: map[string]string{"GO": "1.24"}}
+		assert.NoError(t, runtime.Build(ctx, build, "gosonic-test-runner:0123", &out))
+		assert.Equal(t, "Step 1/1 : FROM alpine\n", out.String())
+		assert.Equal(t, fakeBuild{files: []string{"Dockerfile.ci"}, dockerfile: "Dockerfile.ci", args: `{"GO":"1.24"}`}, engine.builds["gosonic-test-runner:0123"])
+
+		err := runtime.Build(ctx, ImageBuild{Context: t.TempDir()}, "gosonic-test-runner:4567", io.Discard)
+		assert.EqualError(t, err, "building gosonic-test-runner:4567: empty build context")
+	})
+
+	t.Run("inspect", func(t *testing.T) {
+		info, err := runtime.Inspect(ctx, "alpine:latest")
+		assert.NoError(t, err)
+		assert.Equal(t, ImageInfo{ID: "sha256:abc", RepoDigests: []string{"alpine@sha256:def"}}, info)
+
+		_, err = runtime.Inspect(ctx, "missing:latest")
+		assert.ErrorContains(t, err, "No such image: missing:latest")
+	})
+}
+
+func TestNewEngineRuntime(t *testing.T) {
+	tests := map[string]struct {
+		host        string
+		dockerHost  string
+		wantBaseURL string
+		wantErr     string
+	}{
+		"default socket":  {wantBaseURL: "http://docker"},
+		"DOCKER_HOST":     {dockerHost: "tcp://127.0.0.1:2375", wantBaseURL: "http://127.0.0.1:2375"},
+		"explicit host":   {host: "tcp://docker:2375", dockerHost: "unix:///run/docker.sock", wantBaseURL: "http://docker:2375"},
+		"unsupported ssh": {host: "ssh://user@host", wantErr: "unsupported docker host"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("DOCKER_HOST", tc.dockerHost)
+			runtime, err := NewEngineRuntime(tc.host)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantBaseURL, runtime.baseURL)
+		})
+	}
+}
+
+func TestExecuteStageEngineRuntime(t *testing.T) {
+	engine, runtime := newFakeEngine(t)
+	engine.output = [][2]string{{"stdout", "hello\n"}}
+	engine.stats = []string{`{"cpu_stats":{"cpu_usage":{"total_usage":250000000}},"memory_stats":{"usage":1048576}}`}
+
+	var out strings.Builder
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:     "test",
+		Runner:   "alpine:latest",
+		Commands: []string{"echo hello"},
+		Runtime:  runtime,
+		Output:   &out,
+	}, store, "test-project")
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "hello\n")
+
+	final := store.logs[len(store.logs)-1]
+	assert.Equal(t, RuntimeDockerAPI, final.Runtime)
+	assert.Equal(t, "docker run --rm --init --workdir /workspace alpine:latest echo hello", final.Command)
+	assert.Equal(t, &ResourceUsage{CPUSeconds: 0.25, PeakMemory: 1 << 20}, final.Usage)
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// GetGitBranch returns the name of the currently checked out branch. On a
+// detached HEAD it returns "HEAD".
+func GetGitBranch() (string, error) {
+	cmd := execCommand("git", "rev-parse", "--abbrev-ref", "HEAD")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// GetChangedFiles returns the files that differ between base and the working
+// tree, relative to the repository root. This includes committed as well as
+// uncommitted changes.
+func GetChangedFiles(base string) ([]string, error) {
+	cmd := execCommand("git", "diff", "--name-only", base)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing files changed since %s: %w", base, err)
+	}
+
+	var files []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// MatchGlob reports whether name matches the slash separated glob pattern.
+// In addition to the path.Match syntax a "**" element matches any number of
+// path elements, including none.
+func MatchGlob(pattern, name string) (bool, error) {
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// MatchAnyGlob reports whether name matches any of the glob patterns
+func MatchAnyGlob(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		ok, err := MatchGlob(pattern, name)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func matchElements(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try to match the rest of the pattern at every remaining position
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchElements(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(name) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil {
+			return false, fmt.Errorf("invalid glob pattern %q: %w", strings.Join(pattern, "/"), err)
+		}
+		if !ok {
+			return false, nil
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
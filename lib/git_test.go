@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGitBranch(t *testing.T) {
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		if command == "git" && len(args) > 0 && args[0] == "rev-parse" {
+			return exec.Command("echo", "feature/login")
+		}
+		return mockExecCommand(command, args...)
+	}
+	defer func() { execCommand = mockExecCommand }()
+
+	branch, err := GetGitBranch()
+	assert.NoError(t, err)
+	assert.Equal(t, "feature/login", branch)
+}
+
+func TestGetChangedFiles(t *testing.T) {
+	var diffArgs []string
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		if command == "git" && len(args) > 0 && args[0] == "diff" {
+			diffArgs = args
+			return exec.Command("printf", "main.go\nlib/docker.go\n\n")
+		}
+		return mockExecCommand(command, args...)
+	}
+	defer func() { execCommand = mockExecCommand }()
+
+	files, err := GetChangedFiles("origin/main")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"main.go", "lib/docker.go"}, files)
+	assert.Equal(t, []string{"diff", "--name-only", "origin/main"}, diffArgs)
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := map[string]struct {
+		pattern string
+		name    string
+		want    bool
+		wantErr bool
+	}{
+		"exact":                  {pattern: "main.go", name: "main.go", want: true},
+		"star in element":        {pattern: "lib/*.go", name: "lib/docker.go", want: true},
+		"star stays in element":  {pattern: "*.go", name: "lib/docker.go", want: false},
+		"double star any depth":  {pattern: "**/*.go", name: "lib/sub/docker.go", want: true},
+		"double star no element": {pattern: "**/*.go", name: "main.go", want: true},
+		"double star in middle":  {pattern: "docs/**/index.md", name: "docs/index.md", want: true},
+		"trailing double star":   {pattern: "docs/**", name: "docs/guide/setup.md", want: true},
+		"different directory":    {pattern: "docs/**", name: "lib/docker.go", want: false},
+		"invalid pattern":        {pattern: "lib/[.go", name: "lib/docker.go", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := MatchGlob(tc.pattern, tc.name)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
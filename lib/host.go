@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ShellRunner runs a stage's commands directly on the host instead of in a container
+const ShellRunner = "shell"
+
+// hostWaitDelay bounds how long a killed host stage may keep its output open
+const hostWaitDelay = 5 * time.Second
+
+// hostUserHome is HOME in containers run as the host user. The image usually
+// has no passwd entry for the uid, which leaves HOME at the unwritable /.
+const hostUserHome = "/tmp"
+
+// runAsHostUser sets the stage's user to the calling user and gives it a
+// writable HOME, unless the stage's environment sets one
+func runAsHostUser(stage *StageExecution) error {
+	user, err := hostUser()
+	if err != nil {
+		return err
+	}
+	stage.User = user
+
+	env := make(map[string]string, len(stage.Environment)+1)
+	for k, v := range stage.Environment {
+		env[k] = v
+	}
+	if _, ok := env["HOME"]; !ok {
+		env["HOME"] = hostUserHome
+	}
+	stage.Environment = env
+	return nil
+}
+
+// hostCommand returns the command line of a stage run by the shell runner
+func hostCommand(stage StageExecution) []string {
+	return []string{"sh", "-c", strings.Join(stage.Commands, " && ")}
+}
+
+// execHost runs a command on the host in dir with the environment of gosonic
+// plus env. Like ExecDocker, output is streamed to stdout and stderr and the
+// command is killed, along with any processes it started, when the context
+// is done.
+func execHost(ctx context.Context, args []string, dir string, env map[string]string, stdout, stderr io.Writer) DockerResult {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for _, k := range sortedKeys(env) {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, env[k]))
+	}
+	cmd.WaitDelay = hostWaitDelay
+	killProcessGroup(cmd)
+
+	return runCommand(cmd, stdout, stderr)
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package lib
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// hostUser fails, there are no uids to pass to the container
+func hostUser() (string, error) {
+	return "", fmt.Errorf("running containers as the host user is not supported on %s", runtime.GOOS)
+}
+
+// killProcessGroup is a no-op where process groups aren't available, only
+// the command itself is killed
+func killProcessGroup(cmd *exec.Cmd) {}
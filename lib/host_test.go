@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteStageShellRunner(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		t.Errorf("docker must not be called, got %v", args)
+		return DockerResult{}
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bin/app": "binary"})
+
+	var out strings.Builder
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:        "clean",
+		Runner:      ShellRunner,
+		Commands:    []string{"rm -rf ./bin", "echo cleaned $TARGET"},
+		Environment: map[string]string{"TARGET": "bin"},
+		Dir:         dir,
+		Output:      &out,
+	}, store, "test-project")
+	assert.NoError(t, err)
+
+	assert.NoDirExists(t, filepath.Join(dir, "bin"))
+	assert.Contains(t, out.String(), "Runner: shell (on the host)")
+	assert.Contains(t, out.String(), "cleaned bin\n")
+
+	// Host executions are marked in the audit log
+	final := store.logs[len(store.logs)-1]
+	assert.True(t, final.Host)
+	assert.Equal(t, "sh -c rm -rf ./bin && echo cleaned $TARGET", final.Command)
+	assert.Equal(t, "success", final.Status)
+}
+
+func TestExecuteStageShellRunnerFailure(t *testing.T) {
+	tests := map[string]struct {
+		stage      StageExecution
+		wantErr    string
+		wantStatus string
+	}{
+		"exit code": {
+			stage:      StageExecution{Commands: []string{"echo failing >&2", "exit 3"}},
+			wantErr:    "exit status 3",
+			wantStatus: "failed",
+		},
+		"timeout": {
+			// The sleep would keep running without killing the process group
+			stage:      StageExecution{Commands: []string{"sleep 60 && echo done"}, Timeout: 50 * time.Millisecond},
+			wantErr:    "timed out",
+			wantStatus: "timeout",
+		},
+		"volumes": {
+			stage:   StageExecution{Commands: []string{"true"}, Volumes: []Volume{{Source: ".", Target: "/workspace"}}},
+			wantErr: "volumes and services are not supported by the shell runner",
+		},
+		"user": {
+			stage:   StageExecution{Commands: []string{"true"}, User: "1000"},
+			wantErr: "the shell runner runs as the calling user, user can't be set",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stage := tc.stage
+			stage.Name = "test"
+			stage.Runner = ShellRunner
+			stage.Output = io.Discard
+			stage.ErrOutput = io.Discard
+
+			store := &mockAuditStore{}
+			start := time.Now()
+			err := ExecuteStage(stage, store, "test-project")
+			assert.ErrorContains(t, err, tc.wantErr)
+			assert.Less(t, time.Since(start), 10*time.Second)
+
+			if tc.wantStatus == "" {
+				assert.Empty(t, store.logs)
+				return
+			}
+			assert.Equal(t, tc.wantStatus, store.logs[len(store.logs)-1].Status)
+		})
+	}
+}
+
+func TestExecHostEnvironment(t *testing.T) {
+	t.Setenv("GOSONIC_HOST_TEST", "inherited")
+
+	var out strings.Builder
+	result := execHost(context.Background(), []string{"sh", "-c", "echo $GOSONIC_HOST_TEST $STAGE_VAR; pwd"}, os.TempDir(),
+		map[string]string{"STAGE_VAR": "set"}, &out, nil)
+	assert.NoError(t, result.Error)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, "inherited set", lines[0])
+	wantDir, _ := filepath.EvalSymlinks(os.TempDir())
+	gotDir, _ := filepath.EvalSymlinks(lines[1])
+	assert.Equal(t, wantDir, gotDir)
+}
+
+func TestExecuteStageHostUser(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	hostUser := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	tests := map[string]struct {
+		stage    StageExecution
+		wantArgs []string
+		wantUser string
+	}{
+		"host user": {
+			stage:    StageExecution{HostUser: true},
+			wantArgs: []string{"--user", hostUser, "-e", "HOME=/tmp"},
+			wantUser: hostUser,
+		},
+		"host user keeps HOME": {
+			stage:    StageExecution{HostUser: true, Environment: map[string]string{"HOME": "/workspace/.home"}},
+			wantArgs: []string{"--user", hostUser, "-e", "HOME=/workspace/.home"},
+			wantUser: hostUser,
+		},
+		"named user": {
+			stage:    StageExecution{User: "nobody"},
+			wantArgs: []string{"--user", "nobody", "public.ecr.aws/docker/library/alpine:latest"},
+			wantUser: "nobody",
+		},
+		"image user": {
+			stage:    StageExecution{},
+			wantArgs: []string{"--workdir", "/workspace", "public.ecr.aws/docker/library/alpine:latest"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				if args[1] == "run" {
+					got = args
+				}
+				return DockerResult{}
+			}
+
+			stage := tc.stage
+			stage.Name = "build"
+			stage.Runner = "public.ecr.aws/docker/library/alpine:latest"
+			stage.Commands = []string{"go build ./..."}
+			stage.Output = io.Discard
+
+			store := &mockAuditStore{}
+			assert.NoError(t, ExecuteStage(stage, store, "test-project"))
+			assert.Contains(t, strings.Join(got, " "), strings.Join(tc.wantArgs, " "))
+			assert.Equal(t, tc.wantUser, store.logs[len(store.logs)-1].User)
+		})
+	}
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// hostUser returns the uid and gid of the calling user
+func hostUser() (string, error) {
+	return fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()), nil
+}
+
+// killProcessGroup starts the command in its own process group and kills the
+// whole group when the command's context is done
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
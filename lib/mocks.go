@@ -2,6 +2,14 @@ package lib
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/stretchr/testify/mock"
@@ -17,6 +25,11 @@ func (m *MockAuditStore) Store(log AuditLog) error {
 	return args.Error(0)
 }
 
+func (m *MockAuditStore) StoreRun(run Run) error {
+	args := m.Called(run)
+	return args.Error(0)
+}
+
 // MockS3Client mocks the S3 client for testing
 type MockS3Client struct {
 	mock.Mock
@@ -29,3 +42,164 @@ func (m *MockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput,
 	args := m.Called(ctx, params)
 	return &s3.PutObjectOutput{}, args.Error(1)
 }
+
+func (m *MockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	args := m.Called(ctx, params)
+	if out, ok := args.Get(0).(*s3.GetObjectOutput); ok {
+		return out, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(ctx, params)
+	if out, ok := args.Get(0).(*s3.ListObjectsV2Output); ok {
+		return out, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return &s3.DeleteObjectOutput{}, args.Error(1)
+}
+
+// FakeS3 is an in-memory stand-in for the parts of the S3 API the stores
+// use, so they can be tested with a real S3 client. Serve it with
+// httptest.NewServer and point the client at the server with path-style
+// addressing.
+type FakeS3 struct {
+	PageSize int // Maximum keys per list page, defaults to 1000
+
+	mu      sync.Mutex
+	objects map[string][]byte // Keyed by bucket/key
+	lists   int
+	gets    int
+}
+
+// NewFakeS3 creates an empty FakeS3
+func NewFakeS3() *FakeS3 {
+	return &FakeS3{objects: make(map[string][]byte)}
+}
+
+// Keys returns the keys stored in a bucket in lexical order
+func (f *FakeS3) Keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if rest, ok := strings.CutPrefix(key, bucket+"/"); ok {
+			keys = append(keys, rest)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Lists returns the number of list requests served
+func (f *FakeS3) Lists() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
+
+// Gets returns the number of objects downloaded
+func (f *FakeS3) Gets() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gets
+}
+
+// fakeS3ETag returns the ETag of an object, the MD5 of its content like S3's
+// for objects that weren't uploaded in parts
+func fakeS3ETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+// fakeS3ListResult is the response of ListObjectsV2
+type fakeS3ListResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeS3Object
+}
+
+type fakeS3Object struct {
+	Key  string
+	ETag string
+	Size int
+}
+
+// ServeHTTP implements http.Handler
+func (f *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[bucket+"/"+key] = data
+		w.Header().Set("ETag", fakeS3ETag(data))
+
+	case r.Method == http.MethodGet && key != "":
+		data, ok := f.objects[bucket+"/"+key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Message>%s not found</Message></Error>", key)
+			return
+		}
+		f.gets++
+		w.Header().Set("ETag", fakeS3ETag(data))
+		w.Write(data)
+
+	case r.Method == http.MethodDelete && key != "":
+		delete(f.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.lists++
+		query := r.URL.Query()
+		pageSize := f.PageSize
+		if pageSize == 0 {
+			pageSize = 1000
+		}
+
+		// Keys are listed in lexical order, the token is the last key listed
+		var keys []string
+		for k := range f.objects {
+			if rest, ok := strings.CutPrefix(k, bucket+"/"); ok && strings.HasPrefix(rest, query.Get("prefix")) && rest > query.Get("continuation-token") {
+				keys = append(keys, rest)
+			}
+		}
+		sort.Strings(keys)
+
+		result := fakeS3ListResult{Name: bucket, Prefix: query.Get("prefix"), MaxKeys: pageSize}
+		if len(keys) > pageSize {
+			keys = keys[:pageSize]
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[len(keys)-1]
+		}
+		for _, k := range keys {
+			data := f.objects[bucket+"/"+k]
+			result.Contents = append(result.Contents, fakeS3Object{Key: k, ETag: fakeS3ETag(data), Size: len(data)})
+		}
+		result.KeyCount = len(result.Contents)
+
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+
+	default:
+		http.Error(w, "not implemented by FakeS3", http.StatusNotImplemented)
+	}
+}
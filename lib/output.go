@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLineLength is the longest partial line buffered before it is written
+// out anyway, so output without newlines can't grow memory unbounded
+const maxLineLength = 64 * 1024
+
+// outputMu serializes writes from concurrently running stages so that
+// lines from different stages never interleave mid-line
+var outputMu sync.Mutex
+
+// PrefixWriter prefixes every line written to it before passing it on,
+// optionally with a timestamp. Partial lines are buffered until they are
+// completed or flushed.
+type PrefixWriter struct {
+	w          io.Writer
+	prefix     string
+	buf        []byte
+	Timestamps bool             // Prefix each line with the time it was completed
+	now        func() time.Time // Allow overriding the clock in tests
+}
+
+// NewPrefixWriter creates a PrefixWriter writing to w
+func NewPrefixWriter(w io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{
+		w:      w,
+		prefix: prefix,
+		now:    time.Now,
+	}
+}
+
+// Write implements io.Writer
+func (p *PrefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+
+	if len(p.buf) >= maxLineLength {
+		if err := p.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+// Flush writes any buffered partial line, terminated by a newline
+func (p *PrefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	line := append(p.buf, '\n')
+	p.buf = nil
+	return p.writeLine(line)
+}
+
+func (p *PrefixWriter) writeLine(line []byte) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	var prefix []byte
+	if p.Timestamps {
+		prefix = p.now().AppendFormat(prefix, "15:04:05.000 ")
+	}
+	prefix = append(prefix, p.prefix...)
+
+	_, err := p.w.Write(append(prefix, line...))
+	return err
+}
+
+// syncWriter serializes writes to w, so that a command's stdout and stderr,
+// which are copied from separate goroutines, can share one writer
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newSyncWriter creates a syncWriter writing to w, discarding if w is nil
+func newSyncWriter(w io.Writer) *syncWriter {
+	if w == nil {
+		w = io.Discard
+	}
+	return &syncWriter{w: w}
+}
+
+// Write implements io.Writer
+func (s *syncWriter) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(data)
+}
+
+// tailBuffer keeps the last max bytes written to it. It is safe for
+// concurrent use, so stdout and stderr can share one buffer.
+type tailBuffer struct {
+	mu        sync.Mutex
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+// newTailBuffer creates a tailBuffer keeping at most max bytes
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+// Write implements io.Writer
+func (t *tailBuffer) Write(data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, data...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+		t.truncated = true
+	}
+	return len(data), nil
+}
+
+// String returns the kept output, starting at a line boundary if earlier
+// output was dropped
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	buf := t.buf
+	if t.truncated {
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			buf = buf[i+1:]
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPrefixWriter(&buf, "[build] ")
+
+	_, err := w.Write([]byte("first line\nsecond "))
+	assert.NoError(t, err)
+	assert.Equal(t, "[build] first line\n", buf.String())
+
+	_, err = w.Write([]byte("line\nunterminated"))
+	assert.NoError(t, err)
+	assert.Equal(t, "[build] first line\n[build] second line\n", buf.String())
+
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, "[build] first line\n[build] second line\n[build] unterminated\n", buf.String())
+}
+
+func TestPrefixWriterTimestamps(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPrefixWriter(&buf, "[test] ")
+	w.Timestamps = true
+	w.now = func() time.Time {
+		return time.Date(2025, 3, 1, 12, 30, 5, 250*int(time.Millisecond), time.UTC)
+	}
+
+	_, err := w.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "12:30:05.250 [test] hello\n", buf.String())
+}
+
+func TestPrefixWriterLongLine(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPrefixWriter(&buf, "")
+
+	_, err := w.Write(bytes.Repeat([]byte("x"), maxLineLength))
+	assert.NoError(t, err)
+	assert.Equal(t, maxLineLength+1, buf.Len(), "long partial lines should be written out")
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := newTailBuffer(16)
+
+	_, err := tail.Write([]byte("short\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "short\n", tail.String())
+
+	_, err = tail.Write([]byte("first line\nsecond line\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "second line\n", tail.String(), "output should start at a line boundary once truncated")
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rewrite maps images under a registry or repository prefix to a mirror
+type Rewrite struct {
+	From string `yaml:"from"` // Prefix to replace, e.g. public.ecr.aws/docker/library/*
+	To   string `yaml:"to"`   // Replacement prefix, e.g. mirror.example.com/library
+}
+
+// ParseRewrite parses a rewrite rule in from=to format
+func ParseRewrite(rule string) (Rewrite, error) {
+	from, to, ok := strings.Cut(rule, "=")
+	r := Rewrite{From: strings.TrimSpace(from), To: strings.TrimSpace(to)}
+	if !ok {
+		return Rewrite{}, fmt.Errorf("invalid registry rewrite %q, must be from=to", rule)
+	}
+	if err := r.Validate(); err != nil {
+		return Rewrite{}, err
+	}
+	return r, nil
+}
+
+// Validate checks that both sides of the rule are set
+func (r Rewrite) Validate() error {
+	if trimPrefix(r.From) == "" || trimPrefix(r.To) == "" {
+		return fmt.Errorf("invalid registry rewrite %s=%s, from and to must be set", r.From, r.To)
+	}
+	return nil
+}
+
+// apply rewrites the image if it lies under the rule's prefix. The prefix
+// only matches whole path components, so library/go doesn't match
+// library/golang.
+func (r Rewrite) apply(image string) (string, bool) {
+	from := trimPrefix(r.From)
+	if !strings.HasPrefix(image, from) {
+		return image, false
+	}
+	rest := image[len(from):]
+	if rest != "" && !strings.ContainsRune("/:@", rune(rest[0])) {
+		return image, false
+	}
+	return trimPrefix(r.To) + rest, true
+}
+
+// trimPrefix removes the optional trailing /* of a rewrite prefix
+func trimPrefix(prefix string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(prefix, "*"), "/")
+}
+
+// RewriteImage applies the first matching rule to a resolved image
+func RewriteImage(image string, rules []Rewrite) string {
+	for _, rule := range rules {
+		if rewritten, ok := rule.apply(image); ok {
+			return rewritten
+		}
+	}
+	return image
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRewrite(t *testing.T) {
+	tests := map[string]struct {
+		rule    string
+		want    Rewrite
+		wantErr string
+	}{
+		"prefix": {
+			rule: "public.ecr.aws/docker/library/*=mirror.example.com/library",
+			want: Rewrite{From: "public.ecr.aws/docker/library/*", To: "mirror.example.com/library"},
+		},
+		"spaces": {
+			rule: " public.ecr.aws = mirror.example.com ",
+			want: Rewrite{From: "public.ecr.aws", To: "mirror.example.com"},
+		},
+		"missing separator": {
+			rule:    "public.ecr.aws",
+			wantErr: "must be from=to",
+		},
+		"empty target": {
+			rule:    "public.ecr.aws=",
+			wantErr: "from and to must be set",
+		},
+		"only wildcard": {
+			rule:    "*=mirror.example.com",
+			wantErr: "from and to must be set",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseRewrite(tc.rule)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	rules := []Rewrite{
+		{From: "public.ecr.aws/docker/library/golang", To: "golang.example.com/golang"},
+		{From: "public.ecr.aws/docker/library/*", To: "mirror.example.com/library/"},
+		{From: "docker.io", To: "mirror.example.com/hub"},
+	}
+
+	tests := map[string]struct {
+		image string
+		want  string
+	}{
+		"wildcard prefix": {
+			image: "public.ecr.aws/docker/library/alpine:latest",
+			want:  "mirror.example.com/library/alpine:latest",
+		},
+		"first match wins": {
+			image: "public.ecr.aws/docker/library/golang:1.24",
+			want:  "golang.example.com/golang:1.24",
+		},
+		"partial component": {
+			image: "public.ecr.aws/docker/library/golangci-lint:v1",
+			want:  "mirror.example.com/library/golangci-lint:v1",
+		},
+		"registry prefix": {
+			image: "docker.io/bitnami/redis:7",
+			want:  "mirror.example.com/hub/bitnami/redis:7",
+		},
+		"pinned digest": {
+			image: "public.ecr.aws/docker/library/alpine:3@sha256:abc",
+			want:  "mirror.example.com/library/alpine:3@sha256:abc",
+		},
+		"no match": {
+			image: "ghcr.io/org/tool:1",
+			want:  "ghcr.io/org/tool:1",
+		},
+		"registry name prefix": {
+			image: "docker.iox/tool:1",
+			want:  "docker.iox/tool:1",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, RewriteImage(tc.image, rules))
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Audit log reasons of stages killed under a memory limit
+const (
+	ReasonOOMKilled   = "oom_killed"   // The runtime reported the container was OOM killed
+	ReasonProbableOOM = "probable_oom" // Killed with SIGKILL, but the runtime couldn't tell why
+)
+
+// oomExitCode is the exit status of a container killed with SIGKILL
+const oomExitCode = 137
+
+// sizePattern matches sizes like 1024, 512m or 2g
+var sizePattern = regexp.MustCompile(`^([0-9]+)([bkmgBKMG]?)$`)
+
+// Resources limits the resources of a stage's container, empty fields are unlimited
+type Resources struct {
+	CPUs    string `yaml:"cpus,omitempty"`     // Number of CPUs, e.g. 1.5
+	Memory  string `yaml:"memory,omitempty"`   // Memory limit, e.g. 512m or 2g
+	Pids    int64  `yaml:"pids,omitempty"`     // Maximum number of processes
+	ShmSize string `yaml:"shm_size,omitempty"` // Size of /dev/shm, e.g. 256m
+}
+
+// ResourceUsage is what a container used while it ran, sampled from the
+// runtime's stats
+type ResourceUsage struct {
+	CPUSeconds float64 `json:"cpu_seconds"` // CPU time of all processes
+	PeakMemory int64   `json:"peak_memory"` // Highest memory usage in bytes
+}
+
+// IsZero reports whether no limit is set
+func (r Resources) IsZero() bool {
+	return r == Resources{}
+}
+
+// WithDefaults fills the limits the stage doesn't set from the project's defaults
+func (r Resources) WithDefaults(defaults Resources) Resources {
+	if r.CPUs == "" {
+		r.CPUs = defaults.CPUs
+	}
+	if r.Memory == "" {
+		r.Memory = defaults.Memory
+	}
+	if r.Pids == 0 {
+		r.Pids = defaults.Pids
+	}
+	if r.ShmSize == "" {
+		r.ShmSize = defaults.ShmSize
+	}
+	return r
+}
+
+// Validate checks the format of the limits
+func (r Resources) Validate() error {
+	if _, err := r.nanoCPUs(); err != nil {
+		return err
+	}
+	if _, err := parseSize(r.Memory); err != nil {
+		return fmt.Errorf("invalid memory: %w", err)
+	}
+	if _, err := parseSize(r.ShmSize); err != nil {
+		return fmt.Errorf("invalid shm_size: %w", err)
+	}
+	if r.Pids < 0 {
+		return fmt.Errorf("invalid pids %d, must be positive", r.Pids)
+	}
+	return nil
+}
+
+// nanoCPUs returns the CPU limit in billionths of a CPU
+func (r Resources) nanoCPUs() (int64, error) {
+	if r.CPUs == "" {
+		return 0, nil
+	}
+	cpus, err := strconv.ParseFloat(r.CPUs, 64)
+	if err != nil || cpus <= 0 {
+		return 0, fmt.Errorf("invalid cpus %q, must be a positive number", r.CPUs)
+	}
+	return int64(cpus * 1e9), nil
+}
+
+// cliArgs returns the flags of docker compatible clients
+func (r Resources) cliArgs() []string {
+	var args []string
+	if r.CPUs != "" {
+		args = append(args, "--cpus", r.CPUs)
+	}
+	if r.Memory != "" {
+		args = append(args, "--memory", r.Memory)
+	}
+	if r.Pids != 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(r.Pids, 10))
+	}
+	if r.ShmSize != "" {
+		args = append(args, "--shm-size", r.ShmSize)
+	}
+	return args
+}
+
+// parseSize converts a size with an optional b, k, m or g unit to bytes, an
+// empty size is zero
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	match := sizePattern.FindStringSubmatch(size)
+	if match == nil {
+		return 0, fmt.Errorf("%q is not a size like 512m or 2g", size)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q: %w", size, err)
+	}
+	switch strings.ToLower(match[2]) {
+	case "k":
+		n <<= 10
+	case "m":
+		n <<= 20
+	case "g":
+		n <<= 30
+	}
+	return n, nil
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		"empty":     {size: "", want: 0},
+		"bytes":     {size: "1024", want: 1024},
+		"bytes b":   {size: "512b", want: 512},
+		"kilobytes": {size: "64k", want: 64 << 10},
+		"megabytes": {size: "512m", want: 512 << 20},
+		"gigabytes": {size: "2G", want: 2 << 30},
+		"fraction":  {size: "1.5g", wantErr: true},
+		"unit only": {size: "m", wantErr: true},
+		"long unit": {size: "512mb", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseSize(tc.size)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestResourcesValidate(t *testing.T) {
+	tests := map[string]struct {
+		resources Resources
+		wantErr   string
+	}{
+		"none": {},
+		"all":  {resources: Resources{CPUs: "0.5", Memory: "512m", Pids: 100, ShmSize: "64m"}},
+		"invalid cpus": {
+			resources: Resources{CPUs: "two"},
+			wantErr:   `invalid cpus "two"`,
+		},
+		"zero cpus": {
+			resources: Resources{CPUs: "0"},
+			wantErr:   "must be a positive number",
+		},
+		"invalid memory": {
+			resources: Resources{Memory: "1 GB"},
+			wantErr:   "invalid memory",
+		},
+		"invalid shm size": {
+			resources: Resources{ShmSize: "big"},
+			wantErr:   "invalid shm_size",
+		},
+		"negative pids": {
+			resources: Resources{Pids: -1},
+			wantErr:   "invalid pids -1",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.resources.Validate()
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestResourcesWithDefaults(t *testing.T) {
+	defaults := Resources{CPUs: "2", Memory: "2g", Pids: 512}
+	stage := Resources{Memory: "4g", ShmSize: "1g"}
+
+	assert.Equal(t, Resources{CPUs: "2", Memory: "4g", Pids: 512, ShmSize: "1g"}, stage.WithDefaults(defaults))
+	assert.Equal(t, defaults, Resources{}.WithDefaults(defaults))
+	assert.True(t, Resources{}.WithDefaults(Resources{}).IsZero())
+}
+
+func TestExecuteStageOOM(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	tests := map[string]struct {
+		resources  Resources
+		inspect    string // State.OOMKilled reported by inspect, empty if inspect fails
+		wantErr    string
+		wantReason string
+		wantOutput string
+	}{
+		"oom killed": {
+			resources:  Resources{Memory: "512m"},
+			inspect:    "true",
+			wantErr:    "killed for exceeding the memory limit of 512m: exit status 137",
+			wantReason: ReasonOOMKilled,
+			wantOutput: "ran out of memory",
+		},
+		"killed otherwise": {
+			resources: Resources{Memory: "512m"},
+			inspect:   "false",
+			wantErr:   "exit status 137",
+		},
+		"inspect failed": {
+			resources:  Resources{Memory: "512m"},
+			wantErr:    "exit status 137",
+			wantReason: ReasonProbableOOM,
+			wantOutput: "possibly for exceeding the memory limit of 512m",
+		},
+		"without memory limit": {
+			resources: Resources{CPUs: "1"},
+			wantErr:   "exit status 137",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var removed bool
+			ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				switch args[1] {
+				case "run":
+					// The container is kept to be inspected
+					assert.Equal(t, tc.resources.Memory != "", !slices.Contains(args, "--rm"))
+					return DockerResult{Error: errors.New("exit status 137"), ExitCode: 137}
+				case "container":
+					if tc.inspect == "" {
+						return DockerResult{Error: errors.New("exit status 1"), ExitCode: 1}
+					}
+					return DockerResult{Stdout: tc.inspect + "\n"}
+				case "rm":
+					removed = true
+				}
+				return DockerResult{}
+			}
+
+			var errOut strings.Builder
+			store := &mockAuditStore{}
+			err := ExecuteStage(StageExecution{
+				Name:      "test",
+				Runner:    "golang:1.24",
+				Commands:  []string{"go test ./..."},
+				Resources: tc.resources,
+				Output:    io.Discard,
+				ErrOutput: &errOut,
+			}, store, "test-project")
+			assert.EqualError(t, err, tc.wantErr)
+
+			final := store.logs[len(store.logs)-1]
+			assert.Equal(t, "failed", final.Status)
+			assert.Equal(t, tc.wantReason, final.Reason)
+			assert.Contains(t, errOut.String(), tc.wantOutput)
+			assert.Equal(t, tc.resources.Memory != "", removed)
+		})
+	}
+
+	t.Run("invalid limits", func(t *testing.T) {
+		store := &mockAuditStore{}
+		err := ExecuteStage(StageExecution{Name: "test", Runner: "golang:1.24", Resources: Resources{Memory: "lots"}}, store, "test-project")
+		assert.ErrorContains(t, err, "stage test: resources: invalid memory")
+		assert.Empty(t, store.logs)
+	})
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"time"
+)
+
+// AuditSchemaVersion is the version of the audit log and run record format.
+// Logs written before it was introduced have no schema_version.
+const AuditSchemaVersion = 1
+
+// runsDir is the directory of run records below the audit log directory or prefix
+const runsDir = "runs"
+
+// ciEnvVars are the CI environment variables recorded with a run. Only
+// these are recorded, the environment may hold secrets.
+var ciEnvVars = []string{
+	"CI",
+	"GITHUB_ACTIONS", "GITHUB_REPOSITORY", "GITHUB_WORKFLOW", "GITHUB_RUN_ID", "GITHUB_RUN_ATTEMPT", "GITHUB_REF", "GITHUB_SHA", "GITHUB_ACTOR",
+	"GITLAB_CI", "CI_PROJECT_PATH", "CI_PIPELINE_ID", "CI_JOB_ID", "CI_JOB_URL", "CI_COMMIT_REF_NAME", "CI_COMMIT_SHA",
+	"BUILDKITE", "BUILDKITE_PIPELINE_SLUG", "BUILDKITE_BUILD_NUMBER", "BUILDKITE_BUILD_URL", "BUILDKITE_JOB_ID",
+	"CIRCLECI", "CIRCLE_PROJECT_REPONAME", "CIRCLE_BUILD_NUM", "CIRCLE_BUILD_URL",
+	"JENKINS_URL", "JOB_NAME", "BUILD_NUMBER", "BUILD_URL",
+}
+
+// Run records one invocation of gosonic. The audit logs of the stages it
+// ran reference it by its ID.
+type Run struct {
+	SchemaVersion int               `json:"schema_version"`
+	ID            string            `json:"id"`
+	Project       string            `json:"project"`
+	GitRevision   string            `json:"git_revision"`
+	Branch        string            `json:"branch,omitempty"`
+	Stages        []string          `json:"stages"`         // Stages requested on the command line
+	Args          []string          `json:"args"`           // Command line arguments
+	Vars          map[string]string `json:"vars,omitempty"` // Execution variables after resolution
+	Host          string            `json:"host"`           // Hostname of the machine gosonic ran on
+	User          string            `json:"user"`           // User gosonic ran as
+	Version       string            `json:"version"`        // gosonic version
+	CI            map[string]string `json:"ci,omitempty"`   // CI environment variables, see ciEnvVars
+	StartTime     time.Time         `json:"start_time"`
+	EndTime       *time.Time        `json:"end_time,omitempty"` // Unset while the run is in progress
+	Duration      float64           `json:"duration"`           // Seconds from start to end
+	Status        string            `json:"status"`
+	Error         string            `json:"error,omitempty"`
+}
+
+// NewRunID returns a random ID for a run
+func NewRunID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// NewRun starts the record of a run with the host, user and CI environment
+// of the calling process
+func NewRun(project string, stages, args []string, vars map[string]string, version string) Run {
+	host, _ := os.Hostname()
+	return Run{
+		ID:        NewRunID(),
+		Project:   project,
+		Stages:    stages,
+		Args:      args,
+		Vars:      vars,
+		Host:      host,
+		User:      currentUser(),
+		Version:   version,
+		CI:        CIEnvironment(),
+		StartTime: time.Now(),
+		Status:    StatusRunning,
+	}
+}
+
+// Finish records the end of the run with its final status
+func (r *Run) Finish(status string, err error) {
+	end := time.Now()
+	r.EndTime = &end
+	r.Duration = end.Sub(r.StartTime).Seconds()
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// key returns the run record's path relative to the audit log directory
+func (r Run) key() string {
+	return path.Join(runsDir, fmt.Sprintf("%s-%s-%s.json", r.Project, r.StartTime.Format("20060102-150405"), r.ID))
+}
+
+// CIEnvironment returns the CI environment variables that are set
+func CIEnvironment() map[string]string {
+	env := make(map[string]string)
+	for _, name := range ciEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return env
+}
+
+// currentUser returns the name of the calling user
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
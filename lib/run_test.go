@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRun(t *testing.T) {
+	t.Setenv("CI", "true")
+	t.Setenv("GITHUB_RUN_ID", "42")
+	t.Setenv("DEPLOY_TOKEN", "hunter2")
+
+	run := NewRun("test-project", []string{"build"}, []string{"run", "build"}, map[string]string{"env": "prod"}, "v1.2.3")
+
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{16}$`), run.ID)
+	assert.NotEqual(t, run.ID, NewRunID())
+	assert.Equal(t, StatusRunning, run.Status)
+	assert.Equal(t, "v1.2.3", run.Version)
+	assert.NotEmpty(t, run.User)
+	assert.Nil(t, run.EndTime)
+
+	// Only known CI variables are recorded
+	assert.Equal(t, "true", run.CI["CI"])
+	assert.Equal(t, "42", run.CI["GITHUB_RUN_ID"])
+	assert.NotContains(t, run.CI, "DEPLOY_TOKEN")
+
+	run.Finish(StatusFailed, assert.AnError)
+	assert.Equal(t, StatusFailed, run.Status)
+	assert.Equal(t, assert.AnError.Error(), run.Error)
+	require.NotNil(t, run.EndTime)
+	assert.GreaterOrEqual(t, run.Duration, 0.0)
+}
+
+func TestFileStoreRun(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+
+	run := Run{
+		ID:        "0123456789abcdef",
+		Project:   "test-project",
+		StartTime: time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC),
+		Status:    StatusRunning,
+	}
+	require.NoError(t, store.StoreRun(run))
+	run.Finish(StatusSuccess, nil)
+	require.NoError(t, store.StoreRun(run))
+
+	data, err := os.ReadFile(filepath.Join(store.Directory, "runs", "test-project-20250301-123000-0123456789abcdef.json"))
+	require.NoError(t, err)
+	var stored Run
+	require.NoError(t, json.Unmarshal(data, &stored))
+	assert.Equal(t, AuditSchemaVersion, stored.SchemaVersion)
+	assert.Equal(t, StatusSuccess, stored.Status)
+
+	// Run records aren't stage logs
+	logs, err := store.LoadLogs("test-project", "")
+	require.NoError(t, err)
+	assert.Empty(t, logs)
+}
+
+func TestS3StoreRun(t *testing.T) {
+	mockClient := new(MockS3Client)
+	store := NewS3Store(mockClient, "test-bucket", "logs")
+
+	run := Run{
+		ID:        "0123456789abcdef",
+		Project:   "test-project",
+		StartTime: time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC),
+	}
+	mockClient.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return aws.ToString(input.Key) == "logs/runs/test-project-20250301-123000-0123456789abcdef.json"
+	})).Return(&s3.PutObjectOutput{}, nil)
+
+	assert.NoError(t, store.StoreRun(run))
+	mockClient.AssertExpectations(t)
+}
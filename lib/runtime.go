@@ -0,0 +1,325 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Container runtimes
+const (
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+)
+
+// ContainerSpec describes a container independent of the runtime running it
+type ContainerSpec struct {
+	Name         string // Container name, needed to stop the container early
+	Image        string
+	Command      []string // Overrides the image's command if set
+	User         string   // uid[:gid] or name to run as, the image's user if empty
+	HostUser     bool     // User is the calling user, rootless runtimes map it into the container
+	Env          map[string]string
+	EnvFile      string // File of KEY=value lines added to the environment, keeps secrets off the command line
+	WorkDir      string
+	Mounts       []Mount
+	Network      string   // Network to join, empty for the runtime's default
+	NetworkAlias string   // Name the container is reachable by on Network
+	Ports        []string // Ports published on the host, e.g. "5432:5432"
+	Init         bool     // Run an init process that forwards signals and reaps zombies
+	Resources    Resources
+}
+
+// ImageInfo describes an image available to a runtime
+type ImageInfo struct {
+	ID          string   // Content addressable image ID, e.g. sha256:...
+	RepoDigests []string // Registry references by digest, e.g. alpine@sha256:...
+}
+
+// Digest returns the digest of image among the image's repository digests,
+// or an empty string if the image's repository has none, e.g. because it was
+// pulled from a mirror or tagged locally. References that are already pinned
+// return their own digest.
+func (i ImageInfo) Digest(image string) string {
+	ref := ParseImageRef(image)
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	repo := repository(ref)
+
+	for _, d := range i.RepoDigests {
+		name, digest, ok := strings.Cut(d, "@")
+		if ok && repository(ParseImageRef(name)) == repo {
+			return digest
+		}
+	}
+	return ""
+}
+
+// repository returns the repository of ref without tag or digest, with
+// Docker Hub images spelled out, as golang and docker.io/library/golang
+// are the same repository
+func repository(ref ImageRef) string {
+	ref.Tag, ref.Digest = "", ""
+	if ref.Domain == "" || ref.Domain == "index.docker.io" {
+		ref.Domain = "docker.io"
+	}
+	if ref.Domain == "docker.io" && ref.ContextPath == "" {
+		ref.ContextPath = "library"
+	}
+	return ref.String()
+}
+
+// Runtime runs containers. Implementations translate the specs into the
+// flags or API calls their engine expects.
+type Runtime interface {
+	// Name returns the name the runtime is selected by
+	Name() string
+	// CommandLine returns the equivalent command line of Run, for logs and audit records
+	CommandLine(spec ContainerSpec) []string
+	// Run runs a container until it exits and removes it. Output is streamed
+	// to stdout and stderr. When the context is done before the container
+	// exits, a named container is stopped.
+	Run(ctx context.Context, spec ContainerSpec, stdout, stderr io.Writer) DockerResult
+	// Start starts a named container in the background
+	Start(ctx context.Context, spec ContainerSpec) error
+	// Exec runs a command in a running container
+	Exec(ctx context.Context, container string, command []string) DockerResult
+	// Stop stops and removes a container along with its anonymous volumes
+	Stop(ctx context.Context, container string) error
+	// Pull pulls an image, printing progress to out
+	Pull(ctx context.Context, image string, out io.Writer) error
+	// Inspect returns information about a local image
+	Inspect(ctx context.Context, image string) (ImageInfo, error)
+	// Build builds an image and tags it, printing the build output to out
+	Build(ctx context.Context, build ImageBuild, tag string, out io.Writer) error
+	// CreateNetwork creates a network containers can join
+	CreateNetwork(ctx context.Context, name string) error
+	// RemoveNetwork removes a network
+	RemoveNetwork(ctx context.Context, name string) error
+}
+
+// NewRuntime returns the runtime with the given name, an empty name selects Docker
+func NewRuntime(name string) (Runtime, error) {
+	switch name {
+	case RuntimeDocker, "":
+		return Docker, nil
+	case RuntimePodman:
+		return Podman, nil
+	case RuntimeDockerAPI:
+		engine, err := NewEngineRuntime("")
+		if err != nil {
+			return nil, err
+		}
+		return engine, nil
+	default:
+		return nil, fmt.Errorf("unknown container runtime %q, must be %s, %s or %s", name, RuntimeDocker, RuntimePodman, RuntimeDockerAPI)
+	}
+}
+
+// Docker and Podman run containers through their command line clients.
+// Commands are executed with ExecDocker so tests can intercept them.
+var (
+	Docker Runtime = &cliRuntime{
+		name:     RuntimeDocker,
+		stopArgs: []string{"rm", "--force", "--volumes"},
+	}
+	Podman Runtime = &cliRuntime{
+		name: RuntimePodman,
+		// podman waits 10 seconds for the container to stop by default
+		stopArgs: []string{"rm", "--force", "--volumes", "--time", "0"},
+		// Rootless podman maps the calling user to root, keep-id maps it to itself
+		hostUserArgs: []string{"--userns", "keep-id"},
+	}
+)
+
+// cliRuntime is a runtime driven by a docker compatible command line client
+type cliRuntime struct {
+	name         string
+	stopArgs     []string // Arguments removing a running container without waiting
+	hostUserArgs []string // Arguments keeping the calling user's uid inside the container
+}
+
+// Name returns the name of the client binary
+func (r *cliRuntime) Name() string {
+	return r.name
+}
+
+// CommandLine returns the command Run executes
+func (r *cliRuntime) CommandLine(spec ContainerSpec) []string {
+	if keepContainer(spec) {
+		return append([]string{r.name}, r.runArgs(spec, "")...)
+	}
+	return append([]string{r.name}, r.runArgs(spec, "--rm")...)
+}
+
+// keepContainer reports whether Run keeps the container after it exits, to
+// ask whether it was OOM killed, and removes it itself
+func keepContainer(spec ContainerSpec) bool {
+	return spec.Name != "" && spec.Resources.Memory != ""
+}
+
+// runArgs builds the arguments of a run command, mode is --rm, --detach or
+// empty for containers that are kept
+func (r *cliRuntime) runArgs(spec ContainerSpec, mode string) []string {
+	args := []string{"run"}
+	if mode != "" {
+		args = append(args, mode)
+	}
+	if spec.Init {
+		args = append(args, "--init")
+	}
+	if spec.WorkDir != "" {
+		args = append(args, "--workdir", spec.WorkDir)
+	}
+	if spec.User != "" {
+		args = append(args, "--user", spec.User)
+	}
+	if spec.HostUser {
+		args = append(args, r.hostUserArgs...)
+	}
+	if spec.Name != "" {
+		args = append(args, "--name", spec.Name)
+	}
+	if spec.Network != "" {
+		args = append(args, "--network", spec.Network)
+	}
+	if spec.NetworkAlias != "" {
+		args = append(args, "--network-alias", spec.NetworkAlias)
+	}
+	for _, k := range sortedKeys(spec.Env) {
+		args = append(args, "-e", fmt.Sprintf("%s=%s", k, spec.Env[k]))
+	}
+	if spec.EnvFile != "" {
+		args = append(args, "--env-file", spec.EnvFile)
+	}
+	for _, m := range spec.Mounts {
+		args = append(args, m.cliArgs()...)
+	}
+	for _, port := range spec.Ports {
+		args = append(args, "--publish", port)
+	}
+	args = append(args, spec.Resources.cliArgs()...)
+	args = append(args, spec.Image)
+	return append(args, spec.Command...)
+}
+
+// Run runs the container in the foreground. Killing the client doesn't stop
+// the container, so it is removed if the context is done first. The client
+// doesn't report OOM kills, containers with a memory limit are kept until
+// their state was inspected for one.
+func (r *cliRuntime) Run(ctx context.Context, spec ContainerSpec, stdout, stderr io.Writer) DockerResult {
+	result := ExecDocker(ctx, r.CommandLine(spec), stdout, stderr)
+	if ctx.Err() == nil && result.ExitCode == oomExitCode && keepContainer(spec) {
+		oomKilled, err := r.oomKilled(spec.Name)
+		result.OOMKilled = oomKilled
+		result.ProbableOOM = err != nil
+	}
+	if spec.Name != "" && (ctx.Err() != nil || keepContainer(spec)) {
+		_ = r.Stop(context.Background(), spec.Name)
+	}
+	return result
+}
+
+// oomKilled reports whether the kernel killed the exited container for
+// exceeding its memory limit
+func (r *cliRuntime) oomKilled(container string) (bool, error) {
+	result := ExecDocker(context.Background(), []string{r.name, "container", "inspect", "--format", "{{.State.OOMKilled}}", container}, nil, nil)
+	if result.Error != nil {
+		return false, fmt.Errorf("inspecting %s: %w", container, result.Error)
+	}
+	return strconv.ParseBool(strings.TrimSpace(result.Stdout))
+}
+
+// Start runs the container detached
+func (r *cliRuntime) Start(ctx context.Context, spec ContainerSpec) error {
+	return r.exec(ctx, r.runArgs(spec, "--detach")...)
+}
+
+// Exec runs a command in a running container
+func (r *cliRuntime) Exec(ctx context.Context, container string, command []string) DockerResult {
+	return ExecDocker(ctx, append([]string{r.name, "exec", container}, command...), nil, nil)
+}
+
+// Stop force-removes the container
+func (r *cliRuntime) Stop(ctx context.Context, container string) error {
+	return r.exec(ctx, append(r.stopArgs[:len(r.stopArgs):len(r.stopArgs)], container)...)
+}
+
+// Pull pulls the image
+func (r *cliRuntime) Pull(ctx context.Context, image string, out io.Writer) error {
+	w := newSyncWriter(out)
+	result := ExecDocker(ctx, []string{r.name, "pull", image}, w, w)
+	if result.Error != nil {
+		return fmt.Errorf("pulling %s: %w", image, result.Error)
+	}
+	return nil
+}
+
+// Inspect reads the image's ID and digests from image inspect
+func (r *cliRuntime) Inspect(ctx context.Context, image string) (ImageInfo, error) {
+	result := ExecDocker(ctx, []string{r.name, "image", "inspect", image}, io.Discard, io.Discard)
+	if result.Error != nil {
+		return ImageInfo{}, fmt.Errorf("inspecting %s: %w: %s", image, result.Error, strings.TrimSpace(result.Stderr))
+	}
+
+	var images []struct {
+		ID          string `json:"Id"`
+		RepoDigests []string
+	}
+	if err := json.Unmarshal([]byte(result.Stdout), &images); err != nil {
+		return ImageInfo{}, fmt.Errorf("inspecting %s: %w", image, err)
+	}
+	if len(images) == 0 {
+		return ImageInfo{}, fmt.Errorf("inspecting %s: no such image", image)
+	}
+
+	info := ImageInfo{ID: images[0].ID, RepoDigests: images[0].RepoDigests}
+	// podman reports IDs without the algorithm
+	if info.ID != "" && !strings.Contains(info.ID, ":") {
+		info.ID = "sha256:" + info.ID
+	}
+	sort.Strings(info.RepoDigests)
+	return info, nil
+}
+
+// Build builds the image from its context directory
+func (r *cliRuntime) Build(ctx context.Context, build ImageBuild, tag string, out io.Writer) error {
+	args := []string{r.name, "build", "--tag", tag, "--file", filepath.Join(build.Context, build.dockerfile())}
+	for _, k := range sortedKeys(build.Args) {
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, build.Args[k]))
+	}
+	w := newSyncWriter(out)
+	result := ExecDocker(ctx, append(args, build.Context), w, w)
+	if result.Error != nil {
+		return fmt.Errorf("building %s: %w", tag, result.Error)
+	}
+	return nil
+}
+
+// CreateNetwork creates a bridge network
+func (r *cliRuntime) CreateNetwork(ctx context.Context, name string) error {
+	return r.exec(ctx, "network", "create", name)
+}
+
+// RemoveNetwork removes the network
+func (r *cliRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	return r.exec(ctx, "network", "rm", name)
+}
+
+// exec runs a client command, including its stderr in errors
+func (r *cliRuntime) exec(ctx context.Context, args ...string) error {
+	result := ExecDocker(ctx, append([]string{r.name}, args...), nil, nil)
+	if result.Error != nil {
+		if stderr := strings.TrimSpace(result.Stderr); stderr != "" {
+			return fmt.Errorf("%s %s: %w: %s", r.name, args[0], result.Error, stderr)
+		}
+		return fmt.Errorf("%s %s: %w", r.name, args[0], result.Error)
+	}
+	return nil
+}
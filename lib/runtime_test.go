@@ -0,0 +1,288 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRuntime(t *testing.T) {
+	for name, want := range map[string]Runtime{"": Docker, "docker": Docker, "podman": Podman} {
+		got, err := NewRuntime(name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := NewRuntime("containerd")
+	assert.ErrorContains(t, err, `unknown container runtime "containerd"`)
+}
+
+func TestCLIRuntimeCommands(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	spec := ContainerSpec{
+		Name:    "gosonic-test",
+		Image:   "alpine:latest",
+		Command: []string{"echo", "hello"},
+		Env:     map[string]string{"B": "2", "A": "1"},
+		WorkDir: "/workspace",
+		Mounts: []Mount{
+			{Type: VolumeBind, Source: "/src", Target: "/workspace"},
+			{Type: VolumeTmp, Target: "/tmp", Size: "64m"},
+		},
+		Network: "gosonic-net",
+		Init:    true,
+	}
+
+	tests := map[string]struct {
+		runtime  Runtime
+		call     func(r Runtime) error
+		wantArgs []string
+	}{
+		"docker run": {
+			runtime: Docker,
+			call: func(r Runtime) error {
+				return r.Run(context.Background(), spec, nil, nil).Error
+			},
+			wantArgs: []string{
+				"docker", "run", "--rm", "--init", "--workdir", "/workspace", "--name", "gosonic-test", "--network", "gosonic-net",
+				"-e", "A=1", "-e", "B=2", "-v", "/src:/workspace", "--tmpfs", "/tmp:size=64m", "alpine:latest", "echo", "hello",
+			},
+		},
+		"podman start": {
+			runtime: Podman,
+			call: func(r Runtime) error {
+				return r.Start(context.Background(), ContainerSpec{Name: "db", Image: "postgres:16", NetworkAlias: "db", Ports: []string{"5432"}})
+			},
+			wantArgs: []string{"podman", "run", "--detach", "--name", "db", "--network-alias", "db", "--publish", "5432", "postgres:16"},
+		},
+		"podman run as host user": {
+			runtime: Podman,
+			call: func(r Runtime) error {
+				return r.Run(context.Background(), ContainerSpec{Image: "golang:1.24", User: "1000:1000", HostUser: true}, nil, nil).Error
+			},
+			wantArgs: []string{"podman", "run", "--rm", "--user", "1000:1000", "--userns", "keep-id", "golang:1.24"},
+		},
+		"docker run as host user": {
+			runtime: Docker,
+			call: func(r Runtime) error {
+				return r.Run(context.Background(), ContainerSpec{Image: "golang:1.24", User: "1000:1000", HostUser: true}, nil, nil).Error
+			},
+			wantArgs: []string{"docker", "run", "--rm", "--user", "1000:1000", "golang:1.24"},
+		},
+		"docker run with resources": {
+			runtime: Docker,
+			call: func(r Runtime) error {
+				resources := Resources{CPUs: "2", Memory: "1g", Pids: 256, ShmSize: "256m"}
+				return r.Run(context.Background(), ContainerSpec{Image: "golang:1.24", Resources: resources}, nil, nil).Error
+			},
+			wantArgs: []string{"docker", "run", "--rm", "--cpus", "2", "--memory", "1g", "--pids-limit", "256", "--shm-size", "256m", "golang:1.24"},
+		},
+		"docker run with env file": {
+			runtime: Docker,
+			call: func(r Runtime) error {
+				return r.Run(context.Background(), ContainerSpec{Image: "alpine", Env: map[string]string{"CI": "true"}, EnvFile: "/tmp/secrets/env"}, nil, nil).Error
+			},
+			wantArgs: []string{"docker", "run", "--rm", "-e", "CI=true", "--env-file", "/tmp/secrets/env", "alpine"},
+		},
+		"docker stop": {
+			runtime:  Docker,
+			call:     func(r Runtime) error { return r.Stop(context.Background(), "gosonic-test") },
+			wantArgs: []string{"docker", "rm", "--force", "--volumes", "gosonic-test"},
+		},
+		"podman stop doesn't wait": {
+			runtime:  Podman,
+			call:     func(r Runtime) error { return r.Stop(context.Background(), "gosonic-test") },
+			wantArgs: []string{"podman", "rm", "--force", "--volumes", "--time", "0", "gosonic-test"},
+		},
+		"podman pull": {
+			runtime:  Podman,
+			call:     func(r Runtime) error { return r.Pull(context.Background(), "alpine:latest", io.Discard) },
+			wantArgs: []string{"podman", "pull", "alpine:latest"},
+		},
+		"docker build": {
+			runtime: Docker,
+			call: func(r Runtime) error {
+				build := ImageBuild{Context: "ci", Dockerfile: "Dockerfile.ci", Args: map[string]string{"GO": "1.24", "ARCH": "amd64"}}
+				return r.Build(context.Background(), build, "gosonic-test-runner:0123", io.Discard)
+			},
+			wantArgs: []string{
+				"docker", "build", "--tag", "gosonic-test-runner:0123", "--file", filepath.Join("ci", "Dockerfile.ci"),
+				"--build-arg", "ARCH=amd64", "--build-arg", "GO=1.24", "ci",
+			},
+		},
+		"docker network": {
+			runtime:  Docker,
+			call:     func(r Runtime) error { return r.CreateNetwork(context.Background(), "gosonic-net") },
+			wantArgs: []string{"docker", "network", "create", "gosonic-net"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				got = args
+				return DockerResult{}
+			}
+			assert.NoError(t, tc.call(tc.runtime))
+			assert.Equal(t, tc.wantArgs, got)
+		})
+	}
+}
+
+func TestCLIRuntimeOOMKilled(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	// Containers with a memory limit are kept until their state was inspected
+	var calls [][]string
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		calls = append(calls, args)
+		if args[1] == "run" {
+			return DockerResult{Error: errors.New("exit status 137"), ExitCode: 137}
+		}
+		return DockerResult{Stdout: "true\n"}
+	}
+	spec := ContainerSpec{Name: "gosonic-test", Image: "golang:1.24", Resources: Resources{Memory: "1g"}}
+	result := Podman.Run(context.Background(), spec, nil, nil)
+	assert.True(t, result.OOMKilled)
+	assert.False(t, result.ProbableOOM)
+	assert.Equal(t, [][]string{
+		{"podman", "run", "--name", "gosonic-test", "--memory", "1g", "golang:1.24"},
+		{"podman", "container", "inspect", "--format", "{{.State.OOMKilled}}", "gosonic-test"},
+		{"podman", "rm", "--force", "--volumes", "--time", "0", "gosonic-test"},
+	}, calls)
+}
+
+func TestCLIRuntimeErrors(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		return DockerResult{Error: errors.New("exit status 125"), Stderr: "Error: network already exists\n", ExitCode: 125}
+	}
+	err := Podman.CreateNetwork(context.Background(), "gosonic-net")
+	assert.EqualError(t, err, "podman network: exit status 125: Error: network already exists")
+}
+
+func TestCLIRuntimePullOutput(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	// Pull and build progress is written to both streams at once
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		script := "for i in $(seq 50); do echo out $i; echo err $i >&2; done"
+		return runCommand(exec.CommandContext(ctx, "sh", "-c", script), stdout, stderr)
+	}
+
+	var out strings.Builder
+	w := NewPrefixWriter(&out, "[build] ")
+	assert.NoError(t, Docker.Pull(context.Background(), "alpine:latest", w))
+	assert.NoError(t, Docker.Build(context.Background(), ImageBuild{Context: "."}, "gosonic/build", w))
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Len(t, lines, 200)
+	for _, line := range lines {
+		assert.Regexp(t, `^\[build\] (out|err) \d+$`, line)
+	}
+}
+
+func TestCLIRuntimeInspect(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	tests := map[string]struct {
+		runtime Runtime
+		stdout  string
+		want    ImageInfo
+		wantErr string
+	}{
+		"docker": {
+			runtime: Docker,
+			stdout:  `[{"Id": "sha256:abc", "RepoDigests": ["alpine@sha256:def"], "Size": 7}]`,
+			want:    ImageInfo{ID: "sha256:abc", RepoDigests: []string{"alpine@sha256:def"}},
+		},
+		"podman": {
+			runtime: Podman,
+			stdout:  `[{"Id": "abc", "Digest": "sha256:def", "RepoDigests": ["docker.io/library/alpine@sha256:def"]}]`,
+			want:    ImageInfo{ID: "sha256:abc", RepoDigests: []string{"docker.io/library/alpine@sha256:def"}},
+		},
+		"no image": {
+			runtime: Docker,
+			stdout:  `[]`,
+			wantErr: "no such image",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				assert.Equal(t, []string{tc.runtime.Name(), "image", "inspect", "alpine:latest"}, args)
+				return DockerResult{Stdout: tc.stdout}
+			}
+			got, err := tc.runtime.Inspect(context.Background(), "alpine:latest")
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestExecuteStagePodman(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	var binaries []string
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		binaries = append(binaries, args[0])
+		return DockerResult{}
+	}
+
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:     "test",
+		Runner:   "alpine:latest",
+		Commands: []string{"echo hello"},
+		Runtime:  Podman,
+		Output:   io.Discard,
+	}, store, "test-project")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"podman", "podman"}, binaries) // run, then image inspect
+	assert.Equal(t, "podman", store.logs[len(store.logs)-1].Runtime)
+}
+
+func TestImageInfoDigest(t *testing.T) {
+	info := ImageInfo{RepoDigests: []string{
+		"public.ecr.aws/docker/library/golang@sha256:aaa",
+		"registry.internal/golang@sha256:bbb",
+	}}
+
+	assert.Equal(t, "sha256:aaa", info.Digest("public.ecr.aws/docker/library/golang:1.23"))
+	assert.Equal(t, "sha256:bbb", info.Digest("registry.internal/golang:1.23"))
+	assert.Equal(t, "", info.Digest("docker.io/library/golang:1.23"))
+	assert.Equal(t, "sha256:ccc", info.Digest("golang:1.23@sha256:ccc"))
+
+	// Docker Hub images are listed by their short name
+	hub := ImageInfo{RepoDigests: []string{"golang@sha256:ddd"}}
+	assert.Equal(t, "sha256:ddd", hub.Digest("docker.io/library/golang:1.23"))
+	assert.Equal(t, "sha256:ddd", hub.Digest("golang:1.23"))
+	assert.Equal(t, "", hub.Digest("docker.io/someone/golang:1.23"))
+	assert.Equal(t, "sha256:eee", ImageInfo{RepoDigests: []string{"docker.io/library/golang@sha256:eee"}}.Digest("golang"))
+
+	// Images pulled from a mirror or tagged locally have no digest of the
+	// referenced repository
+	mirrored := ImageInfo{RepoDigests: []string{"mirror.internal/golang@sha256:fff"}}
+	assert.Equal(t, "", mirrored.Digest("golang:1.23"))
+	assert.Equal(t, "", mirrored.Digest("registry.internal/golang:1.23"))
+}
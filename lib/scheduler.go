@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Graph represents stages and the stages they require as a directed acyclic graph
+type Graph struct {
+	order []string            // Nodes in topological order
+	deps  map[string][]string // Node -> nodes that must succeed first
+}
+
+// NewGraph creates a graph from the given nodes and their requirements.
+// Requirements on nodes outside the graph are ignored, so callers can pass
+// a stage's full requires list. Nodes are ordered topologically, keeping the
+// given order wherever the requirements allow it.
+func NewGraph(nodes []string, requires map[string][]string) (*Graph, error) {
+	inGraph := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		inGraph[node] = true
+	}
+
+	graph := &Graph{deps: make(map[string][]string, len(nodes))}
+	for _, node := range nodes {
+		for _, req := range requires[node] {
+			if inGraph[req] {
+				graph.deps[node] = append(graph.deps[node], req)
+			}
+		}
+	}
+
+	// Depth-first search in the given order, detecting cycles on the way
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(nodes))
+	var path []string
+	var visit func(node string) error
+	visit = func(node string) error {
+		switch state[node] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path, " -> "), node)
+		}
+
+		state[node] = visiting
+		path = append(path, node)
+		for _, dep := range graph.deps[node] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[node] = visited
+		graph.order = append(graph.order, node)
+		return nil
+	}
+
+	for _, node := range nodes {
+		if err := visit(node); err != nil {
+			return nil, err
+		}
+	}
+
+	return graph, nil
+}
+
+// Order returns the nodes in topological order
+func (g *Graph) Order() []string {
+	return append([]string{}, g.order...)
+}
+
+// Run executes fn for every node. Nodes whose requirements have all succeeded
+// run concurrently, at most parallel at a time. Nodes that require a failed
+// node are skipped. The returned error joins all failures and skips.
+func (g *Graph) Run(parallel int, fn func(node string) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	const (
+		pending = iota
+		running
+		succeeded
+		failed
+		skipped
+	)
+
+	type result struct {
+		node string
+		err  error
+	}
+
+	state := make(map[string]int, len(g.order))
+	results := make(chan result)
+	inFlight := 0
+	var errs []error
+
+	for {
+		// Start every node that is ready, in topological order
+		for _, node := range g.order {
+			if state[node] != pending {
+				continue
+			}
+
+			ready := true
+			for _, dep := range g.deps[node] {
+				switch state[dep] {
+				case failed, skipped:
+					// Dependencies come first in the order, so skips propagate in one pass
+					state[node] = skipped
+					errs = append(errs, fmt.Errorf("stage %q skipped: required stage %q did not succeed", node, dep))
+				case succeeded:
+					continue
+				}
+				ready = false
+				break
+			}
+
+			if !ready || inFlight >= parallel {
+				continue
+			}
+
+			state[node] = running
+			inFlight++
+			go func(node string) {
+				results <- result{node: node, err: fn(node)}
+			}(node)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		// Wait for a node to finish
+		res := <-results
+		inFlight--
+		if res.err != nil {
+			state[res.node] = failed
+			errs = append(errs, fmt.Errorf("stage %q failed: %w", res.node, res.err))
+		} else {
+			state[res.node] = succeeded
+		}
+	}
+
+	return errors.Join(errs...)
+}
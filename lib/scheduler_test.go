@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGraph(t *testing.T) {
+	tests := map[string]struct {
+		nodes     []string
+		requires  map[string][]string
+		wantOrder []string
+		wantErr   bool
+	}{
+		"keeps given order without requirements": {
+			nodes:     []string{"lint", "unit-test", "build"},
+			wantOrder: []string{"lint", "unit-test", "build"},
+		},
+		"requirements come first": {
+			nodes: []string{"deploy", "build", "test"},
+			requires: map[string][]string{
+				"deploy": {"build", "test"},
+				"build":  {"test"},
+			},
+			wantOrder: []string{"test", "build", "deploy"},
+		},
+		"requirements outside the graph are ignored": {
+			nodes: []string{"deploy"},
+			requires: map[string][]string{
+				"deploy": {"build"},
+			},
+			wantOrder: []string{"deploy"},
+		},
+		"cycle": {
+			nodes: []string{"a", "b"},
+			requires: map[string][]string{
+				"a": {"b"},
+				"b": {"a"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			graph, err := NewGraph(tc.nodes, tc.requires)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantOrder, graph.Order())
+		})
+	}
+}
+
+func TestGraphRun(t *testing.T) {
+	t.Run("runs requirements before dependents", func(t *testing.T) {
+		graph, err := NewGraph([]string{"deploy", "build", "test"}, map[string][]string{
+			"deploy": {"build"},
+			"build":  {"test"},
+		})
+		assert.NoError(t, err)
+
+		var mu sync.Mutex
+		var ran []string
+		err = graph.Run(4, func(node string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, node)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"test", "build", "deploy"}, ran)
+	})
+
+	t.Run("runs independent nodes concurrently", func(t *testing.T) {
+		graph, err := NewGraph([]string{"a", "b", "c", "d"}, nil)
+		assert.NoError(t, err)
+
+		var mu sync.Mutex
+		current, peak := 0, 0
+		err = graph.Run(2, func(node string) error {
+			mu.Lock()
+			current++
+			if current > peak {
+				peak = current
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			current--
+			mu.Unlock()
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, peak)
+	})
+
+	t.Run("skips dependents of failed nodes", func(t *testing.T) {
+		graph, err := NewGraph([]string{"test", "lint", "build", "deploy"}, map[string][]string{
+			"build":  {"test"},
+			"deploy": {"build"},
+		})
+		assert.NoError(t, err)
+
+		var mu sync.Mutex
+		var ran []string
+		err = graph.Run(1, func(node string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, node)
+			if node == "test" {
+				return fmt.Errorf("tests failed")
+			}
+			return nil
+		})
+		assert.Error(t, err)
+		assert.Equal(t, []string{"test", "lint"}, ran)
+		assert.Contains(t, err.Error(), `stage "test" failed: tests failed`)
+		assert.Contains(t, err.Error(), `stage "build" skipped`)
+		assert.Contains(t, err.Error(), `stage "deploy" skipped`)
+	})
+}
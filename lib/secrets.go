@@ -0,0 +1,335 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// secretMask replaces secret values in output and audit logs
+const secretMask = "***"
+
+// minSecretLength is the shortest secret value that is masked. Shorter
+// values like "on" would mask every occurrence of common words and show
+// where the value appears.
+const minSecretLength = 4
+
+// secretsKeySize is the size of the AES-256 key encrypting secrets files
+const secretsKeySize = 32
+
+// envNamePattern matches names usable as environment variables
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Secret is a value passed to a stage without appearing on its command line,
+// in its output or in its audit logs
+type Secret struct {
+	Name   string // Environment variable set to the value
+	Value  string
+	Target string // Mount the value as a read-only file at this path instead
+	Source string // Where the value is read from, e.g. env:NPM_TOKEN, part of the cache key
+}
+
+// Validate checks the secret can be injected
+func (s Secret) Validate() error {
+	if s.Target != "" {
+		if !path.IsAbs(s.Target) {
+			return fmt.Errorf("secret %s: target %s must be an absolute path", s.Name, s.Target)
+		}
+		return s.validateLength()
+	}
+	if !envNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("secret %q: name must be a valid environment variable name", s.Name)
+	}
+	// docker's env files hold one variable per line
+	if strings.ContainsAny(s.Value, "\r\n") {
+		return fmt.Errorf("secret %s: multi-line values must be mounted as a file with target", s.Name)
+	}
+	return s.validateLength()
+}
+
+// validateLength rejects values too short to be masked
+func (s Secret) validateLength() error {
+	if len(strings.TrimSpace(s.Value)) < minSecretLength {
+		return fmt.Errorf("secret %s: value must be at least %d characters long to be masked in the output", s.Name, minSecretLength)
+	}
+	return nil
+}
+
+// secretFiles holds the files a stage's secrets are passed to its container
+// in, in a directory only the calling user can read
+type secretFiles struct {
+	dir     string
+	envFile string  // KEY=value lines of the environment secrets
+	mounts  []Mount // Read-only bind mounts of the file secrets
+}
+
+// writeSecrets writes the secrets to files, no secrets need no files
+func writeSecrets(secrets []Secret) (*secretFiles, error) {
+	files := &secretFiles{}
+	if len(secrets) == 0 {
+		return files, nil
+	}
+
+	dir, err := os.MkdirTemp("", "gosonic-secrets-")
+	if err != nil {
+		return nil, fmt.Errorf("writing secrets: %w", err)
+	}
+	files.dir = dir
+
+	var env bytes.Buffer
+	for i, secret := range secrets {
+		if secret.Target == "" {
+			fmt.Fprintf(&env, "%s=%s\n", secret.Name, secret.Value)
+			continue
+		}
+		// The directory keeps the file private on the host, containers
+		// running as another user must still be able to read it
+		file := filepath.Join(dir, fmt.Sprintf("file-%d", i))
+		if err := os.WriteFile(file, []byte(secret.Value), 0644); err != nil {
+			files.remove()
+			return nil, fmt.Errorf("writing secret %s: %w", secret.Name, err)
+		}
+		files.mounts = append(files.mounts, Mount{Type: VolumeBind, Source: file, Target: secret.Target, Readonly: true})
+	}
+
+	if env.Len() > 0 {
+		files.envFile = filepath.Join(dir, "env")
+		if err := os.WriteFile(files.envFile, env.Bytes(), 0600); err != nil {
+			files.remove()
+			return nil, fmt.Errorf("writing secrets: %w", err)
+		}
+	}
+	return files, nil
+}
+
+// remove deletes the secret files
+func (f *secretFiles) remove() {
+	if f.dir != "" {
+		os.RemoveAll(f.dir)
+	}
+}
+
+// secretEnv returns env with the environment secrets added, for the shell
+// runner which passes the environment to the process directly
+func secretEnv(env map[string]string, secrets []Secret) map[string]string {
+	if len(secrets) == 0 {
+		return env
+	}
+	result := make(map[string]string, len(env)+len(secrets))
+	for k, v := range env {
+		result[k] = v
+	}
+	for _, secret := range secrets {
+		result[secret.Name] = secret.Value
+	}
+	return result
+}
+
+// readEnvFile reads the KEY=value lines of an env file
+func readEnvFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading env file: %w", err)
+	}
+	var env []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			env = append(env, line)
+		}
+	}
+	return env, nil
+}
+
+// masker replaces secret values in strings. A nil masker masks nothing.
+type masker struct {
+	replacer *strings.Replacer
+	values   []string // Masked values, longest first
+}
+
+// newMasker masks every line of the secrets' values, multi-line secrets
+// like keys are printed line by line. Lines shorter than minSecretLength,
+// e.g. the end of a wrapped key, aren't masked. Without secrets it returns
+// nil.
+func newMasker(secrets []Secret) *masker {
+	var values []string
+	for _, secret := range secrets {
+		for _, line := range strings.Split(secret.Value, "\n") {
+			if line = strings.TrimSpace(line); len(line) >= minSecretLength {
+				values = append(values, line)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	// Longer values first, so a secret containing another is masked whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	var pairs []string
+	for _, value := range values {
+		pairs = append(pairs, value, secretMask)
+	}
+	return &masker{replacer: strings.NewReplacer(pairs...), values: values}
+}
+
+// mask replaces the secret values in s
+func (m *masker) mask(s string) string {
+	if m == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
+
+// maskError masks the message of err, keeping it available to errors.Is
+func (m *masker) maskError(err error) error {
+	if m == nil || err == nil {
+		return err
+	}
+	return &maskedError{err: err, msg: m.mask(err.Error())}
+}
+
+// maskedError is an error whose message has its secrets masked
+type maskedError struct {
+	err error
+	msg string
+}
+
+func (e *maskedError) Error() string { return e.msg }
+func (e *maskedError) Unwrap() error { return e.err }
+
+// maskWriter masks secrets in the lines written to it. Partial lines are
+// buffered, so secrets split across writes are still masked.
+type maskWriter struct {
+	w      io.Writer
+	masker *masker
+	buf    []byte
+}
+
+// Write implements io.Writer
+func (m *maskWriter) Write(data []byte) (int, error) {
+	m.buf = append(m.buf, data...)
+	n := bytes.LastIndexByte(m.buf, '\n') + 1
+	if n == 0 {
+		if len(m.buf) < maxLineLength {
+			return len(data), nil
+		}
+		// Write most of an overlong line, keeping back what could be the
+		// start of a secret completed by the next write
+		n = m.masker.cut(m.buf)
+	}
+	if _, err := io.WriteString(m.w, m.masker.mask(string(m.buf[:n]))); err != nil {
+		return 0, err
+	}
+	m.buf = append(m.buf[:0], m.buf[n:]...)
+	return len(data), nil
+}
+
+// cut returns how much of buf can be masked on its own: all of it but the
+// last len(longest secret)-1 bytes, moved to the start of any secret that
+// would be split
+func (m *masker) cut(buf []byte) int {
+	n := len(buf) - (len(m.values[0]) - 1)
+	for moved := true; moved; {
+		moved = false
+		for _, value := range m.values {
+			start := max(n-len(value)+1, 0)
+			if i := bytes.Index(buf[start:], []byte(value)); i >= 0 && start+i < n {
+				n, moved = start+i, true
+			}
+		}
+	}
+	return n
+}
+
+// Flush writes any buffered partial line
+func (m *maskWriter) Flush() error {
+	if len(m.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(m.w, m.masker.mask(string(m.buf)))
+	m.buf = nil
+	return err
+}
+
+// maskingStore masks secrets in audit logs before storing them
+type maskingStore struct {
+	AuditStore
+	masker *masker
+}
+
+// Store implements AuditStore
+func (s maskingStore) Store(log AuditLog) error {
+	log.Command = s.masker.mask(log.Command)
+	log.Error = s.masker.mask(log.Error)
+	log.Output = s.masker.mask(log.Output)
+	return s.AuditStore.Store(log)
+}
+
+// GenerateSecretsKey returns a new random key for secrets files, base64 encoded
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, secretsKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("generating key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseSecretsKey decodes a base64 encoded secrets key
+func ParseSecretsKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != secretsKeySize {
+		return nil, fmt.Errorf("secrets key must be %d base64 encoded bytes", secretsKeySize)
+	}
+	return key, nil
+}
+
+// EncryptSecret encrypts a value with AES-256-GCM. The name is authenticated
+// with it, so encrypted values can't be swapped between names.
+func EncryptSecret(key []byte, name, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("encrypting secret %s: %w", name, err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret decrypts a value encrypted with EncryptSecret
+func DecryptSecret(key []byte, name, encrypted string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("decrypting secret %s: invalid encoding", name)
+	}
+	value, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("decrypting secret %s: wrong key or corrupted value", name)
+	}
+	return string(value), nil
+}
+
+// newGCM creates the AES-GCM cipher of a secrets key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secrets key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
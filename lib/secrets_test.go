@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretValidate(t *testing.T) {
+	tests := map[string]struct {
+		secret  Secret
+		wantErr string
+	}{
+		"env":        {secret: Secret{Name: "API_TOKEN", Value: "abcd"}},
+		"file":       {secret: Secret{Name: "key", Value: "line1\nline2", Target: "/run/secrets/key"}},
+		"bad name":   {secret: Secret{Name: "API-TOKEN", Value: "abcd"}, wantErr: "valid environment variable name"},
+		"multiline":  {secret: Secret{Name: "KEY", Value: "a\nb"}, wantErr: "must be mounted as a file"},
+		"relative":   {secret: Secret{Name: "KEY", Value: "abcd", Target: "secrets/key"}, wantErr: "must be an absolute path"},
+		"short":      {secret: Secret{Name: "DEBUG", Value: "on"}, wantErr: "at least 4 characters"},
+		"short file": {secret: Secret{Name: "key", Value: " 1\n", Target: "/run/secrets/key"}, wantErr: "at least 4 characters"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.secret.Validate()
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMasker(t *testing.T) {
+	m := newMasker([]Secret{
+		{Name: "SHORT", Value: "abcd"},
+		{Name: "LONG", Value: "abcdefgh"},
+		{Name: "KEY", Value: "-----BEGIN-----\nc2VjcmV0\nAB\n-----END-----\n", Target: "/key"},
+	})
+
+	assert.Equal(t, "token *** and ***", m.mask("token abcdefgh and abcd"))
+	// Lines too short to be masked are left alone, not every "AB" in the output
+	assert.Equal(t, "***\n***\nAB\n***", m.mask("-----BEGIN-----\nc2VjcmV0\nAB\n-----END-----"))
+
+	err := m.maskError(errors.Join(context.Canceled, errors.New("login abcd failed")))
+	assert.Equal(t, "context canceled\nlogin *** failed", err.Error())
+	assert.ErrorIs(t, err, context.Canceled)
+
+	var none *masker
+	assert.Nil(t, newMasker(nil))
+	assert.Nil(t, newMasker([]Secret{{Name: "KEY", Value: "a\nb", Target: "/key"}}))
+	assert.Equal(t, "abc", none.mask("abc"))
+	assert.NoError(t, none.maskError(nil))
+}
+
+func TestMaskWriter(t *testing.T) {
+	var out strings.Builder
+	w := &maskWriter{w: &out, masker: newMasker([]Secret{{Name: "TOKEN", Value: "hunter2"}})}
+
+	// The secret is split across writes
+	for _, chunk := range []string{"password: hun", "ter2\nnext ", "line hunter2"} {
+		_, err := w.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "password: ***\n", out.String())
+
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "password: ***\nnext line ***", out.String())
+}
+
+func TestMaskWriterLongLine(t *testing.T) {
+	for _, offset := range []int{1, 4, 7, 8} {
+		var out strings.Builder
+		w := &maskWriter{w: &out, masker: newMasker([]Secret{{Name: "TOKEN", Value: "hunter2"}, {Name: "PIN", Value: "2468"}})}
+
+		// The secrets straddle the length at which a line without a newline
+		// is written
+		line := strings.Repeat("x", maxLineLength-offset) + "hunter2 2468 " + strings.Repeat("y", maxLineLength)
+		for _, chunk := range []string{line[:maxLineLength], line[maxLineLength:]} {
+			_, err := w.Write([]byte(chunk))
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Flush())
+
+		assert.NotContains(t, out.String(), "hun", "offset %d", offset)
+		assert.NotContains(t, out.String(), "2468", "offset %d", offset)
+		assert.Equal(t, strings.Replace(strings.Replace(line, "hunter2", "***", 1), "2468", "***", 1), out.String(), "offset %d", offset)
+	}
+}
+
+func TestWriteSecrets(t *testing.T) {
+	files, err := writeSecrets([]Secret{
+		{Name: "TOKEN", Value: "abc"},
+		{Name: "OTHER", Value: "def"},
+		{Name: "key", Value: "line1\nline2\n", Target: "/run/secrets/key"},
+	})
+	require.NoError(t, err)
+
+	env, err := os.ReadFile(files.envFile)
+	require.NoError(t, err)
+	assert.Equal(t, "TOKEN=abc\nOTHER=def\n", string(env))
+
+	info, err := os.Stat(files.envFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(files.dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	require.Len(t, files.mounts, 1)
+	mount := files.mounts[0]
+	assert.Equal(t, "/run/secrets/key", mount.Target)
+	assert.True(t, mount.Readonly)
+	content, err := os.ReadFile(mount.Source)
+	require.NoError(t, err)
+	assert.Equal(t, "line1\nline2\n", string(content))
+
+	files.remove()
+	_, err = os.Stat(files.dir)
+	assert.True(t, os.IsNotExist(err))
+
+	none, err := writeSecrets(nil)
+	require.NoError(t, err)
+	assert.Empty(t, none.dir)
+	assert.Empty(t, none.envFile)
+}
+
+func TestEncryptSecret(t *testing.T) {
+	encoded, err := GenerateSecretsKey()
+	require.NoError(t, err)
+	key, err := ParseSecretsKey(encoded)
+	require.NoError(t, err)
+
+	encrypted, err := EncryptSecret(key, "TOKEN", "hunter2")
+	require.NoError(t, err)
+	assert.NotContains(t, encrypted, "hunter2")
+
+	value, err := DecryptSecret(key, "TOKEN", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	// Values are bound to their name
+	_, err = DecryptSecret(key, "OTHER", encrypted)
+	assert.ErrorContains(t, err, "wrong key or corrupted value")
+
+	otherKey := make([]byte, secretsKeySize)
+	_, err = DecryptSecret(otherKey, "TOKEN", encrypted)
+	assert.ErrorContains(t, err, "wrong key or corrupted value")
+
+	_, err = ParseSecretsKey("c2hvcnQ=")
+	assert.ErrorContains(t, err, "must be 32 base64 encoded bytes")
+}
+
+func TestExecuteStageSecrets(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	var args []string
+	var envFile, keyFile string
+	ExecDocker = func(ctx context.Context, a []string, stdout, stderr io.Writer) DockerResult {
+		args = a
+		for i, arg := range a {
+			switch arg {
+			case "--env-file":
+				data, err := os.ReadFile(a[i+1])
+				require.NoError(t, err)
+				envFile = string(data)
+			case "-v":
+				if source, ok := strings.CutSuffix(a[i+1], ":/run/secrets/key:ro"); ok {
+					data, err := os.ReadFile(source)
+					require.NoError(t, err)
+					keyFile = string(data)
+				}
+			}
+		}
+		io.WriteString(stdout, "logged in with hunter2\n")
+		return DockerResult{
+			Output:   "logged in with hunter2\n",
+			Error:    errors.New("exit status 1: hunter2 rejected"),
+			ExitCode: 1,
+		}
+	}
+
+	var stdout, stderr strings.Builder
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:     "deploy",
+		Runner:   "alpine:latest",
+		Commands: []string{"deploy --token $TOKEN"},
+		Secrets: []Secret{
+			{Name: "TOKEN", Value: "hunter2"},
+			{Name: "key", Value: "private", Target: "/run/secrets/key"},
+		},
+		Output:    &stdout,
+		ErrOutput: &stderr,
+	}, store, "test-project")
+
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "hunter2")
+	assert.Contains(t, err.Error(), "*** rejected")
+
+	assert.Equal(t, "TOKEN=hunter2\n", envFile)
+	assert.Equal(t, "private", keyFile)
+	assert.NotContains(t, strings.Join(args, " "), "hunter2")
+	assert.Contains(t, stdout.String(), "logged in with ***\n")
+	assert.NotContains(t, stdout.String(), "hunter2")
+
+	require.NotEmpty(t, store.logs)
+	for _, log := range store.logs {
+		assert.NotContains(t, log.Output, "hunter2")
+		assert.NotContains(t, log.Error, "hunter2")
+	}
+
+	// The secret files are removed with the container
+	for i, arg := range args {
+		if arg == "--env-file" {
+			_, err := os.Stat(filepath.Dir(args[i+1]))
+			assert.True(t, os.IsNotExist(err))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Default readiness check timing
+const (
+	defaultReadinessInterval = time.Second
+	defaultReadinessTimeout  = time.Minute
+)
+
+// Service is a container started next to a stage, e.g. a database for
+// integration tests. The stage reaches it by its name.
+type Service struct {
+	Name        string
+	Image       string
+	Command     []string // Overrides the image's command if set
+	Environment map[string]string
+	Ports       []string   // Ports published on the host, e.g. "5432:5432"
+	Readiness   *Readiness // How to tell the service is ready, nil means once started
+}
+
+// Readiness defines a command run inside a service container until it succeeds
+type Readiness struct {
+	Command  string        // Run with sh -c inside the service container
+	Interval time.Duration // Delay between checks, defaults to 1s
+	Timeout  time.Duration // Time the service has to become ready, defaults to 1m
+}
+
+// serviceGroup tracks the network and containers started for a stage
+type serviceGroup struct {
+	runtime    Runtime
+	network    string
+	containers []string
+}
+
+// startServices creates a network for the stage and starts its services on
+// it, waiting until each of them is ready. The returned group must be torn
+// down even if an error is returned.
+func startServices(ctx context.Context, stage StageExecution, projectName string, out io.Writer) (*serviceGroup, error) {
+	runtime := stage.runtime()
+	group := &serviceGroup{runtime: runtime, network: containerName(projectName, stage.Name)}
+
+	fmt.Fprintf(out, "Creating network %s\n", group.network)
+	if err := runtime.CreateNetwork(ctx, group.network); err != nil {
+		group.network = ""
+		return group, fmt.Errorf("creating network: %w", err)
+	}
+
+	for _, svc := range stage.Services {
+		container := dockerName(group.network + "-" + svc.Name)
+		spec := ContainerSpec{
+			Name:         container,
+			Image:        svc.Image,
+			Command:      svc.Command,
+			Env:          svc.Environment,
+			Network:      group.network,
+			NetworkAlias: svc.Name,
+			Ports:        svc.Ports,
+		}
+
+		fmt.Fprintf(out, "Starting service %s (%s)\n", svc.Name, svc.Image)
+		if err := runtime.Start(ctx, spec); err != nil {
+			return group, fmt.Errorf("starting service %s: %w", svc.Name, err)
+		}
+		group.containers = append(group.containers, container)
+
+		if err := waitReady(ctx, runtime, svc, container); err != nil {
+			return group, fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+	}
+
+	return group, nil
+}
+
+// waitReady runs the service's readiness command until it succeeds
+func waitReady(ctx context.Context, runtime Runtime, svc Service, container string) error {
+	if svc.Readiness == nil {
+		return nil
+	}
+
+	interval := svc.Readiness.Interval
+	if interval <= 0 {
+		interval = defaultReadinessInterval
+	}
+	timeout := svc.Readiness.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		result := runtime.Exec(ctx, container, []string{"sh", "-c", svc.Readiness.Command})
+		if result.Error == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("not ready after %s: %s", timeout, strings.TrimSpace(result.Output))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// teardown removes the service containers and the network. It doesn't use
+// the stage's context so it still runs after the stage was cancelled.
+func (g *serviceGroup) teardown(out io.Writer) {
+	ctx := context.Background()
+	for _, container := range g.containers {
+		if err := g.runtime.Stop(ctx, container); err != nil {
+			fmt.Fprintf(out, "Error removing service container %s: %v\n", container, err)
+		}
+	}
+	if g.network != "" {
+		if err := g.runtime.RemoveNetwork(ctx, g.network); err != nil {
+			fmt.Fprintf(out, "Error removing network %s: %v\n", g.network, err)
+		}
+	}
+}
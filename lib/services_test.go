@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteStageServices(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	stage := StageExecution{
+		Name:     "integration",
+		Runner:   "golang:1.23",
+		Commands: []string{"go test -tags=integration ./..."},
+		Output:   io.Discard,
+		Services: []Service{{
+			Name:        "db",
+			Image:       "postgres:16",
+			Environment: map[string]string{"POSTGRES_PASSWORD": "secret"},
+			Ports:       []string{"5432:5432"},
+			Readiness:   &Readiness{Command: "pg_isready", Interval: time.Millisecond, Timeout: time.Second},
+		}},
+	}
+
+	tests := map[string]struct {
+		readyAfter int   // Failed readiness checks before the service is ready
+		stageErr   error // Error of the stage container
+		timeout    time.Duration
+		wantErr    string
+		wantCalls  []string
+	}{
+		"success": {
+			readyAfter: 2,
+			wantCalls: []string{
+				"network create", "run --detach", "exec", "exec", "exec", "run --rm", "image inspect", "rm --force", "network rm",
+			},
+		},
+		"stage fails": {
+			stageErr: errors.New("exit status 1"),
+			wantErr:  "exit status 1",
+			wantCalls: []string{
+				"network create", "run --detach", "exec", "run --rm", "image inspect", "rm --force", "network rm",
+			},
+		},
+		"never ready": {
+			readyAfter: 1000,
+			timeout:    20 * time.Millisecond,
+			wantErr:    "service db: not ready after 20ms",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var calls []string
+			var network, serviceContainer, stageNetwork string
+			checks := 0
+			ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+				call := strings.Join(args[1:3], " ")
+				if args[1] == "exec" {
+					call = "exec"
+				}
+				calls = append(calls, call)
+				switch {
+				case args[1] == "network" && args[2] == "create":
+					network = args[3]
+				case args[1] == "run" && args[2] == "--detach":
+					serviceContainer = args[4]
+					assert.Equal(t, []string{
+						"docker", "run", "--detach", "--name", network + "-db", "--network", network, "--network-alias", "db",
+						"-e", "POSTGRES_PASSWORD=secret", "--publish", "5432:5432", "postgres:16",
+					}, args)
+				case args[1] == "exec":
+					assert.Equal(t, []string{"docker", "exec", serviceContainer, "sh", "-c", "pg_isready"}, args)
+					checks++
+					if checks <= tc.readyAfter {
+						return DockerResult{Error: errors.New("exit status 2"), Output: "no response"}
+					}
+				case args[1] == "run":
+					for i, arg := range args {
+						if arg == "--network" {
+							stageNetwork = args[i+1]
+						}
+					}
+					return DockerResult{Error: tc.stageErr}
+				case args[1] == "rm":
+					assert.Equal(t, serviceContainer, args[len(args)-1])
+				}
+				return DockerResult{}
+			}
+
+			s := stage
+			if tc.timeout > 0 {
+				svc := s.Services[0]
+				readiness := *svc.Readiness
+				readiness.Timeout = tc.timeout
+				svc.Readiness = &readiness
+				s.Services = []Service{svc}
+			}
+
+			err := ExecuteStage(s, &mockAuditStore{}, "test-project")
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.True(t, strings.HasPrefix(network, "gosonic-test-project-integration-"))
+			if tc.wantCalls != nil {
+				assert.Equal(t, tc.wantCalls, calls)
+				assert.Equal(t, network, stageNetwork)
+			}
+			// Services are removed however the stage ends
+			assert.Equal(t, []string{"rm --force", "network rm"}, calls[len(calls)-2:])
+		})
+	}
+}
+
+func TestExecuteStageServicesCancelled(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var removed []string
+	ExecDocker = func(runCtx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		switch {
+		case args[1] == "rm":
+			removed = append(removed, args[len(args)-1])
+		case args[1] == "network" && args[2] == "rm":
+			removed = append(removed, args[3])
+		case args[1] == "run" && args[2] == "--rm":
+			// Simulate Ctrl-C while the stage is running
+			cancel()
+			<-runCtx.Done()
+			return DockerResult{Error: runCtx.Err(), ExitCode: -1}
+		}
+		return DockerResult{}
+	}
+
+	err := ExecuteStageContext(ctx, StageExecution{
+		Name:     "integration",
+		Runner:   "golang:1.23",
+		Commands: []string{"go test ./..."},
+		Output:   io.Discard,
+		Services: []Service{{Name: "db", Image: "postgres:16"}},
+	}, &mockAuditStore{}, "test-project")
+	assert.Error(t, err)
+
+	// The stage container, the service and the network are all removed
+	assert.Len(t, removed, 3)
+	for _, name := range removed {
+		assert.True(t, strings.HasPrefix(name, "gosonic-test-project-integration-"), name)
+	}
+}
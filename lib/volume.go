@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Volume types
+const (
+	VolumeBind  = "bind"
+	VolumeCache = "cache"
+	VolumeTmp   = "tmp"
+)
+
+// tmpfsSizePattern matches sizes like 512k, 64m or 1g
+var tmpfsSizePattern = regexp.MustCompile(`^[0-9]+[kmgKMG]?$`)
+
+// Volume represents a docker volume mount configuration
+type Volume struct {
+	Type     string `yaml:"type"`               // bind, cache, tmp
+	Source   string `yaml:"source"`             // host path or named volume
+	Target   string `yaml:"target"`             // container path
+	Readonly bool   `yaml:"readonly,omitempty"` // mount as readonly
+	Size     string `yaml:"size,omitempty"`     // tmpfs size limit, e.g. 64m
+	Lockfile string `yaml:"lockfile,omitempty"` // cache key file, the cache is replaced when it changes
+}
+
+// Mount is a volume resolved for a container runtime
+type Mount struct {
+	Type     string // bind, cache or tmp
+	Source   string // Absolute host path for bind mounts, volume name for caches
+	Target   string
+	Readonly bool
+	Size     string // tmpfs size limit
+}
+
+// mount resolves the volume. Relative bind sources and lockfiles are
+// resolved against the project root, bind sources must exist, cache volumes
+// are named volumes namespaced by project.
+func (v Volume) mount(projectName, root string) (Mount, error) {
+	if v.Target == "" {
+		return Mount{}, fmt.Errorf("volume %q: target must be specified", v.Source)
+	}
+
+	m := Mount{Type: v.Type, Target: v.Target, Readonly: v.Readonly}
+	switch v.Type {
+	case VolumeBind, "": // Bind mounts are the default
+		if v.Source == "" {
+			return Mount{}, fmt.Errorf("bind volume %s: source must be specified", v.Target)
+		}
+		source, err := filepath.Abs(projectPath(root, v.Source))
+		if err != nil {
+			return Mount{}, fmt.Errorf("bind volume %s: %w", v.Target, err)
+		}
+		if _, err := os.Stat(source); err != nil {
+			return Mount{}, fmt.Errorf("bind volume %s: source %s does not exist", v.Target, source)
+		}
+		m.Type = VolumeBind
+		m.Source = source
+
+	case VolumeCache:
+		name, err := v.cacheName(projectName, root)
+		if err != nil {
+			return Mount{}, err
+		}
+		m.Source = name
+
+	case VolumeTmp:
+		if v.Size != "" && !tmpfsSizePattern.MatchString(v.Size) {
+			return Mount{}, fmt.Errorf("tmp volume %s: invalid size %q", v.Target, v.Size)
+		}
+		m.Size = v.Size
+
+	default:
+		return Mount{}, fmt.Errorf("volume %s: unknown type %q, must be bind, cache or tmp", v.Target, v.Type)
+	}
+	return m, nil
+}
+
+// cliArgs returns the -v or --tmpfs arguments of docker compatible clients
+func (m Mount) cliArgs() []string {
+	var opts []string
+	if m.Readonly {
+		opts = append(opts, "ro")
+	}
+	if m.Type == VolumeTmp {
+		if m.Size != "" {
+			opts = append(opts, "size="+m.Size)
+		}
+		return []string{"--tmpfs", joinMount("", m.Target, opts)}
+	}
+	return []string{"-v", joinMount(m.Source, m.Target, opts)}
+}
+
+// cacheName returns the name of the docker volume backing a cache volume.
+// With a lockfile the name includes a hash of its content, so the cache
+// starts empty whenever the lockfile changes.
+func (v Volume) cacheName(projectName, root string) (string, error) {
+	if v.Source == "" {
+		return "", fmt.Errorf("cache volume %s: source must be specified", v.Target)
+	}
+
+	name := fmt.Sprintf("gosonic-%s-%s", projectName, v.Source)
+	if v.Lockfile != "" {
+		sum, err := hashFile(projectPath(root, v.Lockfile))
+		if err != nil {
+			return "", fmt.Errorf("cache volume %s: %w", v.Target, err)
+		}
+		name += "-" + sum[:12]
+	}
+	return dockerName(name), nil
+}
+
+// projectPath resolves a path relative to the project root
+func projectPath(root, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
+
+// joinMount joins the parts of a -v or --tmpfs argument
+func joinMount(source, target string, opts []string) string {
+	arg := target
+	if source != "" {
+		arg = source + ":" + target
+	}
+	if len(opts) > 0 {
+		arg += ":" + strings.Join(opts, ",")
+	}
+	return arg
+}
+
+// volumeMounts resolves all volumes of a stage
+func volumeMounts(volumes []Volume, projectName, root string) ([]Mount, error) {
+	var mounts []Mount
+	for _, vol := range volumes {
+		m, err := vol.mount(projectName, root)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeMount(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"go.sum": "example.com/mod v1.0.0 h1:abc=\n", "src/main.go": "package main"})
+	lockHash, err := hashFile(filepath.Join(dir, "go.sum"))
+	assert.NoError(t, err)
+
+	// Relative bind sources and lockfiles are resolved against the project
+	// root, not the working directory
+	absDir, err := filepath.Abs(dir)
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		volume  Volume
+		want    []string
+		wantErr string
+	}{
+		"bind relative": {
+			volume: Volume{Type: "bind", Source: "./src", Target: "/app/src", Readonly: true},
+			want:   []string{"-v", filepath.Join(absDir, "src") + ":/app/src:ro"},
+		},
+		"bind absolute": {
+			volume: Volume{Type: "bind", Source: dir, Target: "/workspace"},
+			want:   []string{"-v", dir + ":/workspace"},
+		},
+		"bind is the default": {
+			volume: Volume{Source: ".", Target: "/workspace"},
+			want:   []string{"-v", absDir + ":/workspace"},
+		},
+		"bind missing source": {
+			volume:  Volume{Type: "bind", Source: "./testdata", Target: "/testdata"},
+			wantErr: "does not exist",
+		},
+		"cache": {
+			volume: Volume{Type: "cache", Source: "go-cache", Target: "/root/.cache/go-build"},
+			want:   []string{"-v", "gosonic-test-project-go-cache:/root/.cache/go-build"},
+		},
+		"cache keyed by lockfile": {
+			volume: Volume{Type: "cache", Source: "go-mod", Target: "/go/pkg/mod", Lockfile: "go.sum"},
+			want:   []string{"-v", "gosonic-test-project-go-mod-" + lockHash[:12] + ":/go/pkg/mod"},
+		},
+		"cache sanitized name": {
+			volume: Volume{Type: "cache", Source: "npm/cache", Target: "/root/.npm"},
+			want:   []string{"-v", "gosonic-test-project-npm_cache:/root/.npm"},
+		},
+		"cache missing lockfile": {
+			volume:  Volume{Type: "cache", Source: "go-mod", Target: "/go/pkg/mod", Lockfile: "package-lock.json"},
+			wantErr: "package-lock.json",
+		},
+		"cache without name": {
+			volume:  Volume{Type: "cache", Target: "/go/pkg/mod"},
+			wantErr: "source must be specified",
+		},
+		"tmp": {
+			volume: Volume{Type: "tmp", Target: "/tmp"},
+			want:   []string{"--tmpfs", "/tmp"},
+		},
+		"tmp with size": {
+			volume: Volume{Type: "tmp", Target: "/tmp", Size: "64m"},
+			want:   []string{"--tmpfs", "/tmp:size=64m"},
+		},
+		"tmp invalid size": {
+			volume:  Volume{Type: "tmp", Target: "/tmp", Size: "lots"},
+			wantErr: `invalid size "lots"`,
+		},
+		"unknown type": {
+			volume:  Volume{Type: "nfs", Source: "server:/export", Target: "/data"},
+			wantErr: `unknown type "nfs"`,
+		},
+		"missing target": {
+			volume:  Volume{Type: "tmp"},
+			wantErr: "target must be specified",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.volume.mount("test-project", dir)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got.cliArgs())
+		})
+	}
+}
+
+func TestExecuteStageInvalidVolume(t *testing.T) {
+	originalExecDocker := ExecDocker
+	defer func() { ExecDocker = originalExecDocker }()
+
+	runs := 0
+	ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) DockerResult {
+		runs++
+		return DockerResult{}
+	}
+
+	store := &mockAuditStore{}
+	err := ExecuteStage(StageExecution{
+		Name:     "test",
+		Runner:   "alpine:latest",
+		Commands: []string{"ls /data"},
+		Volumes:  []Volume{{Type: "nfs", Source: "server:/export", Target: "/data"}},
+		Retry:    RetryPolicy{Attempts: 3},
+		Output:   io.Discard,
+	}, store, "test-project")
+
+	assert.ErrorContains(t, err, `unknown type "nfs"`)
+	assert.Equal(t, 0, runs)
+	assert.Empty(t, store.logs)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gosonic/lib"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// lockFileName is the lockfile written next to the sonic file
+const lockFileName = "sonic.lock"
+
+// lockHeader is written at the top of every lockfile
+const lockHeader = "# Generated by gosonic lock, pins runner and service images to digests\n"
+
+// Lock pins the images used by a project to digests
+type Lock struct {
+	Version int               `yaml:"version"`
+	Images  map[string]string `yaml:"images"` // Resolved image reference to digest
+}
+
+// lockPath returns the lockfile belonging to a sonic file
+func lockPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), lockFileName)
+}
+
+// loadLock reads a lockfile, a missing lockfile returns nil
+func loadLock(path string) (*Lock, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading lockfile: %w", err)
+	}
+
+	var lock Lock
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("parsing lockfile %s: %w", path, err)
+	}
+	if lock.Images == nil {
+		lock.Images = make(map[string]string)
+	}
+	return &lock, nil
+}
+
+// save writes the lockfile
+func (l *Lock) save(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString(lockHeader)
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(l); err != nil {
+		return fmt.Errorf("encoding lockfile: %w", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("writing lockfile: %w", err)
+	}
+	return nil
+}
+
+// projectImages returns the resolved runner and service images of all
+// stages, sorted and without duplicates
+func projectImages(config *Config, registry string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, name := range config.StageOrder {
+		stageExec, err := newStageExecution(name, config.Stages[name], registry)
+		if err != nil {
+			return nil, err
+		}
+		// Built runners are pinned by the hash of their build context
+		if stageExec.Runner != lib.ShellRunner && stageExec.Build == nil {
+			seen[stageExec.Runner] = true
+		}
+		for _, svc := range stageExec.Services {
+			seen[svc.Image] = true
+		}
+	}
+
+	images := make([]string, 0, len(seen))
+	for image := range seen {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// pinImage returns the image reference pinned to digest
+func pinImage(image, digest string) string {
+	ref := lib.ParseImageRef(image)
+	ref.Digest = digest
+	return ref.String()
+}
+
+// applyLock pins the runner and service images of a stage to the digests in
+// the lockfile. Images missing from the lockfile fail the stage with
+// --locked and are run unpinned with a warning otherwise.
+func applyLock(ctx *cli.Context, config *Config, stageExec *lib.StageExecution, out io.Writer) error {
+	locked := ctx.Bool("locked")
+	if config.Lock == nil {
+		if locked {
+			return fmt.Errorf("--locked requires a lockfile, run gosonic lock to create %s", lockFileName)
+		}
+		return nil
+	}
+
+	pin := func(image string) (string, string, error) {
+		digest, ok := config.Lock.Images[image]
+		if ok {
+			return pinImage(image, digest), digest, nil
+		}
+		if locked {
+			return "", "", fmt.Errorf("%s is stale, image %s of stage %q is not locked, run gosonic lock", lockFileName, image, stageExec.Name)
+		}
+		fmt.Fprintf(out, "Warning: %s is stale, image %s is not locked, run gosonic lock to update it\n", lockFileName, image)
+		return image, "", nil
+	}
+
+	if stageExec.Runner != lib.ShellRunner && stageExec.Build == nil {
+		runner, digest, err := pin(stageExec.Runner)
+		if err != nil {
+			return err
+		}
+		stageExec.Runner, stageExec.Digest = runner, digest
+	}
+
+	services := make([]lib.Service, len(stageExec.Services))
+	for i, svc := range stageExec.Services {
+		image, _, err := pin(svc.Image)
+		if err != nil {
+			return err
+		}
+		svc.Image = image
+		services[i] = svc
+	}
+	stageExec.Services = services
+	return nil
+}
+
+// lockCommand creates the lock command, which resolves all images to digests
+func lockCommand(config *Config) *cli.Command {
+	return &cli.Command{
+		Name:  "lock",
+		Usage: "Pin runner and service images to digests in " + lockFileName,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "check",
+				Usage: "Only check that the lockfile covers all images, without pulling",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			images, err := projectImages(config, projectRegistry(config, ctx))
+			if err != nil {
+				return err
+			}
+
+			if ctx.Bool("check") {
+				if config.Lock == nil {
+					return fmt.Errorf("%s not found, run gosonic lock", lockFileName)
+				}
+				var missing []string
+				for _, image := range images {
+					if _, ok := config.Lock.Images[image]; !ok {
+						missing = append(missing, image)
+					}
+				}
+				if len(missing) > 0 {
+					return fmt.Errorf("%s is stale, missing %v", lockFileName, missing)
+				}
+				fmt.Printf("%s is up to date\n", lockFileName)
+				return nil
+			}
+
+			runtime, err := selectRuntime(config, ctx)
+			if err != nil {
+				return err
+			}
+			rewrites, err := registryRewrites(config, ctx)
+			if err != nil {
+				return err
+			}
+
+			lock := &Lock{Version: 1, Images: make(map[string]string, len(images))}
+			for _, image := range images {
+				// Pull so the digest is the registry's current one, not a stale local copy.
+				// Mirrors serve the same digests, the lock keeps the original image.
+				pull := lib.RewriteImage(image, rewrites)
+				if err := runtime.Pull(ctx.Context, pull, io.Discard); err != nil {
+					return err
+				}
+				info, err := runtime.Inspect(ctx.Context, pull)
+				if err != nil {
+					return err
+				}
+				digest := info.Digest(pull)
+				if digest == "" {
+					return fmt.Errorf("image %s has no registry digest", image)
+				}
+				lock.Images[image] = digest
+				fmt.Printf("%s\t%s\n", image, digest)
+			}
+
+			if err := lock.save(config.LockPath); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %s\n", config.LockPath)
+			return nil
+		},
+	}
+}
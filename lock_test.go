@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gosonic/lib"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestLock(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "sonic.yml")
+	logsDir := filepath.Join(tmpDir, "logs")
+
+	writeConfig := func(extra string) {
+		configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+  allow_shell_runner: true
+stages:
+  test:
+    runner: "docker/library/golang:1.23"
+    commands:
+      - "go test ./..."
+    services:
+      - name: "db"
+        image: "docker/library/postgres:16"
+  clean:
+    runner: "shell"
+    commands:
+      - "true"
+` + extra)
+		assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+	}
+	writeConfig("")
+
+	golang := "public.ecr.aws/docker/library/golang:1.23"
+	postgres := "public.ecr.aws/docker/library/postgres:16"
+	digests := map[string]string{golang: "sha256:aaa", postgres: "sha256:bbb"}
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+	var pulled, ran []string
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		switch {
+		case args[1] == "pull":
+			pulled = append(pulled, args[2])
+		case args[1] == "image" && args[2] == "inspect":
+			image := args[3]
+			repo := image[:strings.LastIndex(image, ":")]
+			return lib.DockerResult{Stdout: fmt.Sprintf(`[{"Id": "sha256:local", "RepoDigests": [%q]}]`, repo+"@"+digests[image])}
+		case args[1] == "run":
+			ran = append(ran, strings.Join(args, " "))
+		}
+		return lib.DockerResult{}
+	}
+
+	stdout, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "lock"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, stdout, "Wrote "+filepath.Join(tmpDir, "sonic.lock"))
+	assert.Equal(t, []string{golang, postgres}, pulled)
+
+	content, err := os.ReadFile(filepath.Join(tmpDir, "sonic.lock"))
+	assert.NoError(t, err)
+	assert.Equal(t, lockHeader+`version: 1
+images:
+  public.ecr.aws/docker/library/golang:1.23: sha256:aaa
+  public.ecr.aws/docker/library/postgres:16: sha256:bbb
+`, string(content))
+
+	t.Run("check", func(t *testing.T) {
+		stdout, _, err := captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", configPath, "lock", "--check"})
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout, "sonic.lock is up to date")
+	})
+
+	t.Run("run uses locked digests", func(t *testing.T) {
+		ran = nil
+		_, _, err := captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", logsDir, "--locked", "test"})
+		})
+		assert.NoError(t, err)
+		assert.Len(t, ran, 2)
+		assert.Contains(t, ran[0], postgres+"@sha256:bbb")
+		assert.Contains(t, ran[1], golang+"@sha256:aaa")
+
+		logs, err := lib.NewFileStore(logsDir).LoadLogs("test-project", "")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, logs)
+		for _, log := range logs {
+			assert.Equal(t, golang+"@sha256:aaa", log.Image)
+			assert.Equal(t, "sha256:aaa", log.ImageDigest)
+		}
+	})
+
+	t.Run("stale lock", func(t *testing.T) {
+		writeConfig(`  lint:
+    runner: "docker/library/golangci-lint:v1.60"
+    commands:
+      - "golangci-lint run"
+`)
+		ran = nil
+		stdout, _, err := captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", logsDir, "lint"})
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout, "Warning: sonic.lock is stale, image public.ecr.aws/docker/library/golangci-lint:v1.60 is not locked")
+		assert.Len(t, ran, 1)
+
+		ran = nil
+		_, _, err = captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", logsDir, "--locked", "lint"})
+		})
+		assert.ErrorContains(t, err, `image public.ecr.aws/docker/library/golangci-lint:v1.60 of stage "lint" is not locked`)
+		assert.Empty(t, ran)
+
+		_, _, err = captureOutput(func() error {
+			return run([]string{"gosonic", "--sonic-file", configPath, "lock", "--check"})
+		})
+		assert.ErrorContains(t, err, "sonic.lock is stale")
+	})
+}
+
+func TestMalformedLock(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "sonic.yml")
+	assert.NoError(t, os.WriteFile(configPath, []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  build:
+    runner: "golang:1.23"
+    commands:
+      - "go build ./..."
+`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(tmpDir, "sonic.lock"), []byte("images: [unterminated\n"), 0644))
+
+	for _, args := range [][]string{{"run", "build"}, {"lock", "--check"}} {
+		_, stderr, err := captureOutput(func() error {
+			return run(append([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs")}, args...))
+		})
+		assert.ErrorContains(t, err, "parsing lockfile "+filepath.Join(tmpDir, "sonic.lock"), args)
+		assert.Contains(t, stderr, "Error: parsing lockfile", args)
+		assert.NotContains(t, stderr, "invalid stage(s)", args)
+	}
+
+	// Help still works
+	_, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "help"})
+	})
+	assert.NoError(t, err)
+}
+
+func TestApplyLockWithoutLockfile(t *testing.T) {
+	config := &Config{}
+	stageExec := lib.StageExecution{Name: "test", Runner: "alpine:latest"}
+
+	for _, locked := range []bool{true, false} {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.Bool("locked", locked, "")
+		ctx := cli.NewContext(cli.NewApp(), set, nil)
+
+		err := applyLock(ctx, config, &stageExec, io.Discard)
+		if locked {
+			assert.ErrorContains(t, err, "--locked requires a lockfile")
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, "alpine:latest", stageExec.Runner)
+		}
+	}
+}
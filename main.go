@@ -5,8 +5,14 @@ import (
 	"context"
 	"fmt"
 	"gosonic/lib"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v3"
@@ -14,9 +20,7 @@ import (
 
 // For testing purposes
 var (
-	createS3Client = func(ctx context.Context) (lib.S3Client, error) {
-		return nil, fmt.Errorf("S3 client creation not implemented")
-	}
+	createS3Client = defaultCreateS3Client
 )
 
 const (
@@ -63,7 +67,7 @@ func defaultCreateAuditStore(config *Config, flags *cli.Context) (lib.AuditStore
 		}
 
 		// Get S3 client
-		client, err := createS3Client(context.Background())
+		client, err := createS3Client(context.Background(), auditS3Settings(config, flags))
 		if err != nil {
 			return nil, fmt.Errorf("creating S3 client: %w", err)
 		}
@@ -76,9 +80,12 @@ func defaultCreateAuditStore(config *Config, flags *cli.Context) (lib.AuditStore
 
 // Variables that can be overridden in tests
 var (
-	createAuditStore = defaultCreateAuditStore
-	getGitRevision   = lib.GetGitRevision
-	execDocker       = lib.ExecDocker
+	createAuditStore    = defaultCreateAuditStore
+	createArtifactStore = defaultCreateArtifactStore
+	getGitRevision      = lib.GetGitRevision
+	getGitBranch        = lib.GetGitBranch
+	getChangedFiles     = lib.GetChangedFiles
+	execDocker          = lib.ExecDocker
 )
 
 type Config struct {
@@ -87,39 +94,143 @@ type Config struct {
 		Name     string `yaml:"name"`
 		Language string `yaml:"language"`
 		Root     string `yaml:"root"`
+		// Whether a skipped stage satisfies the requirements of other stages
+		AllowSkippedRequirements bool `yaml:"allow_skipped_requirements"`
+		// Whether stages may use the shell runner, which runs commands on the host
+		AllowShellRunner bool `yaml:"allow_shell_runner"`
+		// Container runtime running the stages, docker, podman or docker-api
+		Runtime string `yaml:"runtime"`
+		// Registry of images without one, overridden by --registry
+		Registry string `yaml:"registry"`
+		// Rules rewriting resolved images to mirrors, after those of --registry-rewrite
+		RegistryRewrites []lib.Rewrite `yaml:"registry_rewrites"`
+		// Whether containers run as the calling user, stages setting a user are exempt
+		RunAsHostUser bool `yaml:"run_as_host_user"`
+		// Default resource limits of container stages, stages override single limits
+		Resources lib.Resources `yaml:"resources"`
+		// Encrypted secrets file, sonic.secrets.yml next to the sonic file by default
+		SecretsFile string `yaml:"secrets_file"`
 	} `yaml:"project"`
 	Audit struct {
-		Store    string `yaml:"store"`    // "file" or "s3"
-		Path     string `yaml:"path"`     // Directory for file store or S3 prefix
-		S3Bucket string `yaml:"s3bucket"` // S3 bucket name if using S3
+		Store    string     `yaml:"store"`    // "file" or "s3"
+		Path     string     `yaml:"path"`     // Directory for file store or S3 prefix
+		S3Bucket string     `yaml:"s3bucket"` // S3 bucket name if using S3
+		S3       S3Settings `yaml:",inline"`  // Endpoint, region and credentials of the S3 store
 	} `yaml:"audit"`
-	Stages     map[string]Stage `yaml:"stages"`
-	StageOrder []string         `yaml:"-"` // Track stage order, not marshaled
+	Artifacts struct {
+		Store    string     `yaml:"store"`    // "file" or "s3"
+		Path     string     `yaml:"path"`     // Directory for file store or S3 prefix
+		S3Bucket string     `yaml:"s3bucket"` // S3 bucket name if using S3
+		S3       S3Settings `yaml:",inline"`  // Defaults to the audit store's settings
+	} `yaml:"artifacts"`
+	Stages      map[string]Stage `yaml:"stages"`
+	StageOrder  []string         `yaml:"-"` // Track stage order, not marshaled
+	Vars        execVars         `yaml:"-"` // Execution variables passed on the command line
+	Dir         string           `yaml:"-"` // Directory of the sonic file, the project's files are relative to it
+	LockPath    string           `yaml:"-"` // Lockfile next to the sonic file
+	SecretsPath string           `yaml:"-"` // Encrypted secrets file
+	Lock        *Lock            `yaml:"-"` // Pinned image digests, nil without a lockfile
+	Args        []string         `yaml:"-"` // Command line arguments, recorded with runs
+	Run         *lib.Run         `yaml:"-"` // Run the stages are executed in, nil outside of a run
 }
 
-type MatrixValue struct {
-	Name     string `yaml:"name"`
-	Priority int    `yaml:"priority"` // Lower numbers run first
+type Stage struct {
+	Runner         Runner            `yaml:"runner"`
+	Registry       string            `yaml:"registry,omitempty"` // Overrides the default registry for the stage's images
+	User           string            `yaml:"user,omitempty"`     // uid[:gid] or name the container runs as
+	Resources      lib.Resources     `yaml:"resources,omitempty"`
+	Secrets        []Secret          `yaml:"secrets,omitempty"` // Values kept out of the command line and the logs
+	Version        string            `yaml:"version,omitempty"`
+	Commands       []string          `yaml:"commands,omitempty"`
+	Requires       []string          `yaml:"requires,omitempty"`
+	Environment    map[string]string `yaml:"environment,omitempty"`
+	Volumes        []lib.Volume      `yaml:"volumes,omitempty"`
+	Artifacts      []string          `yaml:"artifacts,omitempty"`
+	Coverage       *Coverage         `yaml:"coverage,omitempty"`
+	Timeout        string            `yaml:"timeout,omitempty"`
+	CommandTimeout string            `yaml:"command_timeout,omitempty"` // Maximum execution time of each command
+	Matrix         *Matrix           `yaml:"matrix,omitempty"`
+	Retry          *Retry            `yaml:"retry,omitempty"`
+	When           *When             `yaml:"when,omitempty"`
+	Inputs         []string          `yaml:"inputs,omitempty"`  // Globs of the files the stage depends on
+	Outputs        []string          `yaml:"outputs,omitempty"` // Globs of the files the stage produces
+	Services       []Service         `yaml:"services,omitempty"`
+
+	NeedsArtifacts []ArtifactNeed `yaml:"needs_artifacts,omitempty"` // Artifacts of other stages to restore first
 }
 
-type Matrix struct {
-	Region []MatrixValue `yaml:"region,omitempty"`
-	// Can add more dimensions like environment, platform, etc.
+// Runner is the image a stage runs in, either an image reference or a block
+// building the image from a Dockerfile
+type Runner struct {
+	Image string       `yaml:"-"`
+	Build *RunnerBuild `yaml:"build"`
 }
 
-type Stage struct {
-	Runner      string            `yaml:"runner"`
-	Version     string            `yaml:"version,omitempty"`
-	Commands    []string          `yaml:"commands,omitempty"`
-	Requires    []string          `yaml:"requires,omitempty"`
+// RunnerBuild builds a runner image from a Dockerfile
+type RunnerBuild struct {
+	Context    string            `yaml:"context"`              // Build context directory
+	Dockerfile string            `yaml:"dockerfile,omitempty"` // Relative to the context, defaults to Dockerfile
+	Args       map[string]string `yaml:"args,omitempty"`       // Build arguments
+}
+
+// UnmarshalYAML allows runners to be written as image references
+// ("golang:1.24") as well as {build: ...} mappings
+func (r *Runner) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		r.Image = node.Value
+		return nil
+	}
+
+	type plain Runner
+	if err := node.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	if r.Build == nil {
+		return fmt.Errorf("line %d: runner must be an image or a build block", node.Line)
+	}
+	return nil
+}
+
+// String returns the image reference or describes the build
+func (r Runner) String() string {
+	if r.Build != nil {
+		return "image built from " + r.Build.Context
+	}
+	return r.Image
+}
+
+// Coverage defines the coverage a stage must reach
+type Coverage struct {
+	Enabled    bool    `yaml:"enabled"`
+	Threshold  float64 `yaml:"threshold"`             // Minimum total coverage in percent
+	Profile    string  `yaml:"profile,omitempty"`     // Coverage report, found automatically if empty
+	Format     string  `yaml:"format,omitempty"`      // go, cobertura or lcov, detected if empty
+	BaseBranch string  `yaml:"base_branch,omitempty"` // Branch to compare coverage against
+	MaxDrop    float64 `yaml:"max_drop,omitempty"`    // Percentage points coverage may drop compared to the base branch
+}
+
+// Retry defines how often a failed stage is retried
+type Retry struct {
+	Attempts    int    `yaml:"attempts"`                // Total number of attempts
+	Backoff     string `yaml:"backoff,omitempty"`       // Delay before the first retry, doubled for every further retry
+	OnExitCodes []int  `yaml:"on_exit_codes,omitempty"` // Only retry on these exit codes
+}
+
+// Service is a container started next to a stage and reachable by its name
+type Service struct {
+	Name        string            `yaml:"name"`
+	Image       string            `yaml:"image"`
+	Command     []string          `yaml:"command,omitempty"`
 	Environment map[string]string `yaml:"environment,omitempty"`
-	Volumes     []lib.Volume      `yaml:"volumes,omitempty"`
-	Artifacts   []string          `yaml:"artifacts,omitempty"`
-	Coverage    *struct {
-		Enabled   bool `yaml:"enabled"`
-		Threshold int  `yaml:"threshold"`
-	} `yaml:"coverage,omitempty"`
-	Timeout string `yaml:"timeout,omitempty"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	Readiness   *Readiness        `yaml:"readiness,omitempty"`
+}
+
+// Readiness defines how to tell a service is ready
+type Readiness struct {
+	Command  string `yaml:"command"`            // Run inside the service container until it succeeds
+	Interval string `yaml:"interval,omitempty"` // Delay between checks, defaults to 1s
+	Timeout  string `yaml:"timeout,omitempty"`  // Time the service has to become ready, defaults to 1m
 }
 
 // execVars holds variables passed during execution
@@ -157,6 +268,13 @@ func resolveStageVars(stage *Stage, vars execVars) {
 		stage.Volumes[i].Source = resolveVars(vol.Source, vars)
 		stage.Volumes[i].Target = resolveVars(vol.Target, vars)
 	}
+
+	// Resolve build arguments
+	if stage.Runner.Build != nil {
+		for k, v := range stage.Runner.Build.Args {
+			stage.Runner.Build.Args[k] = resolveVars(v, vars)
+		}
+	}
 }
 
 func loadConfig(path string, vars execVars) (*Config, error) {
@@ -171,9 +289,11 @@ func loadConfig(path string, vars execVars) (*Config, error) {
 
 	// First, decode into a temporary structure to capture order
 	var temp struct {
-		Version string                 `yaml:"version"`
-		Project map[string]interface{} `yaml:"project"`
-		Stages  yaml.Node              `yaml:"stages"`
+		Version   string                 `yaml:"version"`
+		Project   map[string]interface{} `yaml:"project"`
+		Audit     map[string]interface{} `yaml:"audit"`
+		Artifacts map[string]interface{} `yaml:"artifacts"`
+		Stages    yaml.Node              `yaml:"stages"`
 	}
 
 	if err := decoder.Decode(&temp); err != nil {
@@ -195,37 +315,41 @@ func loadConfig(path string, vars execVars) (*Config, error) {
 	}
 
 	// Resolve variables in all stages
+	config.Vars = vars
 	for name, stage := range config.Stages {
 		resolveStageVars(&stage, vars)
 		config.Stages[name] = stage
 	}
 
+	config.Dir = filepath.Dir(path)
+	config.LockPath = lockPath(path)
+	if config.Lock, err = loadLock(config.LockPath); err != nil {
+		return nil, err
+	}
+	config.SecretsPath = secretsPath(&config, path)
+
 	return &config, nil
 }
 
-// VerifyRequirements checks if all required stages have been executed successfully
-func verifyRequirements(stage Stage, auditStore lib.AuditStore, projectName, gitRevision string) error {
-	if len(stage.Requires) == 0 {
+// VerifyRequirements checks if all required stages, and the stages whose
+// artifacts are needed, have been executed successfully.
+// Skipped stages count as successful if the project allows it.
+func verifyRequirements(stage Stage, config *Config, auditStore lib.AuditStore, gitRevision string) error {
+	deps := stage.dependencies()
+	if len(deps) == 0 {
 		return nil
 	}
 
 	// Load audit logs for this project and revision
-	logs, err := auditStore.LoadLogs(projectName, gitRevision)
+	logs, err := auditStore.LoadLogs(config.Project.Name, gitRevision)
 	if err != nil {
 		return fmt.Errorf("loading audit logs: %w", err)
 	}
 
-	// Create a map of successful stages
-	successful := make(map[string]bool)
-	for _, log := range logs {
-		if log.Status == "success" {
-			successful[log.Stage] = true
-		}
-	}
-
 	// Check each required stage
+	successful := successfulStages(logs, config)
 	var missing []string
-	for _, req := range stage.Requires {
+	for _, req := range deps {
 		if !successful[req] {
 			missing = append(missing, req)
 		}
@@ -238,9 +362,334 @@ func verifyRequirements(stage Stage, auditStore lib.AuditStore, projectName, git
 	return nil
 }
 
+// dependencies returns the stages that have to succeed before the stage
+// runs: the stages it requires and those whose artifacts it needs
+func (s Stage) dependencies() []string {
+	if len(s.NeedsArtifacts) == 0 {
+		return s.Requires
+	}
+	deps := append([]string(nil), s.Requires...)
+	for _, need := range s.NeedsArtifacts {
+		if !slices.Contains(deps, need.Stage) {
+			deps = append(deps, need.Stage)
+		}
+	}
+	return deps
+}
+
+// successfulStages returns the stages with a successful or cached audit log,
+// or a skipped one if the project allows skipped requirements. A matrix stage
+// only counts once every cell of its matrix has succeeded.
+func successfulStages(logs []lib.AuditLog, config *Config) map[string]bool {
+	successful := make(map[string]bool)
+	cells := make(map[string]map[string]bool)
+	for _, log := range logs {
+		switch {
+		case config.Project.AllowSkippedRequirements && log.Status == lib.StatusSkipped:
+			// Stages are skipped as a whole, before their matrix is expanded
+			successful[log.Stage] = true
+		case log.Status == lib.StatusSuccess || log.Status == lib.StatusCached:
+			if cells[log.Stage] == nil {
+				cells[log.Stage] = make(map[string]bool)
+			}
+			cells[log.Stage][matrixLabel(log.Matrix)] = true
+		}
+	}
+
+	for name, done := range cells {
+		stage := config.Stages[name]
+		if stage.Matrix == nil {
+			successful[name] = true
+			continue
+		}
+		expanded := expandMatrix(stage.Matrix, config.Vars)
+		complete := len(expanded) > 0
+		for _, cell := range expanded {
+			if !done[matrixLabel(cell.Values)] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			successful[name] = true
+		}
+	}
+	return successful
+}
+
+// resolveDependencies returns the given stages together with every stage
+// they transitively require
+func resolveDependencies(stages []string, config *Config) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+
+	var visit func(name, requiredBy string) error
+	visit = func(name, requiredBy string) error {
+		if seen[name] {
+			return nil
+		}
+		stage, ok := config.Stages[name]
+		if !ok {
+			return fmt.Errorf("stage %q requires unknown stage %q", requiredBy, name)
+		}
+		seen[name] = true
+
+		for _, req := range stage.dependencies() {
+			if err := visit(req, name); err != nil {
+				return err
+			}
+		}
+		result = append(result, name)
+		return nil
+	}
+
+	for _, name := range stages {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// withDependencies adds the stages required by the given stages. Required
+// stages that already succeeded for the current git revision are left out.
+func withDependencies(ctx *cli.Context, stages []string, config *Config) ([]string, error) {
+	all, err := resolveDependencies(stages, config)
+	if err != nil {
+		return nil, err
+	}
+
+	auditStore, err := createAuditStore(config, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating audit store: %w", err)
+	}
+
+	gitRev, err := getGitRevision()
+	if err != nil {
+		gitRev = "unknown" // Don't fail if we can't get git revision
+	}
+
+	logs, err := auditStore.LoadLogs(config.Project.Name, gitRev)
+	if err != nil {
+		return nil, fmt.Errorf("loading audit logs: %w", err)
+	}
+	successful := successfulStages(logs, config)
+
+	requested := make(map[string]bool, len(stages))
+	for _, name := range stages {
+		requested[name] = true
+	}
+
+	var result []string
+	for _, name := range all {
+		if !requested[name] && successful[name] {
+			fmt.Printf("Skipping %s: already completed for revision %s\n", name, gitRev)
+			continue
+		}
+		result = append(result, name)
+	}
+
+	return result, nil
+}
+
+// newStageExecution creates the execution configuration for a stage, images
+// without a registry are resolved against the stage's registry or registry
+func newStageExecution(name string, stage Stage, registry string) (lib.StageExecution, error) {
+	if stage.Registry != "" {
+		registry = stage.Registry
+	}
+
+	timeout, err := lib.ParseTimeout(stage.Timeout)
+	if err != nil {
+		return lib.StageExecution{}, fmt.Errorf("stage %q: %w", name, err)
+	}
+	commandTimeout, err := lib.ParseTimeout(stage.CommandTimeout)
+	if err != nil {
+		return lib.StageExecution{}, fmt.Errorf("stage %q: command_timeout: %w", name, err)
+	}
+
+	var retry lib.RetryPolicy
+	if stage.Retry != nil {
+		var backoff time.Duration
+		if stage.Retry.Backoff != "" {
+			backoff, err = time.ParseDuration(stage.Retry.Backoff)
+			if err != nil {
+				return lib.StageExecution{}, fmt.Errorf("stage %q: invalid retry backoff %q: %w", name, stage.Retry.Backoff, err)
+			}
+		}
+		retry = lib.RetryPolicy{
+			Attempts:    stage.Retry.Attempts,
+			Backoff:     backoff,
+			OnExitCodes: stage.Retry.OnExitCodes,
+		}
+	}
+
+	var coverage *lib.CoverageCheck
+	if stage.Coverage != nil && stage.Coverage.Enabled {
+		switch stage.Coverage.Format {
+		case "", lib.CoverageFormatGo, lib.CoverageFormatCobertura, lib.CoverageFormatLCOV:
+		default:
+			return lib.StageExecution{}, fmt.Errorf("stage %q: unsupported coverage format %q", name, stage.Coverage.Format)
+		}
+		coverage = &lib.CoverageCheck{
+			Profile:    stage.Coverage.Profile,
+			Format:     stage.Coverage.Format,
+			Threshold:  stage.Coverage.Threshold,
+			BaseBranch: stage.Coverage.BaseBranch,
+			MaxDrop:    stage.Coverage.MaxDrop,
+		}
+	}
+
+	services, err := newServices(name, stage.Services, registry)
+	if err != nil {
+		return lib.StageExecution{}, err
+	}
+
+	// Built runners get their tag once the build context is hashed
+	var runner string
+	var build *lib.ImageBuild
+	switch {
+	case stage.Runner.Build != nil:
+		if stage.Runner.Build.Context == "" {
+			return lib.StageExecution{}, fmt.Errorf("stage %q: runner build needs a context", name)
+		}
+		build = &lib.ImageBuild{
+			Context:    stage.Runner.Build.Context,
+			Dockerfile: stage.Runner.Build.Dockerfile,
+			Args:       stage.Runner.Build.Args,
+		}
+	case stage.Runner.Image == lib.ShellRunner:
+		runner = lib.ShellRunner
+	default:
+		runner = lib.ResolveRunnerImage(stage.Runner.Image, registry)
+	}
+
+	return lib.StageExecution{
+		Name:           name,
+		Runner:         runner,
+		Commands:       stage.Commands,
+		Environment:    stage.Environment,
+		Volumes:        stage.Volumes,
+		Timeout:        timeout,
+		CommandTimeout: commandTimeout,
+		Retry:          retry,
+		Inputs:         stage.Inputs,
+		Outputs:        stage.Outputs,
+		Coverage:       coverage,
+		Services:       services,
+		Build:          build,
+		User:           stage.User,
+		Resources:      stage.Resources,
+	}, nil
+}
+
+// newServices validates a stage's services and resolves their images
+func newServices(stageName string, services []Service, registry string) ([]lib.Service, error) {
+	var result []lib.Service
+	seen := make(map[string]bool)
+	for _, svc := range services {
+		if svc.Name == "" || svc.Image == "" {
+			return nil, fmt.Errorf("stage %q: services need a name and an image", stageName)
+		}
+		if seen[svc.Name] {
+			return nil, fmt.Errorf("stage %q: duplicate service %q", stageName, svc.Name)
+		}
+		seen[svc.Name] = true
+
+		var readiness *lib.Readiness
+		if svc.Readiness != nil {
+			if svc.Readiness.Command == "" {
+				return nil, fmt.Errorf("stage %q: service %q: readiness needs a command", stageName, svc.Name)
+			}
+			interval, err := lib.ParseTimeout(svc.Readiness.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("stage %q: service %q: readiness interval: %w", stageName, svc.Name, err)
+			}
+			timeout, err := lib.ParseTimeout(svc.Readiness.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("stage %q: service %q: readiness timeout: %w", stageName, svc.Name, err)
+			}
+			readiness = &lib.Readiness{
+				Command:  svc.Readiness.Command,
+				Interval: interval,
+				Timeout:  timeout,
+			}
+		}
+
+		result = append(result, lib.Service{
+			Name:        svc.Name,
+			Image:       lib.ResolveRunnerImage(svc.Image, registry),
+			Command:     svc.Command,
+			Environment: svc.Environment,
+			Ports:       svc.Ports,
+			Readiness:   readiness,
+		})
+	}
+	return result, nil
+}
+
+// withConfig makes a command that needs the config fail with the error
+// loading it failed with, e.g. a malformed lockfile, instead of running
+// with the empty config help falls back to
+func withConfig(configErr error, cmd *cli.Command) *cli.Command {
+	if configErr != nil {
+		cmd.Before = func(*cli.Context) error {
+			return configErr
+		}
+	}
+	return cmd
+}
+
 func createStageCommand(name string, stage Stage, config *Config) *cli.Command {
+	return &cli.Command{
+		Name:        name,
+		Usage:       fmt.Sprintf("Run the %s stage", name),
+		Description: fmt.Sprintf("Run the %s stage using %s runner", name, stage.Runner),
+		Action: func(ctx *cli.Context) error {
+			return recordRun(ctx, config, []string{name}, func() error {
+				return runStage(ctx, name, stage, config, false)
+			})
+		},
+	}
+}
+
+// stageWriters returns the writers for a stage's stdout and stderr. Lines
+// are prefixed with the stage name if prefix or --prefix-output is set, and
+// timestamped if --timestamps is set.
+func stageWriters(ctx *cli.Context, name string, prefix bool) (io.Writer, io.Writer) {
+	prefix = prefix || ctx.Bool("prefix-output")
+	timestamps := ctx.Bool("timestamps")
+	if !prefix && !timestamps {
+		return os.Stdout, os.Stderr
+	}
+
+	linePrefix := ""
+	if prefix {
+		linePrefix = "[" + name + "] "
+	}
+	out := lib.NewPrefixWriter(os.Stdout, linePrefix)
+	out.Timestamps = timestamps
+	errOut := lib.NewPrefixWriter(os.Stderr, linePrefix)
+	errOut.Timestamps = timestamps
+	return out, errOut
+}
+
+// runStage verifies a stage's requirements and executes it, once per matrix
+// cell if the stage defines a matrix. Output lines are prefixed with the
+// stage name if prefix is set.
+func runStage(ctx *cli.Context, name string, stage Stage, config *Config, prefix bool) error {
+	out, errOut := stageWriters(ctx, name, prefix)
+
+	// The shell runner bypasses the container, teams have to opt in to it
+	shell := stage.Runner.Image == lib.ShellRunner
+	if shell && !config.Project.AllowShellRunner && !ctx.Bool("allow-shell-runner") {
+		return fmt.Errorf("stage %q uses the %s runner, which runs commands on the host; enable it with project.allow_shell_runner or --allow-shell-runner",
+			name, lib.ShellRunner)
+	}
+
 	// Add default workspace mount if not present
-	hasWorkspaceMount := false
+	hasWorkspaceMount := shell // Shell stages run in the project root instead
 	for _, vol := range stage.Volumes {
 		if vol.Target == "/workspace" {
 			hasWorkspaceMount = true
@@ -249,48 +698,200 @@ func createStageCommand(name string, stage Stage, config *Config) *cli.Command {
 	}
 
 	if !hasWorkspaceMount {
-		stage.Volumes = append(stage.Volumes, lib.Volume{
+		// Copy first, stages running concurrently share the configured volumes
+		stage.Volumes = append(stage.Volumes[:len(stage.Volumes):len(stage.Volumes)], lib.Volume{
 			Type:   "bind",
 			Source: ".",
 			Target: "/workspace",
 		})
 	}
 
-	return &cli.Command{
-		Name:        name,
-		Usage:       fmt.Sprintf("Run the %s stage", name),
-		Description: fmt.Sprintf("Run the %s stage using %s runner", name, stage.Runner),
-		Action: func(ctx *cli.Context) error {
-			// Create audit store
-			auditStore, err := createAuditStore(config, ctx)
-			if err != nil {
-				return fmt.Errorf("creating audit store: %w", err)
-			}
+	runtime, err := selectRuntime(config, ctx)
+	if err != nil {
+		return err
+	}
+	registry := projectRegistry(config, ctx)
+	rewrites, err := registryRewrites(config, ctx)
+	if err != nil {
+		return err
+	}
 
-			// Get git revision
-			gitRev, err := getGitRevision()
-			if err != nil {
-				gitRev = "unknown" // Don't fail if we can't get git revision
-			}
+	// Create audit store
+	auditStore, err := createAuditStore(config, ctx)
+	if err != nil {
+		return fmt.Errorf("creating audit store: %w", err)
+	}
 
-			// Verify requirements before executing
-			if err := verifyRequirements(stage, auditStore, config.Project.Name, gitRev); err != nil {
-				return fmt.Errorf("stage requirements not met: %w", err)
-			}
+	// Get git revision
+	gitRev, err := getGitRevision()
+	if err != nil {
+		gitRev = "unknown" // Don't fail if we can't get git revision
+	}
 
-			// Create stage execution configuration
-			stageExec := lib.StageExecution{
-				Name:        name,
-				Runner:      lib.ResolveRunnerImage(stage.Runner, defaultRegistry),
-				Commands:    stage.Commands,
-				Environment: stage.Environment,
-				Volumes:     stage.Volumes,
-			}
+	// Skip the stage if its conditions don't hold, its requirements don't matter then
+	ok, reason, err := stage.When.evaluate(config.Vars)
+	if err != nil {
+		return fmt.Errorf("evaluating conditions of stage %q: %w", name, err)
+	}
+	if !ok {
+		return lib.SkipStage(lib.StageExecution{Name: name, Output: out, RunID: config.runID()}, auditStore, config.Project.Name, reason)
+	}
 
-			// Execute the stage
-			return lib.ExecuteStage(stageExec, auditStore, config.Project.Name)
-		},
+	// Verify requirements before executing
+	if err := verifyRequirements(stage, config, auditStore, gitRev); err != nil {
+		return fmt.Errorf("stage requirements not met: %w", err)
+	}
+
+	// Restore the artifacts of upstream stages into the workspace
+	if err := restoreArtifacts(ctx, name, stage, config, gitRev, out); err != nil {
+		return err
+	}
+
+	// Secrets are only needed, and may only be available, once the stage runs
+	secrets, err := resolveSecrets(config, name, stage.Secrets)
+	if err != nil {
+		return err
+	}
+
+	// configureExecution applies the settings shared by every execution of
+	// the stage, with or without a matrix
+	configureExecution := func(stageExec *lib.StageExecution) error {
+		stageExec.Output = out
+		stageExec.ErrOutput = errOut
+		stageExec.Force = ctx.Bool("force")
+		stageExec.Dir = config.Project.Root
+		stageExec.Root = config.Dir
+		stageExec.Runtime = runtime
+		stageExec.HostUser = config.Project.RunAsHostUser && stage.User == "" && !shell
+		stageExec.Secrets = secrets
+		stageExec.RunID = config.runID()
+		if !shell {
+			stageExec.Resources = stageExec.Resources.WithDefaults(config.Project.Resources)
+		}
+		if err := applyLock(ctx, config, stageExec, out); err != nil {
+			return err
+		}
+		rewriteImages(stageExec, rewrites)
+		return nil
 	}
+
+	// Stages without a matrix run exactly once
+	cells := expandMatrix(stage.Matrix, config.Vars)
+	if stage.Matrix == nil {
+		stageExec, err := newStageExecution(name, stage, registry)
+		if err != nil {
+			return err
+		}
+		if err := configureExecution(&stageExec); err != nil {
+			return err
+		}
+		if err := lib.ExecuteStageContext(ctx.Context, stageExec, auditStore, config.Project.Name); err != nil {
+			return err
+		}
+		return storeArtifacts(ctx, name, stage, nil, config, gitRev, out)
+	}
+	if len(cells) == 0 {
+		return fmt.Errorf("matrix for stage %q has no cells to run", name)
+	}
+
+	// Execute each matrix cell in priority order
+	for _, cell := range cells {
+		stageExec, err := newStageExecution(name, stage.withVars(cell.vars()), registry)
+		if err != nil {
+			return err
+		}
+		stageExec.Matrix = cell.Values
+		if err := configureExecution(&stageExec); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Matrix: %s\n", cell)
+		if err := lib.ExecuteStageContext(ctx.Context, stageExec, auditStore, config.Project.Name); err != nil {
+			return fmt.Errorf("matrix cell %s: %w", cell, err)
+		}
+		if err := storeArtifacts(ctx, name, stage, cell.Values, config, gitRev, out); err != nil {
+			return fmt.Errorf("matrix cell %s: %w", cell, err)
+		}
+	}
+	return nil
+}
+
+// selectRuntime returns the container runtime chosen with --runtime or in
+// the project configuration, Docker by default
+func selectRuntime(config *Config, ctx *cli.Context) (lib.Runtime, error) {
+	name := ctx.String("runtime")
+	if name == "" {
+		name = config.Project.Runtime
+	}
+	return lib.NewRuntime(name)
+}
+
+// projectRegistry returns the registry of images without one, set with
+// --registry or in the project configuration, public.ecr.aws by default
+func projectRegistry(config *Config, ctx *cli.Context) string {
+	if ctx.IsSet("registry") {
+		return ctx.String("registry")
+	}
+	if config.Project.Registry != "" {
+		return config.Project.Registry
+	}
+	return defaultRegistry
+}
+
+// registryRewrites returns the rules of --registry-rewrite followed by those
+// in the project configuration, the first matching rule applies
+func registryRewrites(config *Config, ctx *cli.Context) ([]lib.Rewrite, error) {
+	var rules []lib.Rewrite
+	for _, flag := range ctx.StringSlice("registry-rewrite") {
+		rule, err := lib.ParseRewrite(flag)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	for _, rule := range config.Project.RegistryRewrites {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("project.registry_rewrites: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// rewriteImages points the runner and service images of a stage to mirrors.
+// Rewriting happens after pinning, the lockfile keeps the original images.
+func rewriteImages(stageExec *lib.StageExecution, rules []lib.Rewrite) {
+	if len(rules) == 0 {
+		return
+	}
+	if stageExec.Runner != lib.ShellRunner && stageExec.Build == nil {
+		stageExec.Runner = lib.RewriteImage(stageExec.Runner, rules)
+	}
+	services := make([]lib.Service, len(stageExec.Services))
+	for i, svc := range stageExec.Services {
+		svc.Image = lib.RewriteImage(svc.Image, rules)
+		services[i] = svc
+	}
+	stageExec.Services = services
+}
+
+// runStages executes the given stages as a graph built from their dependencies.
+// Independent stages run concurrently, up to parallel at a time.
+func runStages(ctx *cli.Context, stages []string, config *Config, parallel int) error {
+	requires := make(map[string][]string, len(stages))
+	for _, name := range stages {
+		requires[name] = config.Stages[name].dependencies()
+	}
+
+	graph, err := lib.NewGraph(stages, requires)
+	if err != nil {
+		return err
+	}
+
+	return graph.Run(parallel, func(name string) error {
+		// Prefix output so interleaved stages stay attributable
+		return runStage(ctx, name, config.Stages[name], config, parallel > 1)
+	})
 }
 
 func run(args []string) error {
@@ -329,12 +930,102 @@ func run(args []string) error {
 			Usage:   "S3 bucket name for audit logs when using s3 store",
 			EnvVars: []string{"SONIC_AUDIT_S3_BUCKET"},
 		},
+		&cli.StringFlag{
+			Name:    "audit-s3-endpoint",
+			Usage:   "URL of an S3 compatible store like MinIO, Ceph or LocalStack",
+			EnvVars: []string{"SONIC_AUDIT_S3_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "audit-s3-region",
+			Usage:   "Region of the S3 bucket",
+			EnvVars: []string{"SONIC_AUDIT_S3_REGION"},
+		},
+		&cli.BoolFlag{
+			Name:    "audit-s3-path-style",
+			Usage:   "Address S3 buckets as endpoint/bucket, which most S3 compatible stores need",
+			EnvVars: []string{"SONIC_AUDIT_S3_PATH_STYLE"},
+		},
+		&cli.StringFlag{
+			Name:    "audit-s3-ca-bundle",
+			Usage:   "PEM file with the CAs to verify the S3 endpoint's certificate with",
+			EnvVars: []string{"SONIC_AUDIT_S3_CA_BUNDLE"},
+		},
+		&cli.StringFlag{
+			Name:    "audit-s3-profile",
+			Usage:   "Profile of the shared AWS config and credentials files",
+			EnvVars: []string{"SONIC_AUDIT_S3_PROFILE"},
+		},
+		&cli.StringFlag{
+			Name:    "artifacts-store",
+			Usage:   "Artifact storage type (file or s3)",
+			EnvVars: []string{"SONIC_ARTIFACTS_STORE"},
+		},
+		&cli.StringFlag{
+			Name:    "artifacts-path",
+			Usage:   "Path for artifacts (directory for file store, prefix for S3)",
+			EnvVars: []string{"SONIC_ARTIFACTS_PATH"},
+		},
+		&cli.StringFlag{
+			Name:    "artifacts-s3-bucket",
+			Usage:   "S3 bucket name for artifacts when using s3 store",
+			EnvVars: []string{"SONIC_ARTIFACTS_S3_BUCKET"},
+		},
 		&cli.StringFlag{
 			Name:    "registry",
 			Usage:   "Default Docker registry to use when not specified in image reference",
 			Value:   defaultRegistry,
 			EnvVars: []string{"GOSONIC_DEFAULT_REGISTRY"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "registry-rewrite",
+			Usage:   "Rewrite images under a prefix to a mirror, in from=to format (can be specified multiple times)",
+			EnvVars: []string{"SONIC_REGISTRY_REWRITES"},
+		},
+		&cli.BoolFlag{
+			Name:    "prefix-output",
+			Usage:   "Prefix every output line with the stage name",
+			EnvVars: []string{"SONIC_PREFIX_OUTPUT"},
+		},
+		&cli.BoolFlag{
+			Name:    "timestamps",
+			Usage:   "Prefix every output line with the time it was written",
+			EnvVars: []string{"SONIC_TIMESTAMPS"},
+		},
+		&cli.StringFlag{
+			Name:    "runtime",
+			Usage:   "Container runtime running the stages (docker, podman or docker-api)",
+			EnvVars: []string{"SONIC_RUNTIME"},
+		},
+		&cli.BoolFlag{
+			Name:    "allow-shell-runner",
+			Usage:   "Allow stages with runner shell to run commands directly on the host",
+			EnvVars: []string{"SONIC_ALLOW_SHELL_RUNNER"},
+		},
+		&cli.BoolFlag{
+			Name:    "locked",
+			Usage:   "Fail instead of warning when an image isn't pinned in sonic.lock",
+			EnvVars: []string{"SONIC_LOCKED"},
+		},
+		&cli.BoolFlag{
+			Name:    "force",
+			Usage:   "Run stages even if their inputs are unchanged since a successful run",
+			EnvVars: []string{"SONIC_FORCE"},
+		},
+		&cli.DurationFlag{
+			Name:    "deadline",
+			Usage:   "Maximum execution time for the whole invocation, e.g. 30m",
+			EnvVars: []string{"SONIC_DEADLINE"},
+		},
+	}
+
+	// Apply the global deadline to the context shared by all commands
+	cancelDeadline := func() {}
+	defer func() { cancelDeadline() }()
+	cliApp.Before = func(ctx *cli.Context) error {
+		if deadline := ctx.Duration("deadline"); deadline > 0 {
+			ctx.Context, cancelDeadline = context.WithTimeout(ctx.Context, deadline)
+		}
+		return nil
 	}
 
 	// Load config and create commands immediately
@@ -381,11 +1072,26 @@ func run(args []string) error {
 	if err != nil {
 		config = &Config{} // Use empty config if loading fails
 	}
+	config.Args = args[1:]
 
 	// Add the run command after config is loaded
-	commands = append(commands, &cli.Command{
-		Name:  "run",
-		Usage: "Run one or more stages in sequence",
+	commands = append(commands, withConfig(err, &cli.Command{
+		Name:      "run",
+		Usage:     "Run one or more stages, ordered by their requirements",
+		ArgsUsage: "stage [stage...]",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:    "parallel",
+				Aliases: []string{"p"},
+				Value:   1,
+				Usage:   "Maximum number of independent stages to run concurrently",
+				EnvVars: []string{"SONIC_PARALLEL"},
+			},
+			&cli.BoolFlag{
+				Name:  "with-deps",
+				Usage: "Also run required stages that haven't completed successfully for the current git revision",
+			},
+		},
 		Action: func(ctx *cli.Context) error {
 			if !ctx.Args().Present() {
 				return fmt.Errorf("no stages specified")
@@ -411,18 +1117,26 @@ func run(args []string) error {
 				return fmt.Errorf("invalid stage(s) specified")
 			}
 
-			// Execute each stage
-			for _, name := range stages {
-				stage := config.Stages[name]
-
-				cmd := createStageCommand(name, stage, config)
-				if err := cmd.Run(ctx); err != nil {
-					return fmt.Errorf("stage %q failed: %w", name, err)
+			// Add required stages if requested
+			if ctx.Bool("with-deps") {
+				var err error
+				stages, err = withDependencies(ctx, stages, config)
+				if err != nil {
+					return err
 				}
 			}
-			return nil
+
+			// Execute the stages, honoring their requirements
+			return recordRun(ctx, config, stages, func() error {
+				return runStages(ctx, stages, config, ctx.Int("parallel"))
+			})
 		},
-	})
+	}))
+
+	commands = append(commands,
+		withConfig(err, artifactsCommand(config)),
+		withConfig(err, lockCommand(config)),
+		withConfig(err, secretsCommand(config)))
 
 	// Add stage commands for help display
 	if err == nil {
@@ -469,7 +1183,12 @@ func run(args []string) error {
 		return nil
 	}
 
-	if err := cliApp.Run(args); err != nil {
+	// Cancel running stages on Ctrl-C so their containers, services and
+	// networks are removed before gosonic exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := cliApp.RunContext(ctx, args); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		if os.Getenv("GO_TEST") != "1" {
 			os.Exit(1)
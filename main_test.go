@@ -5,10 +5,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"gosonic/lib"
 
@@ -17,6 +19,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
 )
 
 type MockAuditStore struct {
@@ -28,6 +31,11 @@ func (m *MockAuditStore) Store(log lib.AuditLog) error {
 	return args.Error(0)
 }
 
+func (m *MockAuditStore) StoreRun(run lib.Run) error {
+	args := m.Called(run)
+	return args.Error(0)
+}
+
 func (m *MockAuditStore) LoadLogs(project, gitRevision string) ([]lib.AuditLog, error) {
 	args := m.Called(project, gitRevision)
 	return args.Get(0).([]lib.AuditLog), args.Error(1)
@@ -221,7 +229,7 @@ stages:
 		"deploy":    {Stdout: "Deployment complete\n"},
 	}
 
-	lib.ExecDocker = func(args []string) lib.DockerResult {
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
 		// Find which command is being executed
 		var cmdType string
 
@@ -251,6 +259,7 @@ stages:
 		}
 
 		if result, ok := mockResults[cmdType]; ok {
+			fmt.Fprint(stdout, result.Stdout)
 			return result
 		}
 		return lib.DockerResult{
@@ -267,7 +276,7 @@ stages:
 		wantErr    bool
 	}{
 		"run all stages in order": {
-			args: []string{"gosonic", "--sonic-file", configPath, "run", "unit-test", "build", "deploy"},
+			args: []string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"), "run", "unit-test", "build", "deploy"},
 			wantStdout: []string{
 				"Tests passed",
 				"Build successful",
@@ -275,7 +284,7 @@ stages:
 			},
 		},
 		"invalid stage": {
-			args:    []string{"gosonic", "--sonic-file", configPath, "run", "invalid"},
+			args:    []string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"), "run", "invalid"},
 			wantErr: true,
 			wantStderr: []string{
 				"Error: invalid stage(s): invalid",
@@ -337,7 +346,7 @@ func TestCreateAuditStore(t *testing.T) {
 
 	// Mock S3 client creation
 	originalCreateS3Client := createS3Client
-	createS3Client = func(ctx context.Context) (lib.S3Client, error) {
+	createS3Client = func(ctx context.Context, settings S3Settings) (lib.S3Client, error) {
 		return &lib.MockS3Client{}, nil
 	}
 	defer func() { createS3Client = originalCreateS3Client }()
@@ -359,9 +368,10 @@ func TestCreateAuditStore(t *testing.T) {
 		"file store from config": {
 			config: &Config{
 				Audit: struct {
-					Store    string `yaml:"store"`
-					Path     string `yaml:"path"`
-					S3Bucket string `yaml:"s3bucket"`
+					Store    string     `yaml:"store"`
+					Path     string     `yaml:"path"`
+					S3Bucket string     `yaml:"s3bucket"`
+					S3       S3Settings `yaml:",inline"`
 				}{
 					Store: "file",
 					Path:  filepath.Join(tmpDir, "audit-logs"),
@@ -373,9 +383,10 @@ func TestCreateAuditStore(t *testing.T) {
 		"s3 store from config": {
 			config: &Config{
 				Audit: struct {
-					Store    string `yaml:"store"`
-					Path     string `yaml:"path"`
-					S3Bucket string `yaml:"s3bucket"`
+					Store    string     `yaml:"store"`
+					Path     string     `yaml:"path"`
+					S3Bucket string     `yaml:"s3bucket"`
+					S3       S3Settings `yaml:",inline"`
 				}{
 					Store:    "s3",
 					Path:     "logs/prefix",
@@ -389,9 +400,10 @@ func TestCreateAuditStore(t *testing.T) {
 		"cli flags override config": {
 			config: &Config{
 				Audit: struct {
-					Store    string `yaml:"store"`
-					Path     string `yaml:"path"`
-					S3Bucket string `yaml:"s3bucket"`
+					Store    string     `yaml:"store"`
+					Path     string     `yaml:"path"`
+					S3Bucket string     `yaml:"s3bucket"`
+					S3       S3Settings `yaml:",inline"`
 				}{
 					Store:    "file",
 					Path:     "config-logs",
@@ -410,9 +422,10 @@ func TestCreateAuditStore(t *testing.T) {
 		"env vars override config": {
 			config: &Config{
 				Audit: struct {
-					Store    string `yaml:"store"`
-					Path     string `yaml:"path"`
-					S3Bucket string `yaml:"s3bucket"`
+					Store    string     `yaml:"store"`
+					Path     string     `yaml:"path"`
+					S3Bucket string     `yaml:"s3bucket"`
+					S3       S3Settings `yaml:",inline"`
 				}{
 					Store:    "file",
 					Path:     "config-logs",
@@ -431,9 +444,10 @@ func TestCreateAuditStore(t *testing.T) {
 		"s3 store without bucket": {
 			config: &Config{
 				Audit: struct {
-					Store    string `yaml:"store"`
-					Path     string `yaml:"path"`
-					S3Bucket string `yaml:"s3bucket"`
+					Store    string     `yaml:"store"`
+					Path     string     `yaml:"path"`
+					S3Bucket string     `yaml:"s3bucket"`
+					S3       S3Settings `yaml:",inline"`
 				}{
 					Store: "s3",
 					Path:  "logs",
@@ -444,9 +458,10 @@ func TestCreateAuditStore(t *testing.T) {
 		"invalid store type": {
 			config: &Config{
 				Audit: struct {
-					Store    string `yaml:"store"`
-					Path     string `yaml:"path"`
-					S3Bucket string `yaml:"s3bucket"`
+					Store    string     `yaml:"store"`
+					Path     string     `yaml:"path"`
+					S3Bucket string     `yaml:"s3bucket"`
+					S3       S3Settings `yaml:",inline"`
 				}{
 					Store: "invalid",
 				},
@@ -760,3 +775,1059 @@ stages:
 	assert.Equal(t, "${region.name}", deploy.Environment["REGION"])
 	assert.Equal(t, "${env}", deploy.Environment["ENV"])
 }
+
+func TestRunStagesParallel(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "parallel-sonic.yml")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  lint:
+    runner: "golang"
+    commands:
+      - "echo lint"
+  unit-test:
+    runner: "golang"
+    commands:
+      - "echo unit-test"
+  build:
+    runner: "golang"
+    requires: ["unit-test"]
+    commands:
+      - "echo build"
+  deploy:
+    runner: "kubernetes"
+    requires: ["build"]
+    commands:
+      - "echo deploy"
+`)
+
+	err := os.WriteFile(configPath, configData, 0644)
+	assert.NoError(t, err)
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+
+	tests := map[string]struct {
+		failStage   string
+		wantStdout  []string
+		wantMissing []string
+		wantErr     bool
+	}{
+		"all stages succeed": {
+			wantStdout: []string{
+				"[lint] Stage: lint",
+				"[unit-test] output of unit-test",
+				"[build] output of build",
+				"[deploy] output of deploy",
+			},
+		},
+		"failed prerequisite skips dependents": {
+			failStage: "unit-test",
+			wantStdout: []string{
+				"[lint] output of lint",
+			},
+			wantMissing: []string{
+				"output of build",
+				"output of deploy",
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+				stage := args[len(args)-1]
+				if stage == tc.failStage {
+					return lib.DockerResult{Error: fmt.Errorf("exit status 1"), ExitCode: 1}
+				}
+				fmt.Fprintln(stdout, "output of "+stage)
+				return lib.DockerResult{Stdout: "output of " + stage}
+			}
+
+			stdout, _, err := captureOutput(func() error {
+				return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(t.TempDir(), "logs"),
+					"run", "--parallel", "2", "deploy", "build", "unit-test", "lint"})
+			})
+
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			for _, want := range tc.wantStdout {
+				assert.Contains(t, stdout, want)
+			}
+			for _, missing := range tc.wantMissing {
+				assert.NotContains(t, stdout, missing)
+			}
+		})
+	}
+}
+
+func TestResolveDependencies(t *testing.T) {
+	config := &Config{
+		Stages: map[string]Stage{
+			"test":    {},
+			"build":   {Requires: []string{"test"}},
+			"deploy":  {Requires: []string{"build", "test"}},
+			"broken":  {Requires: []string{"missing"}},
+			"package": {NeedsArtifacts: []ArtifactNeed{{Stage: "build"}}},
+		},
+	}
+
+	stages, err := resolveDependencies([]string{"deploy"}, config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test", "build", "deploy"}, stages)
+
+	// Stages whose artifacts are needed are dependencies as well
+	stages, err = resolveDependencies([]string{"package"}, config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test", "build", "package"}, stages)
+
+	_, err = resolveDependencies([]string{"broken"}, config)
+	assert.EqualError(t, err, `stage "broken" requires unknown stage "missing"`)
+}
+
+func TestRunWithDeps(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "deps-sonic.yml")
+	logsDir := filepath.Join(tmpDir, "logs")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  test:
+    runner: "golang"
+    commands:
+      - "test"
+  build:
+    runner: "golang"
+    requires: ["test"]
+    commands:
+      - "build"
+  deploy:
+    runner: "kubernetes"
+    requires: ["build"]
+    commands:
+      - "deploy"
+`)
+
+	err := os.WriteFile(configPath, configData, 0644)
+	assert.NoError(t, err)
+
+	// The test stage already succeeded for this revision
+	gitRev, err := lib.GetGitRevision()
+	if err != nil {
+		gitRev = "unknown"
+	}
+	err = lib.NewFileStore(logsDir).Store(lib.AuditLog{
+		Project:     "test-project",
+		GitRevision: gitRev,
+		Stage:       "test",
+		Status:      "success",
+	})
+	assert.NoError(t, err)
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+
+	var ran []string
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		if args[1] != "run" {
+			return lib.DockerResult{} // The runner image is inspected afterwards
+		}
+		ran = append(ran, args[len(args)-1])
+		return lib.DockerResult{}
+	}
+
+	stdout, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", logsDir, "run", "--with-deps", "deploy"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build", "deploy"}, ran)
+	assert.Contains(t, stdout, "Skipping test: already completed")
+}
+
+func TestRunDeadline(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "deadline-sonic.yml")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  integration-test:
+    runner: "golang"
+    commands:
+      - "go test -tags=integration ./..."
+`)
+
+	err := os.WriteFile(configPath, configData, 0644)
+	assert.NoError(t, err)
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		if args[1] == "rm" {
+			return lib.DockerResult{}
+		}
+		<-ctx.Done()
+		return lib.DockerResult{Error: ctx.Err(), ExitCode: -1}
+	}
+
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"),
+			"--deadline", "10ms", "run", "integration-test"})
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+}
+
+func TestVerifyRequirements(t *testing.T) {
+	stage := Stage{Requires: []string{"integration-test"}}
+
+	tests := map[string]struct {
+		logs         []lib.AuditLog
+		allowSkipped bool
+		wantErr      bool
+	}{
+		"never ran": {
+			wantErr: true,
+		},
+		"only failed attempts": {
+			logs: []lib.AuditLog{
+				{Stage: "integration-test", Attempt: 1, Status: "failed"},
+				{Stage: "integration-test", Attempt: 2, Status: "failed"},
+			},
+			wantErr: true,
+		},
+		"succeeded on retry": {
+			logs: []lib.AuditLog{
+				{Stage: "integration-test", Attempt: 1, Status: "failed"},
+				{Stage: "integration-test", Attempt: 2, Status: "success"},
+			},
+		},
+		"interrupted": {
+			logs:    []lib.AuditLog{{Stage: "integration-test", Attempt: 1, Status: "running"}},
+			wantErr: true,
+		},
+		"cancelled": {
+			logs:    []lib.AuditLog{{Stage: "integration-test", Attempt: 1, Status: "cancelled"}},
+			wantErr: true,
+		},
+		"cached": {
+			logs: []lib.AuditLog{{Stage: "integration-test", Status: "cached"}},
+		},
+		"skipped": {
+			logs:    []lib.AuditLog{{Stage: "integration-test", Status: "skipped"}},
+			wantErr: true,
+		},
+		"skipped allowed": {
+			logs:         []lib.AuditLog{{Stage: "integration-test", Status: "skipped"}},
+			allowSkipped: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := new(MockAuditStore)
+			store.On("LoadLogs", "test-project", "abc123").Return(tc.logs, nil)
+
+			config := &Config{Stages: map[string]Stage{"integration-test": {}}}
+			config.Project.Name = "test-project"
+			config.Project.AllowSkippedRequirements = tc.allowSkipped
+			err := verifyRequirements(stage, config, store, "abc123")
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRequirementsMatrix(t *testing.T) {
+	stage := Stage{Requires: []string{"build"}}
+	matrix := &Matrix{
+		Dimensions:     map[string][]MatrixValue{"os": {{Name: "linux"}, {Name: "darwin"}}},
+		DimensionOrder: []string{"os"},
+	}
+
+	tests := map[string]struct {
+		logs    []lib.AuditLog
+		vars    execVars
+		wantErr bool
+	}{
+		"every cell succeeded": {
+			logs: []lib.AuditLog{
+				{Stage: "build", Status: "success", Matrix: map[string]string{"os": "linux"}},
+				{Stage: "build", Status: "cached", Matrix: map[string]string{"os": "darwin"}},
+			},
+		},
+		"one cell failed": {
+			logs: []lib.AuditLog{
+				{Stage: "build", Status: "success", Matrix: map[string]string{"os": "linux"}},
+				{Stage: "build", Status: "failed", Matrix: map[string]string{"os": "darwin"}},
+			},
+			wantErr: true,
+		},
+		"one cell missing": {
+			logs:    []lib.AuditLog{{Stage: "build", Status: "success", Matrix: map[string]string{"os": "linux"}}},
+			wantErr: true,
+		},
+		"selected cell succeeded": {
+			logs: []lib.AuditLog{
+				{Stage: "build", Status: "success", Matrix: map[string]string{"os": "linux"}},
+				{Stage: "build", Status: "failed", Matrix: map[string]string{"os": "darwin"}},
+			},
+			vars: execVars{"os.name": "linux"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := new(MockAuditStore)
+			store.On("LoadLogs", "test-project", "abc123").Return(tc.logs, nil)
+
+			config := &Config{Stages: map[string]Stage{"build": {Matrix: matrix}}, Vars: tc.vars}
+			config.Project.Name = "test-project"
+			err := verifyRequirements(stage, config, store, "abc123")
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewStageExecutionCoverage(t *testing.T) {
+	tests := map[string]struct {
+		coverage *Coverage
+		want     *lib.CoverageCheck
+		wantErr  bool
+	}{
+		"not configured": {},
+		"disabled": {
+			coverage: &Coverage{Enabled: false, Threshold: 80},
+		},
+		"enabled": {
+			coverage: &Coverage{Enabled: true, Threshold: 80, Format: "lcov", BaseBranch: "main", MaxDrop: 0.5},
+			want:     &lib.CoverageCheck{Threshold: 80, Format: "lcov", BaseBranch: "main", MaxDrop: 0.5},
+		},
+		"unsupported format": {
+			coverage: &Coverage{Enabled: true, Format: "jacoco"},
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stageExec, err := newStageExecution("test", Stage{Runner: Runner{Image: "golang"}, Coverage: tc.coverage}, defaultRegistry)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, stageExec.Coverage)
+		})
+	}
+}
+
+func TestNewStageExecutionServices(t *testing.T) {
+	tests := map[string]struct {
+		services []Service
+		want     []lib.Service
+		wantErr  string
+	}{
+		"none": {},
+		"with readiness": {
+			services: []Service{{
+				Name:        "db",
+				Image:       "docker/library/postgres:16",
+				Environment: map[string]string{"POSTGRES_PASSWORD": "secret"},
+				Ports:       []string{"5432"},
+				Readiness:   &Readiness{Command: "pg_isready", Interval: "2s", Timeout: "30s"},
+			}},
+			want: []lib.Service{{
+				Name:        "db",
+				Image:       "public.ecr.aws/docker/library/postgres:16",
+				Environment: map[string]string{"POSTGRES_PASSWORD": "secret"},
+				Ports:       []string{"5432"},
+				Readiness:   &lib.Readiness{Command: "pg_isready", Interval: 2 * time.Second, Timeout: 30 * time.Second},
+			}},
+		},
+		"missing image": {
+			services: []Service{{Name: "db"}},
+			wantErr:  "services need a name and an image",
+		},
+		"duplicate name": {
+			services: []Service{{Name: "db", Image: "postgres"}, {Name: "db", Image: "mysql"}},
+			wantErr:  `duplicate service "db"`,
+		},
+		"invalid readiness timeout": {
+			services: []Service{{Name: "db", Image: "postgres", Readiness: &Readiness{Command: "true", Timeout: "soon"}}},
+			wantErr:  `service "db": readiness timeout`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stageExec, err := newStageExecution("test", Stage{Runner: Runner{Image: "golang"}, Services: tc.services}, defaultRegistry)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, stageExec.Services)
+		})
+	}
+}
+
+func TestShellRunnerOptIn(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "shell-sonic.yml")
+	logsDir := filepath.Join(tmpDir, "logs")
+	marker := filepath.Join(tmpDir, "marker")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+  root: "` + tmpDir + `"
+stages:
+  clean:
+    runner: "shell"
+    commands:
+      - "touch marker"
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	_, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", logsDir, "clean"})
+	})
+	assert.ErrorContains(t, err, "enable it with project.allow_shell_runner or --allow-shell-runner")
+	assert.NoFileExists(t, marker)
+
+	// Commands run in the project root once the runner is allowed
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", logsDir, "--allow-shell-runner", "clean"})
+	})
+	assert.NoError(t, err)
+	assert.FileExists(t, marker)
+}
+
+func TestSelectRuntime(t *testing.T) {
+	tests := map[string]struct {
+		flag    string
+		project string
+		want    lib.Runtime
+		wantErr bool
+	}{
+		"default":           {want: lib.Docker},
+		"project":           {project: "podman", want: lib.Podman},
+		"flag wins":         {flag: "docker", project: "podman", want: lib.Docker},
+		"unknown runtime":   {flag: "lxc", wantErr: true},
+		"flag only, podman": {flag: "podman", want: lib.Podman},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			set := flag.NewFlagSet("test", 0)
+			set.String("runtime", tc.flag, "")
+			ctx := cli.NewContext(cli.NewApp(), set, nil)
+
+			config := &Config{}
+			config.Project.Runtime = tc.project
+
+			got, err := selectRuntime(config, ctx)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	tests := map[string]struct {
+		flag     string
+		rewrites []string
+		project  string
+		rules    []lib.Rewrite
+		stage    string
+		runner   string
+		service  string
+		want     string
+		wantSvc  string
+		wantErr  string
+	}{
+		"default": {
+			runner:  "docker/library/golang:1.24",
+			service: "docker/library/postgres:16",
+			want:    "public.ecr.aws/docker/library/golang:1.24",
+			wantSvc: "public.ecr.aws/docker/library/postgres:16",
+		},
+		"project": {
+			project: "registry.example.com",
+			runner:  "golang:1.24",
+			service: "postgres:16",
+			want:    "registry.example.com/golang:1.24",
+			wantSvc: "registry.example.com/postgres:16",
+		},
+		"flag wins over project": {
+			flag:    "flag.example.com",
+			project: "registry.example.com",
+			runner:  "golang:1.24",
+			service: "postgres:16",
+			want:    "flag.example.com/golang:1.24",
+			wantSvc: "flag.example.com/postgres:16",
+		},
+		"stage wins over flag": {
+			flag:    "flag.example.com",
+			stage:   "stage.example.com",
+			runner:  "golang:1.24",
+			service: "postgres:16",
+			want:    "stage.example.com/golang:1.24",
+			wantSvc: "stage.example.com/postgres:16",
+		},
+		"full reference keeps its registry": {
+			project: "registry.example.com",
+			runner:  "ghcr.io/org/tool:1",
+			service: "postgres:16",
+			want:    "ghcr.io/org/tool:1",
+			wantSvc: "registry.example.com/postgres:16",
+		},
+		"project rewrite": {
+			rules:   []lib.Rewrite{{From: "public.ecr.aws/docker/library/*", To: "mirror.example.com/library"}},
+			runner:  "docker/library/golang:1.24",
+			service: "docker/library/postgres:16",
+			want:    "mirror.example.com/library/golang:1.24",
+			wantSvc: "mirror.example.com/library/postgres:16",
+		},
+		"flag rewrite wins over project rewrite": {
+			rewrites: []string{"public.ecr.aws=airgap.example.com"},
+			rules:    []lib.Rewrite{{From: "public.ecr.aws/docker/library/*", To: "mirror.example.com/library"}},
+			runner:   "docker/library/golang:1.24",
+			service:  "docker/library/postgres:16",
+			want:     "airgap.example.com/docker/library/golang:1.24",
+			wantSvc:  "airgap.example.com/docker/library/postgres:16",
+		},
+		"invalid flag rewrite": {
+			rewrites: []string{"public.ecr.aws"},
+			wantErr:  "must be from=to",
+		},
+		"invalid project rewrite": {
+			rules:   []lib.Rewrite{{From: "public.ecr.aws"}},
+			wantErr: "project.registry_rewrites",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			set := flag.NewFlagSet("test", 0)
+			set.String("registry", defaultRegistry, "")
+			set.Var(cli.NewStringSlice(), "registry-rewrite", "")
+			var args []string
+			if tc.flag != "" {
+				args = append(args, "--registry", tc.flag)
+			}
+			for _, rule := range tc.rewrites {
+				args = append(args, "--registry-rewrite", rule)
+			}
+			assert.NoError(t, set.Parse(args))
+			ctx := cli.NewContext(cli.NewApp(), set, nil)
+
+			config := &Config{}
+			config.Project.Registry = tc.project
+			config.Project.RegistryRewrites = tc.rules
+
+			rules, err := registryRewrites(config, ctx)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			stageExec, err := newStageExecution("build", Stage{
+				Runner:   Runner{Image: tc.runner},
+				Registry: tc.stage,
+				Services: []Service{{Name: "db", Image: tc.service}},
+			}, projectRegistry(config, ctx))
+			assert.NoError(t, err)
+			rewriteImages(&stageExec, rules)
+
+			assert.Equal(t, tc.want, stageExec.Runner)
+			assert.Equal(t, tc.wantSvc, stageExec.Services[0].Image)
+		})
+	}
+}
+
+func TestRunnerBuild(t *testing.T) {
+	tests := map[string]struct {
+		yaml       string
+		wantRunner string
+		wantBuild  *lib.ImageBuild
+		wantErr    string
+	}{
+		"image": {
+			yaml:       `runner: "golang:1.24"`,
+			wantRunner: "public.ecr.aws/golang:1.24",
+		},
+		"build": {
+			yaml: `
+runner:
+  build:
+    context: ./ci
+    dockerfile: Dockerfile.ci
+    args:
+      GO_VERSION: "1.24"`,
+			wantBuild: &lib.ImageBuild{Context: "./ci", Dockerfile: "Dockerfile.ci", Args: map[string]string{"GO_VERSION": "1.24"}},
+		},
+		"build without context": {
+			yaml:    "runner:\n  build:\n    dockerfile: Dockerfile.ci",
+			wantErr: "runner build needs a context",
+		},
+		"mapping without build": {
+			yaml:    "runner:\n  image: golang",
+			wantErr: "runner must be an image or a build block",
+		},
+		"empty mapping": {
+			yaml:    "runner: {}",
+			wantErr: "runner must be an image or a build block",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stage Stage
+			err := yaml.Unmarshal([]byte(tc.yaml), &stage)
+			if err == nil {
+				var stageExec lib.StageExecution
+				stageExec, err = newStageExecution("lint", stage, defaultRegistry)
+				if err == nil {
+					assert.Equal(t, tc.wantRunner, stageExec.Runner)
+					assert.Equal(t, tc.wantBuild, stageExec.Build)
+				}
+			}
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRunAsHostUser(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "user-sonic.yml")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+  run_as_host_user: true
+stages:
+  build:
+    runner: "golang"
+    commands:
+      - "go build -o bin/app"
+  deploy:
+    runner: "alpine"
+    user: "nobody"
+    commands:
+      - "./deploy.sh"
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+
+	users := make(map[string]string)
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		for i, arg := range args {
+			if arg == "--user" {
+				users[args[len(args)-1]] = args[i+1]
+			}
+		}
+		return lib.DockerResult{}
+	}
+
+	_, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"), "run", "build", "deploy"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"bin/app":     fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		"./deploy.sh": "nobody",
+	}, users)
+}
+
+func TestResourceDefaults(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "resources-sonic.yml")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+  allow_shell_runner: true
+  resources:
+    cpus: "2"
+    memory: "1g"
+stages:
+  build:
+    runner: "golang"
+    commands:
+      - "go build ./..."
+  test:
+    runner: "golang"
+    resources:
+      memory: "4g"
+      pids: 512
+    commands:
+      - "go test ./..."
+  clean:
+    runner: "shell"
+    commands:
+      - "true"
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+
+	limits := make(map[string]string)
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		if args[1] != "run" {
+			return lib.DockerResult{} // Containers with a memory limit are removed afterwards
+		}
+		var flags []string
+		for i, arg := range args {
+			switch arg {
+			case "--cpus", "--memory", "--pids-limit", "--shm-size":
+				flags = append(flags, arg, args[i+1])
+			}
+		}
+		limits[args[len(args)-2]] = strings.Join(flags, " ")
+		return lib.DockerResult{}
+	}
+
+	_, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"), "run", "build", "test", "clean"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"build": "--cpus 2 --memory 1g",
+		"test":  "--cpus 2 --memory 4g --pids-limit 512",
+	}, limits)
+}
+
+func TestResolveSecrets(t *testing.T) {
+	tmpDir := t.TempDir()
+	secretFile := filepath.Join(tmpDir, "token")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("from-file"), 0600))
+	t.Setenv("GOSONIC_TEST_SECRET", "from-env")
+
+	key, err := lib.GenerateSecretsKey()
+	assert.NoError(t, err)
+	t.Setenv(secretsKeyEnv, key)
+	decoded, _ := lib.ParseSecretsKey(key)
+	encrypted, err := lib.EncryptSecret(decoded, "deploy_token", "from-secrets-file")
+	assert.NoError(t, err)
+	config := &Config{SecretsPath: filepath.Join(tmpDir, secretsFileName)}
+	file := &SecretsFile{Secrets: map[string]string{"deploy_token": encrypted}}
+	assert.NoError(t, file.save(config.SecretsPath))
+
+	tests := map[string]struct {
+		secret  Secret
+		want    lib.Secret
+		wantErr string
+	}{
+		"env by name": {
+			secret: Secret{Name: "GOSONIC_TEST_SECRET"},
+			want:   lib.Secret{Name: "GOSONIC_TEST_SECRET", Value: "from-env", Source: "env:GOSONIC_TEST_SECRET"},
+		},
+		"env": {
+			secret: Secret{Name: "TOKEN", Env: "GOSONIC_TEST_SECRET"},
+			want:   lib.Secret{Name: "TOKEN", Value: "from-env", Source: "env:GOSONIC_TEST_SECRET"},
+		},
+		"file": {
+			secret: Secret{Name: "token", File: secretFile, Target: "/run/secrets/token"},
+			want:   lib.Secret{Name: "token", Value: "from-file", Target: "/run/secrets/token", Source: "file:" + secretFile},
+		},
+		"key": {
+			secret: Secret{Name: "TOKEN", Key: "deploy_token"},
+			want:   lib.Secret{Name: "TOKEN", Value: "from-secrets-file", Source: "key:deploy_token"},
+		},
+		"unset env": {
+			secret:  Secret{Name: "TOKEN", Env: "GOSONIC_TEST_UNSET"},
+			wantErr: "environment variable GOSONIC_TEST_UNSET is not set",
+		},
+		"missing file": {
+			secret:  Secret{Name: "TOKEN", File: filepath.Join(tmpDir, "missing")},
+			wantErr: `stage "deploy": secret TOKEN`,
+		},
+		"missing key": {
+			secret:  Secret{Name: "TOKEN", Key: "other"},
+			wantErr: "key other not found",
+		},
+		"two sources": {
+			secret:  Secret{Name: "TOKEN", Env: "GOSONIC_TEST_SECRET", File: secretFile},
+			wantErr: "set only one of env, file and key",
+		},
+		"no name": {
+			secret:  Secret{Env: "GOSONIC_TEST_SECRET"},
+			wantErr: "secrets need a name",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := resolveSecrets(config, "deploy", []Secret{tc.secret})
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []lib.Secret{tc.want}, got)
+		})
+	}
+}
+
+func TestSecretsCommand(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "secrets-sonic.yml")
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  deploy:
+    runner: "alpine"
+    secrets:
+      - name: "TOKEN"
+        key: "deploy_token"
+    commands:
+      - "deploy --token $TOKEN"
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	key, err := lib.GenerateSecretsKey()
+	assert.NoError(t, err)
+	t.Setenv(secretsKeyEnv, key)
+
+	// The value is read from stdin
+	stdin := filepath.Join(tmpDir, "stdin")
+	assert.NoError(t, os.WriteFile(stdin, []byte("hunter2\n"), 0600))
+	in, err := os.Open(stdin)
+	assert.NoError(t, err)
+	defer in.Close()
+	oldStdin := os.Stdin
+	os.Stdin = in
+	defer func() { os.Stdin = oldStdin }()
+
+	stdout, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "secrets", "set", "deploy_token"})
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, stdout, "Stored deploy_token")
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, secretsFileName))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+	assert.Contains(t, string(data), "deploy_token:")
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+
+	var envFile string
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		for i, arg := range args {
+			if arg == "--env-file" {
+				data, _ := os.ReadFile(args[i+1])
+				envFile = string(data)
+			}
+		}
+		io.WriteString(stdout, "token is hunter2\n")
+		return lib.DockerResult{Output: "token is hunter2\n"}
+	}
+
+	stdout, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"), "run", "deploy"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "TOKEN=hunter2\n", envFile)
+	assert.Contains(t, stdout, "token is ***")
+	assert.NotContains(t, stdout, "hunter2")
+
+	// Without the key the stage can't start
+	t.Setenv(secretsKeyEnv, "")
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"), "run", "deploy"})
+	})
+	assert.ErrorContains(t, err, secretsKeyEnv+" is not set")
+}
+
+func TestS3AuditStore(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	fake := lib.NewFakeS3()
+	fake.PageSize = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// The default client factory reads the standard AWS settings
+	tmpDir := t.TempDir()
+	t.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(tmpDir, "aws-config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(tmpDir, "aws-credentials"))
+
+	configPath := filepath.Join(tmpDir, "s3-sonic.yml")
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+audit:
+  store: "s3"
+  s3bucket: "audit-logs"
+  path: "ci"
+stages:
+  build:
+    runner: "golang"
+    commands:
+      - "go build ./..."
+  test:
+    runner: "golang"
+    requires:
+      - "build"
+    commands:
+      - "go test ./..."
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		return lib.DockerResult{}
+	}
+
+	// test can't run before build succeeded
+	_, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "run", "test"})
+	})
+	assert.ErrorContains(t, err, "required stages not completed successfully: build")
+
+	// The requirement is verified against the logs stored in S3
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "run", "build", "test"})
+	})
+	assert.NoError(t, err)
+
+	var logs, runs int
+	for _, key := range fake.Keys("audit-logs") {
+		switch {
+		case strings.HasPrefix(key, "ci/runs/test-project-"):
+			runs++
+		case strings.HasPrefix(key, "ci/test-project/"):
+			logs++
+		}
+	}
+	assert.Equal(t, 2, runs)
+	assert.Equal(t, 2, logs)
+}
+
+func TestSkippedStageSecrets(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "skipped-secrets-sonic.yml")
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  deploy:
+    runner: "alpine"
+    secrets:
+      - name: "DEPLOY_TOKEN"
+        env: "GOSONIC_TEST_UNSET_TOKEN"
+    commands:
+      - "deploy --token $DEPLOY_TOKEN"
+    when:
+      vars:
+        env: "prod"
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		return lib.DockerResult{}
+	}
+
+	// Secrets of a skipped stage aren't resolved
+	auditPath := filepath.Join(tmpDir, "logs")
+	_, _, err := captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", auditPath, "run", "deploy"})
+	})
+	assert.NoError(t, err)
+	logs, err := lib.NewFileStore(auditPath).LoadLogs("test-project", "")
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, lib.StatusSkipped, logs[0].Status)
+	}
+
+	// The stage fails once it runs
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", auditPath, "--var", "env=prod", "run", "deploy"})
+	})
+	assert.ErrorContains(t, err, "environment variable GOSONIC_TEST_UNSET_TOKEN is not set")
+}
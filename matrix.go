@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type MatrixValue struct {
+	Name     string `yaml:"name"`
+	Priority int    `yaml:"priority"` // Lower numbers run first
+}
+
+// UnmarshalYAML allows matrix values to be written as plain scalars
+// ("- us-east-1") as well as {name, priority} mappings
+func (v *MatrixValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		v.Name = node.Value
+		return nil
+	}
+
+	type plain MatrixValue
+	return node.Decode((*plain)(v))
+}
+
+// Matrix expands a single stage into one execution per combination of its
+// dimension values. Every key other than include and exclude is a dimension,
+// e.g. "region", whose current value is exposed as ${region.name}.
+type Matrix struct {
+	Dimensions     map[string][]MatrixValue
+	DimensionOrder []string            // Track dimension order, used for expansion
+	Include        []map[string]string // Extra cells, keyed by dimension name
+	Exclude        []map[string]string // Cells to drop, keyed by dimension name
+}
+
+// UnmarshalYAML decodes the matrix block while preserving dimension order
+func (m *Matrix) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: matrix must be a mapping", node.Line)
+	}
+
+	m.Dimensions = make(map[string][]MatrixValue)
+	for i := 0; i < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		value := node.Content[i+1]
+
+		switch key {
+		case "include":
+			if err := value.Decode(&m.Include); err != nil {
+				return fmt.Errorf("matrix include: %w", err)
+			}
+		case "exclude":
+			if err := value.Decode(&m.Exclude); err != nil {
+				return fmt.Errorf("matrix exclude: %w", err)
+			}
+		default:
+			var values []MatrixValue
+			if err := value.Decode(&values); err != nil {
+				return fmt.Errorf("matrix dimension %q: %w", key, err)
+			}
+			m.Dimensions[key] = values
+			m.DimensionOrder = append(m.DimensionOrder, key)
+		}
+	}
+
+	return nil
+}
+
+// matrixCell is a single combination of matrix dimension values
+type matrixCell struct {
+	Values   map[string]string // dimension -> value name
+	Priority int
+	order    []string
+}
+
+// vars returns the execution variables for the cell, e.g. region.name
+func (c matrixCell) vars() execVars {
+	result := make(execVars, len(c.Values))
+	for dim, name := range c.Values {
+		result[dim+".name"] = name
+	}
+	return result
+}
+
+// String returns a readable representation of the cell, e.g. "region=us-east-1"
+func (c matrixCell) String() string {
+	parts := make([]string, 0, len(c.order))
+	for _, dim := range c.order {
+		if name, ok := c.Values[dim]; ok {
+			parts = append(parts, dim+"="+name)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// matches reports whether every key in filter has the same value in the cell
+func (c matrixCell) matches(filter map[string]string) bool {
+	for dim, name := range filter {
+		if c.Values[dim] != name {
+			return false
+		}
+	}
+	return true
+}
+
+// expandMatrix returns the cells for a matrix ordered by priority. Cells that
+// conflict with variables passed on the command line are dropped so that
+// --var region.name=us-east-1 selects a single region.
+func expandMatrix(m *Matrix, vars execVars) []matrixCell {
+	if m == nil {
+		return nil
+	}
+
+	// Build the cartesian product in declaration order
+	var cells []matrixCell
+	if len(m.DimensionOrder) > 0 {
+		cells = []matrixCell{{Values: map[string]string{}}}
+	}
+	for _, dim := range m.DimensionOrder {
+		var next []matrixCell
+		for _, cell := range cells {
+			for _, value := range m.Dimensions[dim] {
+				values := make(map[string]string, len(cell.Values)+1)
+				for k, v := range cell.Values {
+					values[k] = v
+				}
+				values[dim] = value.Name
+				next = append(next, matrixCell{
+					Values:   values,
+					Priority: cell.Priority + value.Priority,
+				})
+			}
+		}
+		cells = next
+	}
+
+	// Drop excluded combinations
+	var kept []matrixCell
+	for _, cell := range cells {
+		excluded := false
+		for _, filter := range m.Exclude {
+			if cell.matches(filter) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, cell)
+		}
+	}
+
+	// Add included combinations that aren't already present
+	for _, include := range m.Include {
+		duplicate := false
+		for _, cell := range kept {
+			if len(cell.Values) == len(include) && cell.matches(include) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+
+		cell := matrixCell{Values: make(map[string]string, len(include))}
+		for dim, name := range include {
+			cell.Values[dim] = name
+			for _, value := range m.Dimensions[dim] {
+				if value.Name == name {
+					cell.Priority += value.Priority
+					break
+				}
+			}
+		}
+		kept = append(kept, cell)
+	}
+
+	// Only keep cells that agree with explicitly passed variables
+	var result []matrixCell
+	for _, cell := range kept {
+		selected := true
+		for dim, name := range cell.Values {
+			if v, ok := vars[dim+".name"]; ok && v != name {
+				selected = false
+				break
+			}
+		}
+		if selected {
+			result = append(result, cell)
+		}
+	}
+
+	// Include-only dimensions sort after declared ones for display
+	order := append([]string{}, m.DimensionOrder...)
+	for _, include := range m.Include {
+		var extra []string
+		for dim := range include {
+			if _, ok := m.Dimensions[dim]; !ok && !slices.Contains(order, dim) {
+				extra = append(extra, dim)
+			}
+		}
+		sort.Strings(extra)
+		order = append(order, extra...)
+	}
+	for i := range result {
+		result[i].order = order
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Priority < result[j].Priority
+	})
+
+	return result
+}
+
+// withVars returns a copy of the stage with the given variables resolved
+func (s Stage) withVars(vars execVars) Stage {
+	env := make(map[string]string, len(s.Environment))
+	for k, v := range s.Environment {
+		env[k] = v
+	}
+	s.Environment = env
+	s.Volumes = append(s.Volumes[:0:0], s.Volumes...)
+	if s.Runner.Build != nil {
+		build := *s.Runner.Build
+		build.Args = make(map[string]string, len(s.Runner.Build.Args))
+		for k, v := range s.Runner.Build.Args {
+			build.Args[k] = v
+		}
+		s.Runner.Build = &build
+	}
+
+	resolveStageVars(&s, vars)
+	return s
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gosonic/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMatrixConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "matrix-sonic.yml")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  deploy:
+    runner: "kubernetes"
+    commands:
+      - "kubectl apply -f k8s/"
+    environment:
+      REGION: "${region.name}"
+    matrix:
+      region:
+        - name: "eu-west-1"
+          priority: 2
+        - name: "us-east-1"
+          priority: 1
+      env:
+        - "staging"
+        - "prod"
+      exclude:
+        - region: "eu-west-1"
+          env: "staging"
+      include:
+        - region: "ap-south-1"
+          env: "prod"
+`)
+
+	err := os.WriteFile(configPath, configData, 0644)
+	assert.NoError(t, err)
+
+	config, err := loadConfig(configPath, nil)
+	assert.NoError(t, err)
+
+	matrix := config.Stages["deploy"].Matrix
+	assert.NotNil(t, matrix)
+	assert.Equal(t, []string{"region", "env"}, matrix.DimensionOrder)
+	assert.Equal(t, []MatrixValue{
+		{Name: "eu-west-1", Priority: 2},
+		{Name: "us-east-1", Priority: 1},
+	}, matrix.Dimensions["region"])
+	assert.Equal(t, []MatrixValue{{Name: "staging"}, {Name: "prod"}}, matrix.Dimensions["env"])
+	assert.Equal(t, []map[string]string{{"region": "eu-west-1", "env": "staging"}}, matrix.Exclude)
+	assert.Equal(t, []map[string]string{{"region": "ap-south-1", "env": "prod"}}, matrix.Include)
+}
+
+func TestExpandMatrix(t *testing.T) {
+	matrix := &Matrix{
+		Dimensions: map[string][]MatrixValue{
+			"region": {
+				{Name: "eu-west-1", Priority: 2},
+				{Name: "us-east-1", Priority: 1},
+			},
+			"env": {
+				{Name: "staging"},
+				{Name: "prod"},
+			},
+		},
+		DimensionOrder: []string{"region", "env"},
+	}
+
+	tests := map[string]struct {
+		matrix *Matrix
+		vars   execVars
+		want   []string
+	}{
+		"nil matrix": {
+			matrix: nil,
+			want:   nil,
+		},
+		"ordered by priority": {
+			matrix: matrix,
+			want: []string{
+				"region=us-east-1,env=staging",
+				"region=us-east-1,env=prod",
+				"region=eu-west-1,env=staging",
+				"region=eu-west-1,env=prod",
+			},
+		},
+		"exclude and include": {
+			matrix: &Matrix{
+				Dimensions:     matrix.Dimensions,
+				DimensionOrder: matrix.DimensionOrder,
+				Exclude:        []map[string]string{{"env": "staging"}},
+				Include: []map[string]string{
+					{"region": "us-east-1", "env": "prod"}, // already present
+					{"region": "ap-south-1", "env": "prod"},
+				},
+			},
+			want: []string{
+				"region=ap-south-1,env=prod",
+				"region=us-east-1,env=prod",
+				"region=eu-west-1,env=prod",
+			},
+		},
+		"filtered by exec vars": {
+			matrix: matrix,
+			vars:   execVars{"region.name": "eu-west-1"},
+			want: []string{
+				"region=eu-west-1,env=staging",
+				"region=eu-west-1,env=prod",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, cell := range expandMatrix(tc.matrix, tc.vars) {
+				got = append(got, cell.String())
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestMatrixStageExecution(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "matrix-sonic.yml")
+
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  deploy:
+    runner: "kubernetes"
+    commands:
+      - "kubectl apply -f k8s/"
+    environment:
+      REGION: "${region.name}"
+    matrix:
+      region:
+        - name: "eu-west-1"
+          priority: 2
+        - name: "us-east-1"
+          priority: 1
+`)
+
+	err := os.WriteFile(configPath, configData, 0644)
+	assert.NoError(t, err)
+
+	var regions []string
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+	lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+		for i, arg := range args {
+			if arg == "-e" && strings.HasPrefix(args[i+1], "REGION=") {
+				regions = append(regions, strings.TrimPrefix(args[i+1], "REGION="))
+			}
+		}
+		return lib.DockerResult{}
+	}
+
+	_, _, err = captureOutput(func() error {
+		return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", filepath.Join(tmpDir, "logs"), "run", "deploy"})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"us-east-1", "eu-west-1"}, regions)
+
+	// Each cell is recorded as its own audit entry
+	gitRev, err := lib.GetGitRevision()
+	if err != nil {
+		gitRev = "unknown"
+	}
+	logs, err := lib.NewFileStore(filepath.Join(tmpDir, "logs")).LoadLogs("test-project", gitRev)
+	assert.NoError(t, err)
+	var cells []string
+	for _, log := range logs {
+		cells = append(cells, log.Matrix["region"])
+	}
+	assert.ElementsMatch(t, []string{"us-east-1", "eu-west-1"}, cells)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"gosonic/lib"
+
+	"github.com/urfave/cli/v2"
+)
+
+// version is set by release builds with -ldflags "-X main.version=v1.2.3"
+var version string
+
+// gosonicVersion returns the version recorded in run records, the module
+// version for go install builds or dev for local builds
+func gosonicVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// recordRun calls fn, which runs the given stages, as one run. The run is
+// recorded as running before fn is called and updated with its outcome, the
+// audit logs of its stages reference it by config.Run.
+func recordRun(ctx *cli.Context, config *Config, stages []string, fn func() error) error {
+	auditStore, err := createAuditStore(config, ctx)
+	if err != nil {
+		return fmt.Errorf("creating audit store: %w", err)
+	}
+
+	run := lib.NewRun(config.Project.Name, stages, config.Args, config.Vars, gosonicVersion())
+	if run.GitRevision, err = getGitRevision(); err != nil {
+		run.GitRevision = "unknown" // Don't fail if we can't get git revision
+	}
+	run.Branch, _ = getGitBranch()
+	if err := auditStore.StoreRun(run); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing run record: %v\n", err)
+	}
+
+	config.Run = &run
+	defer func() { config.Run = nil }()
+	err = fn()
+
+	status := lib.StatusSuccess
+	switch {
+	case errors.Is(ctx.Context.Err(), context.DeadlineExceeded):
+		status = lib.StatusTimeout
+	case ctx.Context.Err() != nil:
+		status = lib.StatusCancelled
+	case err != nil:
+		status = lib.StatusFailed
+	}
+	run.Finish(status, err)
+	if err := auditStore.StoreRun(run); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing run record: %v\n", err)
+	}
+	return err
+}
+
+// runID returns the ID of the current run, empty outside of a run
+func (c *Config) runID() string {
+	if c.Run == nil {
+		return ""
+	}
+	return c.Run.ID
+}
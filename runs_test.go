@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gosonic/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordRun(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "runs-sonic.yml")
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+stages:
+  build:
+    runner: "golang"
+    commands:
+      - "go build ./..."
+  test:
+    runner: "golang"
+    requires:
+      - "build"
+    commands:
+      - "go test ./..."
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	originalExecDocker := lib.ExecDocker
+	defer func() { lib.ExecDocker = originalExecDocker }()
+
+	tests := map[string]struct {
+		fail       bool
+		wantStatus string
+	}{
+		"success": {wantStatus: lib.StatusSuccess},
+		"failed":  {fail: true, wantStatus: lib.StatusFailed},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+				if tc.fail {
+					return lib.DockerResult{Error: fmt.Errorf("exit status 1"), ExitCode: 1}
+				}
+				return lib.DockerResult{}
+			}
+
+			logsDir := filepath.Join(t.TempDir(), "logs")
+			args := []string{"gosonic", "--sonic-file", configPath, "--audit-path", logsDir, "--var", "env=prod", "run", "build", "test"}
+			_, _, err := captureOutput(func() error { return run(args) })
+			if tc.fail {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			files, err := filepath.Glob(filepath.Join(logsDir, "runs", "test-project-*.json"))
+			assert.NoError(t, err)
+			if !assert.Len(t, files, 1) {
+				return
+			}
+			data, err := os.ReadFile(files[0])
+			assert.NoError(t, err)
+			var record lib.Run
+			assert.NoError(t, json.Unmarshal(data, &record))
+
+			assert.Equal(t, lib.AuditSchemaVersion, record.SchemaVersion)
+			assert.Equal(t, tc.wantStatus, record.Status)
+			assert.Equal(t, []string{"build", "test"}, record.Stages)
+			assert.Equal(t, args[1:], record.Args)
+			assert.Equal(t, map[string]string{"env": "prod"}, record.Vars)
+			assert.NotEmpty(t, record.Host)
+			assert.Equal(t, "dev", record.Version)
+			assert.NotNil(t, record.EndTime)
+
+			// The stages' logs reference the run
+			store := lib.NewFileStore(logsDir)
+			logs, err := store.LoadLogs("test-project", "")
+			assert.NoError(t, err)
+			assert.NotEmpty(t, logs)
+			for _, log := range logs {
+				assert.Equal(t, record.ID, log.RunID)
+			}
+		})
+	}
+}
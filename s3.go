@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"gosonic/lib"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultS3Region signs requests to custom endpoints without a configured
+// region, S3 compatible stores usually accept any region
+const defaultS3Region = "us-east-1"
+
+// S3Settings configures the connection to S3 or an S3 compatible store like
+// MinIO, Ceph or LocalStack. Empty fields use the standard AWS configuration.
+type S3Settings struct {
+	Endpoint  string `yaml:"s3endpoint"`   // URL of an S3 compatible store
+	Region    string `yaml:"s3region"`     // Region, us-east-1 for custom endpoints without one
+	PathStyle *bool  `yaml:"s3path_style"` // Address buckets as endpoint/bucket instead of bucket.endpoint, nil if not set
+	CABundle  string `yaml:"s3ca_bundle"`  // PEM file with the CAs the endpoint's certificate is verified with
+	Profile   string `yaml:"s3profile"`    // Profile of the shared AWS config and credentials files
+}
+
+// withDefaults fills the settings that aren't set from defaults
+func (s S3Settings) withDefaults(defaults S3Settings) S3Settings {
+	if s.Endpoint == "" {
+		s.Endpoint = defaults.Endpoint
+	}
+	if s.Region == "" {
+		s.Region = defaults.Region
+	}
+	if s.PathStyle == nil {
+		s.PathStyle = defaults.PathStyle
+	}
+	if s.CABundle == "" {
+		s.CABundle = defaults.CABundle
+	}
+	if s.Profile == "" {
+		s.Profile = defaults.Profile
+	}
+	return s
+}
+
+// auditS3Settings returns the S3 settings of the audit store, flags take
+// precedence over the config file
+func auditS3Settings(config *Config, ctx *cli.Context) S3Settings {
+	flags := S3Settings{
+		Endpoint: ctx.String("audit-s3-endpoint"),
+		Region:   ctx.String("audit-s3-region"),
+		CABundle: ctx.String("audit-s3-ca-bundle"),
+		Profile:  ctx.String("audit-s3-profile"),
+	}
+	if ctx.IsSet("audit-s3-path-style") {
+		flags.PathStyle = aws.Bool(ctx.Bool("audit-s3-path-style"))
+	}
+	return flags.withDefaults(config.Audit.S3)
+}
+
+// artifactS3Settings returns the S3 settings of the artifact store. Settings
+// it doesn't set itself are taken from the audit store, which usually lives
+// in the same object store.
+func artifactS3Settings(config *Config, ctx *cli.Context) S3Settings {
+	return config.Artifacts.S3.withDefaults(auditS3Settings(config, ctx))
+}
+
+// defaultCreateS3Client creates an S3 client from the settings and the
+// default AWS configuration: the environment, the shared config and
+// credentials files and the instance or task role
+func defaultCreateS3Client(ctx context.Context, settings S3Settings) (lib.S3Client, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if settings.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(settings.Region))
+	}
+	if settings.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(settings.Profile))
+	}
+	if settings.CABundle != "" {
+		pem, err := os.ReadFile(settings.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading S3 CA bundle: %w", err)
+		}
+		opts = append(opts, awsconfig.WithCustomCABundle(bytes.NewReader(pem)))
+	}
+	if settings.Endpoint != "" {
+		endpoint, err := url.Parse(settings.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q, must be an http or https URL", settings.Endpoint)
+		}
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS configuration: %w", err)
+	}
+	if settings.Endpoint != "" && cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = aws.ToBool(settings.PathStyle)
+		if settings.Endpoint != "" {
+			o.BaseEndpoint = aws.String(settings.Endpoint)
+			// Not every S3 compatible store supports the checksums the SDK
+			// adds by default, only send them where the API requires them
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+	}), nil
+}
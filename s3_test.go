@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gosonic/lib"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestAuditS3Settings(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "s3-settings-sonic.yml")
+	configData := []byte(`
+version: "1"
+project:
+  name: "test-project"
+audit:
+  store: "s3"
+  s3bucket: "audit-logs"
+  s3endpoint: "https://minio.internal:9000"
+  s3region: "eu-central-1"
+  s3path_style: true
+  s3ca_bundle: "/etc/ssl/minio-ca.pem"
+  s3profile: "minio"
+stages:
+  build:
+    runner: "golang"
+    commands:
+      - "go build ./..."
+`)
+	assert.NoError(t, os.WriteFile(configPath, configData, 0644))
+
+	originalCreateS3Client := createS3Client
+	defer func() { createS3Client = originalCreateS3Client }()
+
+	fromConfig := S3Settings{
+		Endpoint:  "https://minio.internal:9000",
+		Region:    "eu-central-1",
+		PathStyle: aws.Bool(true),
+		CABundle:  "/etc/ssl/minio-ca.pem",
+		Profile:   "minio",
+	}
+
+	tests := map[string]struct {
+		flags []string
+		env   map[string]string
+		want  S3Settings
+	}{
+		"from config": {
+			want: fromConfig,
+		},
+		"cli flags override config": {
+			flags: []string{
+				"--audit-s3-endpoint", "http://localhost:4566",
+				"--audit-s3-region", "us-west-2",
+				"--audit-s3-profile", "localstack",
+			},
+			want: S3Settings{
+				Endpoint:  "http://localhost:4566",
+				Region:    "us-west-2",
+				PathStyle: aws.Bool(true),
+				CABundle:  "/etc/ssl/minio-ca.pem",
+				Profile:   "localstack",
+			},
+		},
+		"cli flag turns off path style": {
+			flags: []string{"--audit-s3-path-style=false"},
+			want: S3Settings{
+				Endpoint:  "https://minio.internal:9000",
+				Region:    "eu-central-1",
+				PathStyle: aws.Bool(false),
+				CABundle:  "/etc/ssl/minio-ca.pem",
+				Profile:   "minio",
+			},
+		},
+		"env vars override config": {
+			env: map[string]string{
+				"SONIC_AUDIT_S3_ENDPOINT":  "https://ceph.internal",
+				"SONIC_AUDIT_S3_CA_BUNDLE": "/etc/ssl/ceph-ca.pem",
+			},
+			want: S3Settings{
+				Endpoint:  "https://ceph.internal",
+				Region:    "eu-central-1",
+				PathStyle: aws.Bool(true),
+				CABundle:  "/etc/ssl/ceph-ca.pem",
+				Profile:   "minio",
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			var got S3Settings
+			createS3Client = func(ctx context.Context, settings S3Settings) (lib.S3Client, error) {
+				got = settings
+				return nil, fmt.Errorf("no S3 in tests")
+			}
+
+			args := append([]string{"gosonic", "--sonic-file", configPath}, tc.flags...)
+			_, _, err := captureOutput(func() error { return run(append(args, "run", "build")) })
+			assert.ErrorContains(t, err, "no S3 in tests")
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestArtifactS3Settings(t *testing.T) {
+	config := &Config{}
+	config.Audit.S3 = S3Settings{
+		Endpoint:  "https://minio.internal:9000",
+		PathStyle: aws.Bool(true),
+		Profile:   "minio",
+	}
+	config.Artifacts.S3 = S3Settings{
+		Endpoint: "https://artifacts.internal",
+		Region:   "eu-west-1",
+	}
+	ctx := cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil)
+
+	// Settings the artifact store doesn't set are taken from the audit store
+	assert.Equal(t, S3Settings{
+		Endpoint:  "https://artifacts.internal",
+		Region:    "eu-west-1",
+		PathStyle: aws.Bool(true),
+		Profile:   "minio",
+	}, artifactS3Settings(config, ctx))
+
+	// An explicit false isn't replaced by the audit store's setting
+	config.Artifacts.S3.PathStyle = aws.Bool(false)
+	assert.Equal(t, aws.Bool(false), artifactS3Settings(config, ctx).PathStyle)
+}
+
+func TestDefaultCreateS3Client(t *testing.T) {
+	server := httptest.NewTLSServer(lib.NewFakeS3())
+	defer server.Close()
+
+	// Credentials and settings come from a profile of the shared files only
+	tmpDir := t.TempDir()
+	awsConfig := filepath.Join(tmpDir, "aws-config")
+	awsCredentials := filepath.Join(tmpDir, "aws-credentials")
+	assert.NoError(t, os.WriteFile(awsConfig, []byte("[profile minio]\noutput = json\n"), 0600))
+	assert.NoError(t, os.WriteFile(awsCredentials, []byte("[minio]\naws_access_key_id = minio\naws_secret_access_key = minio123\n"), 0600))
+	t.Setenv("AWS_CONFIG_FILE", awsConfig)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", awsCredentials)
+	for _, name := range []string{"AWS_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_ENDPOINT_URL", "AWS_ENDPOINT_URL_S3", "AWS_CA_BUNDLE"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+
+	caBundle := filepath.Join(tmpDir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caBundle, caPEM, 0644))
+
+	tests := map[string]struct {
+		settings  S3Settings
+		wantErr   string
+		wantS3Err bool
+	}{
+		"custom endpoint with CA bundle and profile": {
+			settings: S3Settings{
+				Endpoint:  server.URL,
+				PathStyle: aws.Bool(true),
+				CABundle:  caBundle,
+				Profile:   "minio",
+			},
+		},
+		"untrusted certificate": {
+			settings: S3Settings{
+				Endpoint:  server.URL,
+				PathStyle: aws.Bool(true),
+				Profile:   "minio",
+			},
+			wantS3Err: true,
+		},
+		"missing CA bundle": {
+			settings: S3Settings{
+				Endpoint: server.URL,
+				CABundle: filepath.Join(tmpDir, "missing.pem"),
+			},
+			wantErr: "reading S3 CA bundle",
+		},
+		"invalid endpoint": {
+			settings: S3Settings{Endpoint: "minio.internal:9000"},
+			wantErr:  "invalid S3 endpoint",
+		},
+		"unknown profile": {
+			settings: S3Settings{Endpoint: server.URL, Profile: "missing"},
+			wantErr:  "loading AWS configuration",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, err := defaultCreateS3Client(context.Background(), tc.settings)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			store := lib.NewS3Store(client, "audit-logs", "ci")
+			log := lib.AuditLog{
+				Project:     "test-project",
+				GitRevision: "abc123",
+				Stage:       "build",
+				StartTime:   time.Now(),
+				Status:      lib.StatusSuccess,
+			}
+			err = store.Store(log)
+			if tc.wantS3Err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			logs, err := store.LoadLogs("test-project", "abc123")
+			assert.NoError(t, err)
+			assert.Len(t, logs, 1)
+		})
+	}
+}
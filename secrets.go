@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gosonic/lib"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// secretsFileName is the encrypted secrets file written next to the sonic file
+const secretsFileName = "sonic.secrets.yml"
+
+// secretsKeyEnv holds the key of the encrypted secrets file. It is only read
+// from the environment, flags show up in the process list.
+const secretsKeyEnv = "SONIC_SECRETS_KEY"
+
+// secretsHeader is written at the top of every secrets file
+const secretsHeader = "# Encrypted with gosonic secrets set, decrypted with " + secretsKeyEnv + "\n"
+
+// Secret is a value passed to a stage without appearing on its command line
+// or in its logs. Without a source it is read from the host environment
+// variable Name.
+type Secret struct {
+	Name   string `yaml:"name"`             // Environment variable set in the container
+	Env    string `yaml:"env,omitempty"`    // Host environment variable holding the value
+	File   string `yaml:"file,omitempty"`   // Host file holding the value
+	Key    string `yaml:"key,omitempty"`    // Entry of the encrypted secrets file
+	Target string `yaml:"target,omitempty"` // Mount the value as a file at this path instead of setting Name
+}
+
+// SecretsFile holds secrets encrypted with the project's secrets key
+type SecretsFile struct {
+	Secrets map[string]string `yaml:"secrets"` // Key to encrypted value
+}
+
+// secretsPath returns the secrets file of a project
+func secretsPath(config *Config, configPath string) string {
+	if config.Project.SecretsFile != "" {
+		return config.Project.SecretsFile
+	}
+	return filepath.Join(filepath.Dir(configPath), secretsFileName)
+}
+
+// loadSecretsFile reads a secrets file, a missing file holds no secrets
+func loadSecretsFile(path string) (*SecretsFile, error) {
+	file := &SecretsFile{Secrets: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading secrets file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("parsing secrets file %s: %w", path, err)
+	}
+	if file.Secrets == nil {
+		file.Secrets = make(map[string]string)
+	}
+	return file, nil
+}
+
+// save writes the secrets file, readable only by the calling user
+func (f *SecretsFile) save(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString(secretsHeader)
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(f); err != nil {
+		return fmt.Errorf("encoding secrets file: %w", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing secrets file: %w", err)
+	}
+	return nil
+}
+
+// secretsKey reads the key of the secrets file from the environment
+func secretsKey() ([]byte, error) {
+	encoded := os.Getenv(secretsKeyEnv)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s is not set, create a key with gosonic secrets keygen", secretsKeyEnv)
+	}
+	key, err := lib.ParseSecretsKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", secretsKeyEnv, err)
+	}
+	return key, nil
+}
+
+// resolveSecrets reads the values of a stage's secrets from their sources
+func resolveSecrets(config *Config, stageName string, secrets []Secret) ([]lib.Secret, error) {
+	var result []lib.Secret
+	var file *SecretsFile
+	var key []byte
+	for _, secret := range secrets {
+		if secret.Name == "" {
+			return nil, fmt.Errorf("stage %q: secrets need a name", stageName)
+		}
+		sources := 0
+		for _, source := range []string{secret.Env, secret.File, secret.Key} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return nil, fmt.Errorf("stage %q: secret %s: set only one of env, file and key", stageName, secret.Name)
+		}
+
+		var value, source string
+		switch {
+		case secret.File != "":
+			source = "file:" + secret.File
+			data, err := os.ReadFile(secret.File)
+			if err != nil {
+				return nil, fmt.Errorf("stage %q: secret %s: %w", stageName, secret.Name, err)
+			}
+			value = string(data)
+
+		case secret.Key != "":
+			source = "key:" + secret.Key
+			if file == nil {
+				var err error
+				if file, err = loadSecretsFile(config.SecretsPath); err != nil {
+					return nil, err
+				}
+				if key, err = secretsKey(); err != nil {
+					return nil, fmt.Errorf("stage %q: secret %s: %w", stageName, secret.Name, err)
+				}
+			}
+			encrypted, ok := file.Secrets[secret.Key]
+			if !ok {
+				return nil, fmt.Errorf("stage %q: secret %s: key %s not found in %s", stageName, secret.Name, secret.Key, config.SecretsPath)
+			}
+			var err error
+			if value, err = lib.DecryptSecret(key, secret.Key, encrypted); err != nil {
+				return nil, fmt.Errorf("stage %q: secret %s: %w", stageName, secret.Name, err)
+			}
+
+		default:
+			env := secret.Env
+			if env == "" {
+				env = secret.Name
+			}
+			source = "env:" + env
+			var ok bool
+			if value, ok = os.LookupEnv(env); !ok {
+				return nil, fmt.Errorf("stage %q: secret %s: environment variable %s is not set", stageName, secret.Name, env)
+			}
+		}
+
+		result = append(result, lib.Secret{Name: secret.Name, Value: value, Target: secret.Target, Source: source})
+	}
+	return result, nil
+}
+
+// secretsCommand creates the command managing the encrypted secrets file
+func secretsCommand(config *Config) *cli.Command {
+	return &cli.Command{
+		Name:  "secrets",
+		Usage: "Manage the encrypted secrets file",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "keygen",
+				Usage: "Print a new key for " + secretsKeyEnv,
+				Action: func(ctx *cli.Context) error {
+					key, err := lib.GenerateSecretsKey()
+					if err != nil {
+						return err
+					}
+					fmt.Println(key)
+					return nil
+				},
+			},
+			{
+				Name:      "set",
+				Usage:     "Encrypt the value read from stdin and store it under key",
+				ArgsUsage: "key",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						return fmt.Errorf("usage: gosonic secrets set key < value")
+					}
+					name := ctx.Args().First()
+
+					key, err := secretsKey()
+					if err != nil {
+						return err
+					}
+					data, err := io.ReadAll(ctx.App.Reader)
+					if err != nil {
+						return fmt.Errorf("reading secret: %w", err)
+					}
+					// echo and heredocs add a newline that isn't part of the secret
+					value := strings.TrimSuffix(string(data), "\n")
+
+					file, err := loadSecretsFile(config.SecretsPath)
+					if err != nil {
+						return err
+					}
+					if file.Secrets[name], err = lib.EncryptSecret(key, name, value); err != nil {
+						return err
+					}
+					if err := file.save(config.SecretsPath); err != nil {
+						return err
+					}
+					fmt.Printf("Stored %s in %s\n", name, config.SecretsPath)
+					return nil
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List the keys in the secrets file",
+				Action: func(ctx *cli.Context) error {
+					file, err := loadSecretsFile(config.SecretsPath)
+					if err != nil {
+						return err
+					}
+					names := make([]string, 0, len(file.Secrets))
+					for name := range file.Secrets {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+					for _, name := range names {
+						fmt.Println(name)
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
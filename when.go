@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gosonic/lib"
+)
+
+// defaultChangedBase is the git ref changed files are compared against
+// when no base is configured
+const defaultChangedBase = "HEAD~1"
+
+// When defines conditions that must all hold for a stage to run
+type When struct {
+	Branch  []string          `yaml:"branch,omitempty"`  // Branch name globs, one of them must match
+	Vars    map[string]string `yaml:"vars,omitempty"`    // Execution variables that must have the given values
+	Env     map[string]string `yaml:"env,omitempty"`     // Environment variables that must have the given values
+	Changed *Changed          `yaml:"changed,omitempty"` // Files that must have changed
+}
+
+// Changed matches when any file changed since a git ref matches one of the paths
+type Changed struct {
+	Paths []string `yaml:"paths"`          // Globs relative to the repository root, ** matches any depth
+	Base  string   `yaml:"base,omitempty"` // Git ref to compare against, defaults to HEAD~1
+}
+
+// evaluate reports whether all conditions hold. If not, it also returns
+// the reason for the first condition that failed.
+func (w *When) evaluate(vars execVars) (bool, string, error) {
+	if w == nil {
+		return true, "", nil
+	}
+
+	if len(w.Branch) > 0 {
+		branch, err := getGitBranch()
+		if err != nil {
+			return false, "", fmt.Errorf("getting git branch: %w", err)
+		}
+		ok, err := lib.MatchAnyGlob(w.Branch, branch)
+		if err != nil {
+			return false, "", err
+		}
+		if !ok {
+			return false, fmt.Sprintf("branch %q does not match %s", branch, strings.Join(w.Branch, ", ")), nil
+		}
+	}
+
+	for _, name := range sortedKeys(w.Vars) {
+		if vars[name] != w.Vars[name] {
+			return false, fmt.Sprintf("var %s is %q, not %q", name, vars[name], w.Vars[name]), nil
+		}
+	}
+
+	for _, name := range sortedKeys(w.Env) {
+		if value := os.Getenv(name); value != w.Env[name] {
+			return false, fmt.Sprintf("environment variable %s is %q, not %q", name, value, w.Env[name]), nil
+		}
+	}
+
+	if w.Changed != nil {
+		base := w.Changed.Base
+		if base == "" {
+			base = defaultChangedBase
+		}
+		files, err := getChangedFiles(base)
+		if err != nil {
+			return false, "", err
+		}
+
+		changed := false
+		for _, file := range files {
+			ok, err := lib.MatchAnyGlob(w.Changed.Paths, file)
+			if err != nil {
+				return false, "", err
+			}
+			if ok {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return false, fmt.Sprintf("no files matching %s changed since %s", strings.Join(w.Changed.Paths, ", "), base), nil
+		}
+	}
+
+	return true, "", nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
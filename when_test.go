@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gosonic/lib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWhenEvaluate(t *testing.T) {
+	originalGetGitBranch := getGitBranch
+	originalGetChangedFiles := getChangedFiles
+	defer func() {
+		getGitBranch = originalGetGitBranch
+		getChangedFiles = originalGetChangedFiles
+	}()
+
+	var changedBase string
+	getGitBranch = func() (string, error) { return "release/1.2", nil }
+	getChangedFiles = func(base string) ([]string, error) {
+		changedBase = base
+		return []string{"README.md", "lib/docker.go"}, nil
+	}
+	t.Setenv("SONIC_TEST_CI", "true")
+
+	tests := map[string]struct {
+		when     *When
+		vars     execVars
+		want     bool
+		wantBase string
+	}{
+		"no conditions": {
+			when: nil,
+			want: true,
+		},
+		"branch matches": {
+			when: &When{Branch: []string{"main", "release/*"}},
+			want: true,
+		},
+		"branch does not match": {
+			when: &When{Branch: []string{"main"}},
+			want: false,
+		},
+		"var matches": {
+			when: &When{Vars: map[string]string{"env": "prod"}},
+			vars: execVars{"env": "prod"},
+			want: true,
+		},
+		"var missing": {
+			when: &When{Vars: map[string]string{"env": "prod"}},
+			want: false,
+		},
+		"env matches": {
+			when: &When{Env: map[string]string{"SONIC_TEST_CI": "true"}},
+			want: true,
+		},
+		"env differs": {
+			when: &When{Env: map[string]string{"SONIC_TEST_CI": "false"}},
+			want: false,
+		},
+		"changed files match": {
+			when:     &When{Changed: &Changed{Paths: []string{"lib/**/*.go"}}},
+			want:     true,
+			wantBase: "HEAD~1",
+		},
+		"no matching changes": {
+			when:     &When{Changed: &Changed{Paths: []string{"docs/**"}, Base: "origin/main"}},
+			want:     false,
+			wantBase: "origin/main",
+		},
+		"all conditions must hold": {
+			when: &When{
+				Branch: []string{"release/*"},
+				Vars:   map[string]string{"env": "staging"},
+			},
+			vars: execVars{"env": "prod"},
+			want: false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			changedBase = ""
+			ok, reason, err := tc.when.evaluate(tc.vars)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, ok)
+			assert.Equal(t, tc.want, reason == "")
+			assert.Equal(t, tc.wantBase, changedBase)
+		})
+	}
+}
+
+func TestConditionalStageExecution(t *testing.T) {
+	oldGoTest := os.Getenv("GO_TEST")
+	os.Setenv("GO_TEST", "1")
+	defer func() { os.Setenv("GO_TEST", oldGoTest) }()
+
+	configData := `
+version: "1"
+project:
+  name: "test-project"
+  allow_skipped_requirements: %s
+stages:
+  deploy-docs:
+    runner: "alpine"
+    commands:
+      - "echo deploy"
+    when:
+      vars:
+        env: "prod"
+  notify:
+    runner: "alpine"
+    requires: ["deploy-docs"]
+    commands:
+      - "echo notify"
+`
+
+	tests := map[string]struct {
+		allowSkipped string
+		wantErr      bool
+	}{
+		"skipped requirement not satisfied": {allowSkipped: "false", wantErr: true},
+		"skipped requirement satisfied":     {allowSkipped: "true"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			configPath := filepath.Join(tmpDir, "when-sonic.yml")
+			err := os.WriteFile(configPath, []byte(fmt.Sprintf(configData, tc.allowSkipped)), 0644)
+			assert.NoError(t, err)
+
+			var executed int
+			originalExecDocker := lib.ExecDocker
+			defer func() { lib.ExecDocker = originalExecDocker }()
+			lib.ExecDocker = func(ctx context.Context, args []string, stdout, stderr io.Writer) lib.DockerResult {
+				if args[1] != "run" {
+					return lib.DockerResult{} // The runner image is inspected afterwards
+				}
+				executed++
+				return lib.DockerResult{}
+			}
+
+			auditPath := filepath.Join(tmpDir, "logs")
+			stdout, _, err := captureOutput(func() error {
+				return run([]string{"gosonic", "--sonic-file", configPath, "--audit-path", auditPath, "run", "deploy-docs", "notify"})
+			})
+			assert.Contains(t, stdout, `Skipping stage deploy-docs: var env is "", not "prod"`)
+
+			if tc.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, 0, executed)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, executed)
+			}
+
+			// The skipped stage is recorded in the audit store
+			gitRev, err := lib.GetGitRevision()
+			if err != nil {
+				gitRev = "unknown"
+			}
+			logs, err := lib.NewFileStore(auditPath).LoadLogs("test-project", gitRev)
+			assert.NoError(t, err)
+			statuses := map[string]string{}
+			for _, log := range logs {
+				statuses[log.Stage] = log.Status
+			}
+			assert.Equal(t, "skipped", statuses["deploy-docs"])
+		})
+	}
+}